@@ -0,0 +1,165 @@
+package stc
+
+import (
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+	"sort"
+)
+
+func trustLineFlags(authorized, maintain, clawback bool) uint32 {
+	var flags uint32
+	if authorized {
+		flags |= uint32(stx.AUTHORIZED_FLAG)
+	}
+	if maintain {
+		flags |= uint32(stx.AUTHORIZED_TO_MAINTAIN_LIABILITIES_FLAG)
+	}
+	if clawback {
+		flags |= uint32(stx.TRUSTLINE_CLAWBACK_ENABLED_FLAG)
+	}
+	return flags
+}
+
+func copyAccountID(a *AccountID) *AccountID {
+	if a == nil {
+		return nil
+	}
+	ret := *a
+	return &ret
+}
+
+// Convert the account to an stx.AccountEntry, as it would appear in
+// the ledger.  Signers are sorted by key, the master key weight is
+// taken from the signer whose key is the account itself (0 if there
+// is none), and extensions are filled in only as far as needed to
+// hold the liabilities, sponsorship, and sequence number information
+// reported by horizon.
+func (ae *HorizonAccountEntry) ToAccountEntry() *stx.AccountEntry {
+	ret := &stx.AccountEntry{
+		AccountID:     ae.Account_id,
+		Balance:       int64(ae.Balance),
+		SeqNum:        stx.SequenceNumber(ae.Sequence),
+		NumSubEntries: ae.Subentry_count,
+		InflationDest: copyAccountID(ae.Inflation_destination),
+		HomeDomain:    ae.Home_domain,
+		Thresholds: stx.Thresholds{
+			0,
+			ae.Thresholds.Low_threshold,
+			ae.Thresholds.Med_threshold,
+			ae.Thresholds.High_threshold,
+		},
+	}
+	if ae.Flags.Auth_required {
+		ret.Flags |= uint32(stx.AUTH_REQUIRED_FLAG)
+	}
+	if ae.Flags.Auth_revocable {
+		ret.Flags |= uint32(stx.AUTH_REVOCABLE_FLAG)
+	}
+	if ae.Flags.Auth_immutable {
+		ret.Flags |= uint32(stx.AUTH_IMMUTABLE_FLAG)
+	}
+	if ae.Flags.Auth_clawback_enabled {
+		ret.Flags |= uint32(stx.AUTH_CLAWBACK_ENABLED_FLAG)
+	}
+
+	signers := append([]HorizonSigner(nil), ae.Signers...)
+	sort.SliceStable(signers, func(i, j int) bool {
+		return stcdetail.XdrToBin(&signers[i].Key) <
+			stcdetail.XdrToBin(&signers[j].Key)
+	})
+	master := ae.Account_id.String()
+	var sponsors []stx.SponsorshipDescriptor
+	sponsored := false
+	for i := range signers {
+		s := &signers[i]
+		if s.Key.String() == master {
+			ret.Thresholds[stx.THRESHOLD_MASTER_WEIGHT] = uint8(s.Weight)
+			continue
+		}
+		ret.Signers = append(ret.Signers, stx.Signer{
+			Key:    s.Key,
+			Weight: s.Weight,
+		})
+		sponsors = append(sponsors, copyAccountID(s.Sponsor))
+		if s.Sponsor != nil {
+			sponsored = true
+		}
+	}
+
+	needV3 := ae.Seq_ledger != 0 || ae.Seq_time != 0
+	needV2 := needV3 || sponsored ||
+		ae.Num_sponsored != 0 || ae.Num_sponsoring != 0
+	if !needV2 && ae.Buying_liabilities == 0 &&
+		ae.Selling_liabilities == 0 {
+		return ret
+	}
+	ret.Ext.V = 1
+	v1 := ret.Ext.V1()
+	v1.Liabilities.Buying = int64(ae.Buying_liabilities)
+	v1.Liabilities.Selling = int64(ae.Selling_liabilities)
+	if !needV2 {
+		return ret
+	}
+	v1.Ext.V = 2
+	v2 := v1.Ext.V2()
+	v2.NumSponsored = ae.Num_sponsored
+	v2.NumSponsoring = ae.Num_sponsoring
+	v2.SignerSponsoringIDs = sponsors
+	if !needV3 {
+		return ret
+	}
+	v2.Ext.V = 3
+	v3 := v2.Ext.V3()
+	v3.SeqLedger = ae.Seq_ledger
+	v3.SeqTime = stx.TimePoint(ae.Seq_time)
+	return ret
+}
+
+// Convert the account's non-native balances and liquidity pool
+// shares to stx.TrustLineEntry structures, as they would appear in
+// the ledger.
+func (ae *HorizonAccountEntry) ToTrustLineEntries() []stx.TrustLineEntry {
+	ret := make([]stx.TrustLineEntry, 0,
+		len(ae.Balances)+len(ae.Pool_shares))
+	for i := range ae.Balances {
+		b := &ae.Balances[i]
+		tl := stx.TrustLineEntry{
+			AccountID: ae.Account_id,
+			Balance:   int64(b.Balance),
+			Limit:     int64(b.Limit),
+			Flags: trustLineFlags(b.Is_authorized,
+				b.Is_authorized_to_maintain_liabilities,
+				b.Is_clawback_enabled),
+		}
+		tl.Asset.Type = b.Asset.Type
+		switch b.Asset.Type {
+		case stx.ASSET_TYPE_CREDIT_ALPHANUM4:
+			*tl.Asset.AlphaNum4() = *b.Asset.AlphaNum4()
+		case stx.ASSET_TYPE_CREDIT_ALPHANUM12:
+			*tl.Asset.AlphaNum12() = *b.Asset.AlphaNum12()
+		}
+		if b.Buying_liabilities != 0 || b.Selling_liabilities != 0 {
+			tl.Ext.V = 1
+			tl.Ext.V1().Liabilities = stx.Liabilities{
+				Buying:  int64(b.Buying_liabilities),
+				Selling: int64(b.Selling_liabilities),
+			}
+		}
+		ret = append(ret, tl)
+	}
+	for i := range ae.Pool_shares {
+		ps := &ae.Pool_shares[i]
+		tl := stx.TrustLineEntry{
+			AccountID: ae.Account_id,
+			Balance:   int64(ps.Balance),
+			Limit:     int64(ps.Limit),
+			Flags: trustLineFlags(ps.Is_authorized,
+				ps.Is_authorized_to_maintain_liabilities,
+				ps.Is_clawback_enabled),
+		}
+		tl.Asset.Type = stx.ASSET_TYPE_POOL_SHARE
+		*tl.Asset.LiquidityPoolID() = ps.Liquidity_pool_id
+		ret = append(ret, tl)
+	}
+	return ret
+}
@@ -0,0 +1,222 @@
+package stc
+
+import (
+	"encoding/json"
+	"github.com/xdrpp/goxdr/xdr"
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+	"os"
+	"sync"
+	"time"
+)
+
+// The TTL of an AccountCache whose TTL field is zero.
+const DefaultAccountCacheTTL = 30 * time.Second
+
+type accountCacheEntry struct {
+	Fetched time.Time
+	Entry   *HorizonAccountEntry
+}
+
+// A concurrency-safe cache of account entries, keyed by account (in
+// strkey format).  When StellarNet.AccountCache is non-nil,
+// GetAccountEntry returns entries from the cache while they are
+// fresh, and Post, PostWait, and RPCClient.Submit invalidate the
+// entries of accounts a transaction affects.  A nil *AccountCache is
+// a valid, empty cache that never stores anything.
+type AccountCache struct {
+	// How long entries remain fresh.  If zero, uses
+	// DefaultAccountCacheTTL.
+	TTL time.Duration
+
+	// If non-empty, Save (and StellarNet.Save) write the cache to
+	// this file, so that Load can restore it in a later process.
+	// Invalidating entries saves the cache immediately.
+	Path string
+
+	// If true, GetAccountEntry returns an entry regardless of its age
+	// when the network cannot be reached, which allows building
+	// transactions offline.
+	StaleIfError bool
+
+	mu      sync.Mutex
+	entries map[string]accountCacheEntry
+	dirty   bool
+}
+
+// Create an AccountCache with a particular TTL, and if path is
+// non-empty, persist it in path (loading any entries path already
+// contains).
+func NewAccountCache(ttl time.Duration, path string) *AccountCache {
+	ret := &AccountCache{TTL: ttl, Path: path}
+	if path != "" {
+		ret.Load()
+	}
+	return ret
+}
+
+func (c *AccountCache) ttl() time.Duration {
+	if c.TTL == 0 {
+		return DefaultAccountCacheTTL
+	}
+	return c.TTL
+}
+
+// Return a copy of the cached entry for acct and the time it was
+// fetched, regardless of its age, or nil if there is no entry.
+func (c *AccountCache) GetStale(acct string) (
+	*HorizonAccountEntry, time.Time) {
+	if c == nil {
+		return nil, time.Time{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ce, ok := c.entries[acct]; ok {
+		return ce.Entry.Copy(), ce.Fetched
+	}
+	return nil, time.Time{}
+}
+
+// Return a copy of the cached entry for acct, or nil if there is no
+// entry or it is older than the TTL.
+func (c *AccountCache) Get(acct string) *HorizonAccountEntry {
+	ret, fetched := c.GetStale(acct)
+	if ret != nil && time.Since(fetched) >= c.ttl() {
+		return nil
+	}
+	return ret
+}
+
+// Add a copy of an account entry to the cache, replacing any
+// existing entry.  The change is not written to Path until Save.
+func (c *AccountCache) Put(ae *HorizonAccountEntry) {
+	if c == nil {
+		return
+	}
+	entry := ae.Copy()
+	entry.Net = nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]accountCacheEntry)
+	}
+	c.entries[ae.Account_id.String()] = accountCacheEntry{
+		Fetched: time.Now(),
+		Entry:   entry,
+	}
+	c.dirty = true
+}
+
+// Write the cache to Path if it has changed since it was last loaded
+// or saved.
+func (c *AccountCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	return c.save()
+}
+
+// Remove the entries of particular accounts (in strkey format).
+func (c *AccountCache) Invalidate(accts ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := false
+	for _, acct := range accts {
+		if _, ok := c.entries[acct]; ok {
+			delete(c.entries, acct)
+			changed = true
+		}
+	}
+	if changed {
+		c.save()
+	}
+}
+
+// Remove all entries.
+func (c *AccountCache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.save()
+}
+
+// Remove the entries of all accounts mentioned in a transaction
+// (including accounts the transaction merely pays or references).
+func (c *AccountCache) InvalidateTx(e *TransactionEnvelope) {
+	if c == nil {
+		return
+	}
+	var accts []string
+	stcdetail.ForEachXdrType(e, func(k interface {
+		ToSignerKey() stx.SignerKey
+	}) {
+		accts = append(accts, k.ToSignerKey().String())
+	})
+	c.Invalidate(accts...)
+}
+
+// Remove the entries of all accounts whose ledger entries (including
+// trustlines, offers, and data entries) changed according to
+// transaction metadata, such as the LedgerEntryChanges and
+// TransactionMeta in StellarMetas.  This catches accounts that a
+// transaction affects without mentioning, such as the owners of
+// offers it crosses.
+func (c *AccountCache) InvalidateMetas(ms ...xdr.XdrType) {
+	if c == nil {
+		return
+	}
+	var accts []string
+	for _, md := range stcdetail.GetMetaDeltas(ms...) {
+		if acct := md.AccountID(); acct != nil {
+			accts = append(accts, acct.String())
+		}
+	}
+	c.Invalidate(accts...)
+}
+
+// Replace the contents of the cache with the contents of Path.  The
+// cache is left unchanged if Path does not exist.
+func (c *AccountCache) Load() error {
+	data, _, err := stcdetail.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var entries map[string]accountCacheEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries, c.dirty = entries, false
+	return nil
+}
+
+// Save the cache to Path; must be called with c.mu held.  Callers
+// that invalidate entries ignore errors, since the cache can always
+// be refilled from the network.
+func (c *AccountCache) save() error {
+	if c.Path == "" {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err == nil {
+		err = stcdetail.SafeWriteFile(c.Path, string(data), 0600)
+	}
+	if err == nil {
+		c.dirty = false
+	}
+	return err
+}
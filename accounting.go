@@ -0,0 +1,232 @@
+package stc
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/xdrpp/goxdr/xdr"
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A change in an account's balance of one asset, as computed by
+// AccountingEntries.  OpIndex is the 0-based index of the operation
+// that caused the change, or -1 for changes made by the transaction
+// as a whole, such as the fee (for which OpType is "fee" and Fee is
+// the fee charged).  Counterparty is the first account other than
+// the account itself that the operation involves, if any.  Amount is
+// positive for credits and negative for debits, and Balance is the
+// account's balance of Asset after the change.
+type AccountingEntry struct {
+	Time         time.Time             `json:"time"`
+	TxHash       string                `json:"tx_hash"`
+	Ledger       uint32                `json:"ledger"`
+	OpIndex      int                   `json:"op_index"`
+	OpType       string                `json:"op_type"`
+	Counterparty string                `json:"counterparty"`
+	Asset        string                `json:"asset"`
+	Amount       stcdetail.JsonInt64e7 `json:"amount"`
+	Fee          stcdetail.JsonInt64e7 `json:"fee"`
+	Memo         string                `json:"memo"`
+	Balance      stcdetail.JsonInt64e7 `json:"balance"`
+	PagingToken  string                `json:"paging_token"`
+}
+
+// Field names of AccountingEntry in CSV exports (and in JSON), in
+// the order returned by CSVRecord.
+var AccountingCSVHeader = []string{
+	"time", "tx_hash", "ledger", "op_index", "op_type", "counterparty",
+	"asset", "amount", "fee", "memo", "balance", "paging_token",
+}
+
+// Return the entry's fields as strings, in the order of
+// AccountingCSVHeader.
+func (ae *AccountingEntry) CSVRecord() []string {
+	amount, _ := ae.Amount.MarshalText()
+	fee, _ := ae.Fee.MarshalText()
+	balance, _ := ae.Balance.MarshalText()
+	return []string{
+		ae.Time.UTC().Format(time.RFC3339),
+		ae.TxHash,
+		strconv.FormatUint(uint64(ae.Ledger), 10),
+		strconv.Itoa(ae.OpIndex),
+		ae.OpType,
+		ae.Counterparty,
+		ae.Asset,
+		string(amount),
+		string(fee),
+		ae.Memo,
+		string(balance),
+		ae.PagingToken,
+	}
+}
+
+// Render a memo as text, a decimal ID, or a hex hash.
+func memoString(m *stx.Memo) string {
+	switch m.Type {
+	case stx.MEMO_TEXT:
+		return *m.Text()
+	case stx.MEMO_ID:
+		return strconv.FormatUint(uint64(*m.Id()), 10)
+	case stx.MEMO_HASH:
+		return hex.EncodeToString(m.Hash()[:])
+	case stx.MEMO_RETURN:
+		return hex.EncodeToString(m.RetHash()[:])
+	}
+	return ""
+}
+
+// If e is a fee-bump transaction, return its inner transaction.
+// Otherwise, return e.
+func innerEnvelope(e *stx.TransactionEnvelope) *stx.TransactionEnvelope {
+	if e.Type != stx.ENVELOPE_TYPE_TX_FEE_BUMP {
+		return e
+	}
+	ret := &stx.TransactionEnvelope{Type: stx.ENVELOPE_TYPE_TX}
+	*ret.V1() = *e.FeeBump().Tx.InnerTx.V1()
+	return ret
+}
+
+// Return the first account other than self involved in an operation
+// (not counting asset issuers), or "".
+func counterparty(op *stx.Operation, src *stx.MuxedAccount,
+	self string) string {
+	ret := ""
+	check := func(acct string) {
+		if ret == "" && acct != self {
+			ret = acct
+		}
+	}
+	if op.SourceAccount != nil {
+		src = op.SourceAccount
+	}
+	check(src.ToSignerKey().String())
+	stcdetail.ForEachXdr(&op.Body, func(t xdr.XdrType) bool {
+		switch v := t.XdrPointer().(type) {
+		case *stx.Asset, *stx.ChangeTrustAsset, *stx.TrustLineAsset:
+			return true
+		case *stx.AccountID:
+			check(v.String())
+			return true
+		case *stx.MuxedAccount:
+			check(v.ToSignerKey().String())
+			return true
+		}
+		return false
+	})
+	return ret
+}
+
+// Return the asset and balance held in a ledger entry if it is
+// acct's account entry or one of acct's trustlines.
+func entryBalance(e *stx.LedgerEntry, acct string) (string, int64, bool) {
+	switch e.Data.Type {
+	case stx.ACCOUNT:
+		if ae := e.Data.Account(); ae.AccountID.String() == acct {
+			return "native", int64(ae.Balance), true
+		}
+	case stx.TRUSTLINE:
+		if tl := e.Data.TrustLine(); tl.AccountID.String() == acct {
+			return tl.Asset.String(), int64(tl.Balance), true
+		}
+	}
+	return "", 0, false
+}
+
+// Append an entry for each of acct's balances changed in ms.
+func balanceChanges(out []AccountingEntry, proto *AccountingEntry,
+	acct string, ms ...xdr.XdrType) []AccountingEntry {
+	for _, md := range stcdetail.GetMetaDeltas(ms...) {
+		var oldBal, newBal int64
+		var asset string
+		var ok bool
+		if md.Old != nil {
+			asset, oldBal, ok = entryBalance(md.Old, acct)
+		}
+		if md.New != nil {
+			asset, newBal, ok = entryBalance(md.New, acct)
+		}
+		if !ok || oldBal == newBal {
+			continue
+		}
+		ae := *proto
+		ae.Asset = asset
+		ae.Amount = stcdetail.JsonInt64e7(newBal - oldBal)
+		ae.Balance = stcdetail.JsonInt64e7(newBal)
+		out = append(out, ae)
+	}
+	return out
+}
+
+// Compute the changes a transaction made to an account's balances,
+// from the transaction's metadata.  Entries are ordered as the
+// changes happened: first the fee, then the changes made by each
+// operation.  Fails if the metadata uses a version of
+// TransactionMeta that the stx package does not support.
+func AccountingEntries(r *HorizonTxResult, acct *AccountID) (
+	[]AccountingEntry, error) {
+	self := acct.String()
+	e := innerEnvelope(&r.Env)
+	ops := e.Operations()
+	src := (&TransactionEnvelope{TransactionEnvelope: e}).SourceAccount()
+	proto := AccountingEntry{
+		Time:        r.Time,
+		TxHash:      fmt.Sprintf("%x", r.Txhash[:]),
+		Ledger:      r.Ledger,
+		OpIndex:     -1,
+		PagingToken: r.PagingToken,
+	}
+	switch e.Type {
+	case stx.ENVELOPE_TYPE_TX_V0:
+		proto.Memo = memoString(&e.V0().Tx.Memo)
+	case stx.ENVELOPE_TYPE_TX:
+		proto.Memo = memoString(&e.V1().Tx.Memo)
+	}
+
+	fee := proto
+	fee.OpType = "fee"
+	ret := balanceChanges(nil, &fee, self,
+		stx.XDR_LedgerEntryChanges(&r.FeeMeta))
+	for i := range ret {
+		ret[i].Fee = -ret[i].Amount
+	}
+
+	var opMetas []stx.OperationMeta
+	var txBefore, txAfter *stx.LedgerEntryChanges
+	switch m := &r.ResultMeta; m.V {
+	case 0:
+		opMetas = *m.Operations()
+	case 1:
+		opMetas, txBefore = m.V1().Operations, &m.V1().TxChanges
+	case 2:
+		opMetas, txBefore = m.V2().Operations, &m.V2().TxChangesBefore
+		txAfter = &m.V2().TxChangesAfter
+	default:
+		return nil, horizonFailure(fmt.Sprintf(
+			"unsupported TransactionMeta version %d", m.V))
+	}
+
+	tx := proto
+	tx.OpType = "transaction"
+	if txBefore != nil {
+		ret = balanceChanges(ret, &tx, self,
+			stx.XDR_LedgerEntryChanges(txBefore))
+	}
+	for i := range opMetas {
+		op := proto
+		op.OpIndex = i
+		if ops != nil && i < len(*ops) {
+			op.OpType = strings.ToLower((*ops)[i].Body.Type.String())
+			op.Counterparty = counterparty(&(*ops)[i], src, self)
+		}
+		ret = balanceChanges(ret, &op, self,
+			stx.XDR_LedgerEntryChanges(&opMetas[i].Changes))
+	}
+	if txAfter != nil {
+		ret = balanceChanges(ret, &tx, self,
+			stx.XDR_LedgerEntryChanges(txAfter))
+	}
+	return ret, nil
+}
@@ -0,0 +1,74 @@
+package stc
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// The network operations on which StellarNet's network methods are
+// built.  By default, a StellarNet talks to horizon through
+// HorizonBackend, but setting StellarNet.Backend allows these
+// operations to be replaced, for example by the in-memory fake in
+// package stctest, so that code using StellarNet can be tested
+// without network access.
+//
+// The ctx argument passed to backend methods is never nil.  Methods
+// that return structures containing a Net field need not set it, as
+// StellarNet sets it to itself.
+type NetBackend interface {
+	// Fetch an account, where acct is in strkey format.
+	GetAccountEntry(ctx context.Context, acct string) (
+		*HorizonAccountEntry, error)
+
+	// Fetch recent fee statistics.
+	GetFeeStats(ctx context.Context) (*FeeStats, error)
+
+	// Fetch the latest ledger header.
+	GetLedgerHeader(ctx context.Context) (*LedgerHeader, error)
+
+	// Submit a transaction, returning TxFailure if it fails.
+	Post(ctx context.Context, e *TransactionEnvelope) (
+		*TransactionResult, error)
+
+	// Look up a transaction by its hex-encoded hash.
+	GetTxResult(ctx context.Context, txid string) (*HorizonTxResult, error)
+
+	// Fetch one page of a collection in the format of horizon's
+	// _embedded.records, along with the query for the next page.
+	// query is either a horizon query relative to the base URL (e.g.,
+	// "accounts/ACCOUNT/transactions?order=desc") or the next query
+	// returned by a previous call.  An empty page marks the end of
+	// the collection.
+	GetPage(ctx context.Context, query string) (
+		records []json.RawMessage, next string, err error)
+
+	// Call cb on the JSON of each new record of a horizon query as
+	// it is created, until ctx is done or cb returns an error.
+	Stream(ctx context.Context, query string,
+		cb func(json.RawMessage) error) error
+}
+
+// The default NetBackend, which sends requests to the horizon server
+// at Net.Horizon.
+type HorizonBackend struct {
+	Net *StellarNet
+}
+
+var _ NetBackend = HorizonBackend{}
+
+func (net *StellarNet) backend() NetBackend {
+	if net.Backend != nil {
+		return net.Backend
+	}
+	return HorizonBackend{net}
+}
+
+func (net *StellarNet) streamRaw(ctx context.Context, query string,
+	cb func(json.RawMessage) error) error {
+	return net.backend().Stream(ctxOrBackground(ctx), query, cb)
+}
+
+func (net *StellarNet) getPage(ctx context.Context, query string) (
+	[]json.RawMessage, string, error) {
+	return net.backend().GetPage(ctxOrBackground(ctx), query)
+}
@@ -0,0 +1,242 @@
+package stc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A claim predicate as horizon represents it in JSON.
+type horizonPredicate struct {
+	Unconditional    bool
+	And              []horizonPredicate
+	Or               []horizonPredicate
+	Not              *horizonPredicate
+	Abs_before       string
+	Abs_before_epoch string
+	Rel_before       string
+}
+
+func (jp *horizonPredicate) toPredicate(p *stx.ClaimPredicate) error {
+	var err error
+	switch {
+	case jp.And != nil || jp.Or != nil:
+		sub := jp.And
+		p.Type = stx.CLAIM_PREDICATE_AND
+		if jp.Or != nil {
+			sub = jp.Or
+			p.Type = stx.CLAIM_PREDICATE_OR
+		}
+		ps := make([]stx.ClaimPredicate, len(sub))
+		for i := range sub {
+			if err = sub[i].toPredicate(&ps[i]); err != nil {
+				return err
+			}
+		}
+		if p.Type == stx.CLAIM_PREDICATE_AND {
+			*p.AndPredicates() = ps
+		} else {
+			*p.OrPredicates() = ps
+		}
+	case jp.Not != nil:
+		p.Type = stx.CLAIM_PREDICATE_NOT
+		*p.NotPredicate() = new(stx.ClaimPredicate)
+		return jp.Not.toPredicate(*p.NotPredicate())
+	case jp.Abs_before_epoch != "":
+		p.Type = stx.CLAIM_PREDICATE_BEFORE_ABSOLUTE_TIME
+		*p.AbsBefore(), err = strconv.ParseInt(jp.Abs_before_epoch, 10, 64)
+	case jp.Abs_before != "":
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339, jp.Abs_before); err == nil {
+			p.Type = stx.CLAIM_PREDICATE_BEFORE_ABSOLUTE_TIME
+			*p.AbsBefore() = t.Unix()
+		}
+	case jp.Rel_before != "":
+		p.Type = stx.CLAIM_PREDICATE_BEFORE_RELATIVE_TIME
+		*p.RelBefore(), err = strconv.ParseInt(jp.Rel_before, 10, 64)
+	case jp.Unconditional:
+		p.Type = stx.CLAIM_PREDICATE_UNCONDITIONAL
+	default:
+		return horizonFailure("unknown claim predicate")
+	}
+	return err
+}
+
+// Render a claim predicate as a human-readable expression.
+func predicateString(p *stx.ClaimPredicate) string {
+	switch p.Type {
+	case stx.CLAIM_PREDICATE_UNCONDITIONAL:
+		return "unconditional"
+	case stx.CLAIM_PREDICATE_AND, stx.CLAIM_PREDICATE_OR:
+		var ps []stx.ClaimPredicate
+		var op string
+		if p.Type == stx.CLAIM_PREDICATE_AND {
+			ps, op = *p.AndPredicates(), " and "
+		} else {
+			ps, op = *p.OrPredicates(), " or "
+		}
+		s := make([]string, len(ps))
+		for i := range ps {
+			s[i] = predicateString(&ps[i])
+		}
+		return "(" + strings.Join(s, op) + ")"
+	case stx.CLAIM_PREDICATE_NOT:
+		if *p.NotPredicate() == nil {
+			return "not (unconditional)"
+		}
+		return "not " + predicateString(*p.NotPredicate())
+	case stx.CLAIM_PREDICATE_BEFORE_ABSOLUTE_TIME:
+		return fmt.Sprintf("before %d (%s)", *p.AbsBefore(),
+			time.Unix(*p.AbsBefore(), 0).Format(time.UnixDate))
+	case stx.CLAIM_PREDICATE_BEFORE_RELATIVE_TIME:
+		return fmt.Sprintf("within %d seconds of creation", *p.RelBefore())
+	}
+	return fmt.Sprintf("ClaimPredicate.Type#%d", int32(p.Type))
+}
+
+// Report whether a claim predicate is satisfied in a ledger with a
+// particular close time.  Relative time predicates are evaluated
+// against created, the time the claimable balance was created (though
+// in practice the network converts them to absolute time predicates
+// when creating a claimable balance).  A NOT predicate with no body
+// is treated as NOT UNCONDITIONAL, and so is never satisfied.
+func ClaimPredicateSatisfied(p *stx.ClaimPredicate,
+	created, closeTime time.Time) bool {
+	switch p.Type {
+	case stx.CLAIM_PREDICATE_UNCONDITIONAL:
+		return true
+	case stx.CLAIM_PREDICATE_AND:
+		for i := range *p.AndPredicates() {
+			if !ClaimPredicateSatisfied(&(*p.AndPredicates())[i],
+				created, closeTime) {
+				return false
+			}
+		}
+		return true
+	case stx.CLAIM_PREDICATE_OR:
+		for i := range *p.OrPredicates() {
+			if ClaimPredicateSatisfied(&(*p.OrPredicates())[i],
+				created, closeTime) {
+				return true
+			}
+		}
+		return false
+	case stx.CLAIM_PREDICATE_NOT:
+		return *p.NotPredicate() != nil &&
+			!ClaimPredicateSatisfied(*p.NotPredicate(), created, closeTime)
+	case stx.CLAIM_PREDICATE_BEFORE_ABSOLUTE_TIME:
+		return closeTime.Unix() < *p.AbsBefore()
+	case stx.CLAIM_PREDICATE_BEFORE_RELATIVE_TIME:
+		return closeTime.Unix() < created.Unix()+*p.RelBefore()
+	}
+	return false
+}
+
+// A claimant of a claimable balance.
+type HorizonClaimant struct {
+	Destination AccountID
+	Predicate   stx.ClaimPredicate `json:"-"`
+}
+
+func (c *HorizonClaimant) UnmarshalJSON(data []byte) error {
+	type jhc HorizonClaimant
+	var j struct {
+		*jhc
+		Predicate horizonPredicate
+	}
+	j.jhc = (*jhc)(c)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	return j.Predicate.toPredicate(&c.Predicate)
+}
+
+type HorizonClaimableBalanceFlags struct {
+	Clawback_enabled bool
+}
+
+// A claimable balance, as returned by horizon's claimable_balances
+// endpoint.
+type HorizonClaimableBalance struct {
+	Net                  *StellarNet            `json:"-"`
+	Id                   stx.ClaimableBalanceID `json:"-"`
+	Paging_token         string
+	Asset                stx.Asset `json:"-"`
+	Amount               stcdetail.JsonInt64e7
+	Sponsor              *AccountID
+	Last_modified_ledger uint32
+	Last_modified_time   *time.Time
+	Claimants            []HorizonClaimant
+	Flags                HorizonClaimableBalanceFlags
+}
+
+func (cb *HorizonClaimableBalance) UnmarshalJSON(data []byte) error {
+	type jhcb HorizonClaimableBalance
+	var j struct {
+		*jhcb
+		Id    string
+		Asset string
+	}
+	j.jhcb = (*jhcb)(cb)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	} else if _, err = fmt.Sscan(j.Asset, &cb.Asset); err != nil {
+		return err
+	}
+	bin, err := hex.DecodeString(j.Id)
+	if err != nil {
+		return err
+	}
+	return stcdetail.XdrFromBin(&cb.Id, string(bin))
+}
+
+func (cb *HorizonClaimableBalance) String() string {
+	return stcdetail.PrettyPrintAux(cb.Net.prettyPrintAux, cb)
+}
+
+// Report whether acct can claim the balance in a ledger with a
+// particular close time.  Relative time predicates are evaluated
+// against Last_modified_time (or are false if it is unknown).
+func (cb *HorizonClaimableBalance) ClaimableBy(acct *AccountID,
+	closeTime time.Time) bool {
+	target := acct.String()
+	for i := range cb.Claimants {
+		c := &cb.Claimants[i]
+		if c.Destination.String() != target {
+			continue
+		}
+		var created time.Time
+		if cb.Last_modified_time != nil {
+			created = *cb.Last_modified_time
+		}
+		if ClaimPredicateSatisfied(&c.Predicate, created, closeTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch all claimable balances that list acct (in strkey format) as
+// a claimant, whether or not their predicates are currently
+// satisfied.
+func (net *StellarNet) GetClaimableBalances(ctx context.Context,
+	acct string) ([]HorizonClaimableBalance, error) {
+	var ret []HorizonClaimableBalance
+	err := Iterate(ctx, net, "claimable_balances?claimant="+
+		url.QueryEscape(acct), &PageOptions{PageSize: 200},
+		func(cb *HorizonClaimableBalance, _ string) error {
+			ret = append(ret, *cb)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,237 @@
+package stc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Policy for retrying requests to horizon that fail because the
+// server is rate limiting us (HTTP status 429), is temporarily
+// unavailable, or for which IsTemporary returns true.
+type RetryPolicy struct {
+	// Maximum number of times to retry a request after the initial
+	// attempt.  A negative value means retry forever.
+	MaxRetries int
+
+	// How long to wait before the first retry.  The delay doubles
+	// after each subsequent failure.
+	MinBackoff time.Duration
+
+	// Upper bound on the delay between retries (unless the server
+	// explicitly requests a longer delay through a Retry-After
+	// header).
+	MaxBackoff time.Duration
+}
+
+// The retry policy used when StellarNet.Retry is nil.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	MinBackoff: time.Second,
+	MaxBackoff: time.Minute,
+}
+
+// User-Agent sent to horizon when StellarNet.UserAgent is empty.
+const DefaultUserAgent = "stc (https://github.com/xdrpp/stc)"
+
+// Return the delay requested by a Retry-After header, which can
+// either be a number of seconds or an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return 0, false
+	} else if secs, err := strconv.ParseUint(h, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, true
+	} else if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// Returns true if a response with a particular status code is worth
+// retrying.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// Returns true if a response with a particular status code suggests
+// that the server is down but another server might not be, as when a
+// gateway cannot reach horizon.
+func gatewayStatus(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Wait for d, returning early with an error if ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Closing the body of a response also releases its timeout.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (net *StellarNet) httpClient() *http.Client {
+	if net.Client != nil {
+		return net.Client
+	}
+	return http.DefaultClient
+}
+
+func (net *StellarNet) retryPolicy() *RetryPolicy {
+	if net.Retry != nil {
+		return net.Retry
+	}
+	return &DefaultRetryPolicy
+}
+
+// Send one attempt of a request, with the configured headers and
+// (if timeout is true) the configured per-request timeout.  Waits
+// first if necessary to stay within the server's rate limit.
+func (net *StellarNet) doOnce(req *http.Request, timeout bool) (
+	*http.Response, error) {
+	rl := net.rateLimiter(req.URL.String())
+	if err := rl.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if timeout && net.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, net.Timeout)
+	}
+	r := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		r.Body = body
+	}
+	for k, vs := range net.Header {
+		r.Header[k] = vs
+	}
+	if r.Header.Get("User-Agent") == "" {
+		if net.UserAgent != "" {
+			r.Header.Set("User-Agent", net.UserAgent)
+		} else {
+			r.Header.Set("User-Agent", DefaultUserAgent)
+		}
+	}
+	resp, err := net.httpClient().Do(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	rl.update(resp.Header)
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// Send a request to horizon using the StellarNet's Client, Header,
+// UserAgent, Timeout, and Retry settings.  The request body, if any,
+// must support GetBody so that it can be re-sent.  If timeout is
+// false, the Timeout setting is ignored (as is appropriate for
+// long-lived event streams).  Responses with status codes other than
+// 429 and 503 are returned to the caller; the caller must check the
+// status code and close the body.  When the request goes to one of
+// several configured servers (see HorizonURLs), retries go
+// immediately to another server that is up, and only back off once
+// all servers are down.  A server that exceeds the Timeout or returns
+// status 502 or 504 is also skipped in favor of another server, but
+// such a request is not retried when there is no other server.
+func (net *StellarNet) do(req *http.Request, timeout bool) (
+	*http.Response, error) {
+	ctx := req.Context()
+	policy := net.retryPolicy()
+	backoff := policy.MinBackoff
+	for try := 0; ; try++ {
+		resp, err := net.doOnce(req, timeout)
+		if ctx.Err() != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		var delay time.Duration
+		// Since ctx is live, an expired deadline means the attempt
+		// timed out, so the server may be stalled
+		failoverOnly := false
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				failoverOnly = true
+			} else if !IsTemporary(err) {
+				return nil, err
+			}
+		} else if gatewayStatus(resp.StatusCode) {
+			failoverOnly = true
+		} else if !retryableStatus(resp.StatusCode) {
+			return resp, nil
+		} else if d, ok := retryAfter(resp); ok {
+			delay = d
+		}
+		if policy.MaxRetries >= 0 && try >= policy.MaxRetries {
+			return resp, err
+		}
+		alt := net.failover(req.URL.String())
+		if alt == "" && failoverOnly {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		if alt != "" {
+			if req, err = retarget(req, alt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if delay == 0 {
+			delay = backoff
+			if backoff *= 2; policy.MaxBackoff > 0 &&
+				backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+		}
+		if err = sleepCtx(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Adapter so that stcdetail.StreamClient sends requests through
+// StellarNet.do.
+type streamDoer struct {
+	net *StellarNet
+}
+
+func (sd streamDoer) Do(req *http.Request) (*http.Response, error) {
+	return sd.net.do(req, false)
+}
@@ -5,14 +5,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,6 +42,9 @@ type isSignerKey interface {
 	ToSignerKey() SignerKey
 }
 
+// Maximum number of accounts to fetch concurrently
+const maxFetches = 8
+
 func getAccounts(net *StellarNet, e *TransactionEnvelope, usenet bool) {
 	accounts := make(map[string][]HorizonSigner)
 	record := func(ac isSignerKey) {
@@ -50,8 +60,13 @@ func getAccounts(net *StellarNet, e *TransactionEnvelope, usenet bool) {
 
 	if usenet {
 		c := make(chan func())
+		// Limit concurrent requests so as not to trip horizon's rate
+		// limit on transactions that mention many accounts
+		sem := make(chan struct{}, maxFetches)
 		for ac := range accounts {
 			go func(ac string) {
+				sem <- struct{}{}
+				defer func() { <-sem }()
 				if ae, err := net.GetAccountEntry(ac); err == nil {
 					c <- func() { accounts[ac] = ae.Signers }
 				} else {
@@ -174,22 +189,21 @@ func fixTx(net *StellarNet, e *TransactionEnvelope) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if h, err := net.GetFeeStats(); err == nil {
-			// 20 should be a parameter
-			e.SetFee(h.Percentile(20))
-		}
+		// Errors leave the fee unchanged (e.g., fee statistics are
+		// only available from horizon)
+		net.ApplyFeePolicy(context.Background(), e)
 	}()
 	if !isZeroAccount(e.SourceAccount()) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if a, _ := net.GetAccountEntry(
-				e.SourceAccount().ToSignerKey().String()); a != nil {
+			if seq, err := net.GetNextSeq(context.Background(),
+				e.SourceAccount()); err == nil && seq != 0 {
 				switch e.Type {
 				case stx.ENVELOPE_TYPE_TX:
-					e.V1().Tx.SeqNum = a.NextSeq()
+					e.V1().Tx.SeqNum = seq
 				case stx.ENVELOPE_TYPE_TX_V0:
-					e.V0().Tx.SeqNum = a.NextSeq()
+					e.V0().Tx.SeqNum = seq
 				}
 			}
 		}()
@@ -298,6 +312,25 @@ func mustWriteTx(outfile string, e *TransactionEnvelope, net *StellarNet,
 	}
 }
 
+// Wrap a transaction in a fee-bump transaction paid for by feeSource,
+// offering a fee chosen by the network's fee policy.
+func feeBump(net *StellarNet, e *TransactionEnvelope,
+	feeSource string) *TransactionEnvelope {
+	var acct MuxedAccount
+	if _, err := fmt.Sscan(feeSource, &acct); err != nil {
+		fmt.Fprintln(os.Stderr, "syntactically invalid fee source account")
+		os.Exit(2)
+	} else if e.Type == stx.ENVELOPE_TYPE_TX_FEE_BUMP {
+		fmt.Fprintln(os.Stderr, "transaction already has a fee bump")
+		os.Exit(1)
+	}
+	ret := NewFeeBump(e, &acct, 0)
+	// Errors leave the lowest fee the inner transaction allows (e.g.,
+	// fee statistics are only available from horizon)
+	net.ApplyFeePolicy(context.Background(), ret)
+	return ret
+}
+
 func signTx(net *StellarNet, key string, e *TransactionEnvelope) error {
 	if key != "" {
 		key = AdjustKeyName(key)
@@ -486,6 +519,476 @@ func doEdit(net *StellarNet, arg string) {
 	mustWriteTx(arg, e, net, txfmt)
 }
 
+// Build a transaction containing a path payment using the best path
+// found by horizon, with arguments SOURCE-ACCT SEND-ASSET DEST-ACCT
+// DEST-ASSET AMOUNT.
+func doPathPayment(net *StellarNet, receive bool, slippage uint32,
+	args []string, outfile string) {
+	e := NewTransactionEnvelope()
+	var sendAsset, destAsset stx.Asset
+	var dest stx.MuxedAccount
+	var amount stcdetail.JsonInt64e7
+	if _, err := fmt.Sscan(args[0], &e.V1().Tx.SourceAccount); err != nil {
+		fmt.Fprintln(os.Stderr, "syntactically invalid source account")
+		os.Exit(1)
+	} else if _, err = fmt.Sscan(args[1], &sendAsset); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid asset %q: %s\n", args[1], err)
+		os.Exit(1)
+	} else if _, err = fmt.Sscan(args[2], &dest); err != nil {
+		fmt.Fprintln(os.Stderr, "syntactically invalid destination account")
+		os.Exit(1)
+	} else if _, err = fmt.Sscan(args[3], &destAsset); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid asset %q: %s\n", args[3], err)
+		os.Exit(1)
+	} else if err = amount.UnmarshalText([]byte(args[4])); err != nil ||
+		amount <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid amount %q\n", args[4])
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	var op OperationBody
+	var err error
+	if receive {
+		op, err = net.FindPathPaymentStrictReceive(ctx, &sendAsset, &dest,
+			&destAsset, int64(amount), slippage)
+	} else {
+		op, err = net.FindPathPaymentStrictSend(ctx, &sendAsset,
+			int64(amount), &dest, &destAsset, slippage)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	e.Append(nil, op)
+	fixTx(net, e)
+	mustWriteTx(outfile, e, net, fmt_txrep)
+}
+
+// List the claimable balances of an account or, if claim is true,
+// build a transaction claiming all those currently claimable.
+func doClaim(net *StellarNet, arg string, claim bool, outfile string) {
+	var acct AccountID
+	if _, err := fmt.Sscan(arg, &acct); err != nil {
+		fmt.Fprintln(os.Stderr, "syntactically invalid account")
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	lh, err := net.GetLedgerHeaderCtx(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error fetching ledger header: %s\n", err)
+		os.Exit(1)
+	}
+	closeTime := time.Unix(int64(lh.ScpValue.CloseTime), 0)
+	cbs, err := net.GetClaimableBalances(ctx, arg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if !claim {
+		for i := range cbs {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Print(&cbs[i])
+			fmt.Printf("Claimable_now: %v\n",
+				cbs[i].ClaimableBy(&acct, closeTime))
+		}
+		return
+	}
+
+	e := NewTransactionEnvelope()
+	e.V1().Tx.SourceAccount = *acct.ToMuxedAccount()
+	for i := range cbs {
+		if !cbs[i].ClaimableBy(&acct, closeTime) {
+			continue
+		} else if len(*e.Operations()) >= stx.MAX_OPS_PER_TX {
+			fmt.Fprintf(os.Stderr, "warning: only claiming the first %d "+
+				"balances; run again to claim the rest\n", stx.MAX_OPS_PER_TX)
+			break
+		}
+		e.Append(nil, ClaimClaimableBalance{BalanceID: cbs[i].Id})
+	}
+	if len(*e.Operations()) == 0 {
+		fmt.Fprintln(os.Stderr, "no claimable balances")
+		os.Exit(1)
+	}
+	fixTx(net, e)
+	mustWriteTx(outfile, e, net, fmt_txrep)
+}
+
+// Parse a liquidity pool ID in hex (optionally followed by ":lp").
+func mustParsePoolID(arg string) stx.PoolID {
+	var id stx.PoolID
+	if _, err := fmt.Sscan(strings.TrimSuffix(arg, ":lp"),
+		stx.XDR_PoolID(&id)); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid liquidity pool ID %q\n", arg)
+		os.Exit(1)
+	}
+	return id
+}
+
+// List the liquidity pools with a particular ID or pair of reserve
+// assets.
+func doQueryPools(net *StellarNet, args []string) {
+	ctx := context.Background()
+	if len(args) == 1 {
+		id := mustParsePoolID(args[0])
+		lp, err := net.GetLiquidityPool(ctx, &id)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(lp)
+		return
+	}
+	assets := make([]stx.Asset, len(args))
+	for i := range args {
+		if _, err := fmt.Sscan(args[i], &assets[i]); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid asset %q: %s\n", args[i], err)
+			os.Exit(1)
+		}
+	}
+	n := 0
+	err := Iterate(ctx, net, LiquidityPoolsQuery(assets...), nil,
+		func(lp *HorizonLiquidityPool, _ string) error {
+			if n++; n > 1 {
+				fmt.Println()
+			}
+			fmt.Print(lp)
+			return nil
+		})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Build a transaction depositing into or withdrawing from a
+// liquidity pool, with arguments SOURCE-ACCT POOL MAX-A MAX-B for
+// deposits and SOURCE-ACCT POOL SHARES for withdrawals.  A deposit
+// is preceded by a ChangeTrust operation if the source account does
+// not yet have a trustline for the pool shares.
+func doPool(net *StellarNet, withdraw bool, slippage uint32,
+	args []string, outfile string) {
+	e := NewTransactionEnvelope()
+	if _, err := fmt.Sscan(args[0], &e.V1().Tx.SourceAccount); err != nil {
+		fmt.Fprintln(os.Stderr, "syntactically invalid source account")
+		os.Exit(1)
+	}
+	id := mustParsePoolID(args[1])
+	amounts := make([]int64, len(args)-2)
+	for i := range amounts {
+		var amount stcdetail.JsonInt64e7
+		if err := amount.UnmarshalText([]byte(args[i+2])); err != nil ||
+			amount <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid amount %q\n", args[i+2])
+			os.Exit(1)
+		}
+		amounts[i] = int64(amount)
+	}
+
+	ctx := context.Background()
+	lp, err := net.GetLiquidityPool(ctx, &id)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if withdraw {
+		var a, b int64
+		var op *LiquidityPoolWithdraw
+		if a, b, err = lp.ExpectedWithdraw(amounts[0]); err == nil {
+			op, err = lp.WithdrawOp(amounts[0], slippage)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "expect to withdraw %s %s and %s %s\n",
+			stcdetail.JsonInt64e7(a), &lp.Reserves[0].Asset,
+			stcdetail.JsonInt64e7(b), &lp.Reserves[1].Asset)
+		e.Append(nil, op)
+	} else {
+		var a, b, shares int64
+		var op *LiquidityPoolDeposit
+		if a, b, shares, err = lp.ExpectedDeposit(amounts[0],
+			amounts[1]); err == nil {
+			op, err = lp.DepositOp(amounts[0], amounts[1], slippage)
+		}
+		var params *stx.LiquidityPoolParameters
+		if err == nil {
+			params, err = lp.Parameters()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr,
+			"expect to deposit %s %s and %s %s for %s shares\n",
+			stcdetail.JsonInt64e7(a), &lp.Reserves[0].Asset,
+			stcdetail.JsonInt64e7(b), &lp.Reserves[1].Asset,
+			stcdetail.JsonInt64e7(shares))
+		ae, err := net.GetAccountEntryCtx(ctx, args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		trusted := false
+		for i := range ae.Pool_shares {
+			if ae.Pool_shares[i].Liquidity_pool_id == id {
+				trusted = true
+			}
+		}
+		if !trusted {
+			ct := ChangeTrust{Limit: math.MaxInt64}
+			ct.Line.Type = stx.ASSET_TYPE_POOL_SHARE
+			*ct.Line.LiquidityPool() = *params
+			e.Append(nil, ct)
+		}
+		e.Append(nil, op)
+	}
+	fixTx(net, e)
+	mustWriteTx(outfile, e, net, fmt_txrep)
+}
+
+// Show a transaction's effect on an account, or, if verbose, the
+// whole transaction.  Verbose transactions are separated by blank
+// lines, using *nl to track whether one has already been shown.
+func showAccountTx(net *StellarNet, r *HorizonTxResult, acct *AccountID,
+	verbose bool, nl *bool) {
+	if verbose {
+		if *nl {
+			fmt.Println()
+		}
+		*nl = true
+		fmt.Print(r)
+	} else {
+		fmt.Printf("%x\n  time %s\n", r.Txhash, r.Time)
+		fmt.Print(net.AccountDelta(&r.StellarMetas, acct, "  "))
+	}
+}
+
+// Stream the transactions (or, if payments is true, the payments) of
+// an account as they happen, reconnecting with exponential backoff
+// after errors.  If cursorFile is not empty, the paging token of each
+// record shown is saved there, and streaming resumes after the saved
+// token, so that restarting does not miss any records.
+func doWatch(net *StellarNet, arg string, payments, verbose bool,
+	cursorFile string) {
+	var acct AccountID
+	if _, err := fmt.Sscan(arg, &acct); err != nil {
+		fmt.Fprintln(os.Stderr, "syntactically invalid account")
+		os.Exit(1)
+	}
+	opts := &PageOptions{}
+	if cursorFile != "" {
+		if data, _, err := stcdetail.ReadFile(cursorFile); err == nil {
+			opts.Cursor = strings.TrimSpace(string(data))
+		} else if !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	saveCursor := func(token string) error {
+		if cursorFile == "" {
+			return nil
+		}
+		return stcdetail.SafeWriteFile(cursorFile, token+"\n", 0666)
+	}
+
+	var err error
+	nl := false
+	if payments {
+		err = StreamForever(context.Background(), net, PaymentsQuery(arg),
+			opts, func(op *HorizonOperation, token string) error {
+				if nl {
+					fmt.Println()
+				}
+				nl = true
+				fmt.Print(op)
+				return saveCursor(token)
+			}, showReconnect)
+	} else {
+		err = StreamForever(context.Background(), net,
+			"accounts/"+arg+"/transactions", opts,
+			func(r *HorizonTxResult, token string) error {
+				showAccountTx(net, r, &acct, verbose, &nl)
+				return saveCursor(token)
+			}, showReconnect)
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// Print each ledger as it closes.
+func doWatchLedgers(net *StellarNet) {
+	nl := false
+	err := StreamForever(context.Background(), net, "ledgers", nil,
+		func(l *HorizonLedger, _ string) error {
+			if nl {
+				fmt.Println()
+			}
+			nl = true
+			fmt.Print(l)
+			return nil
+		}, showReconnect)
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// Report a stream error that StreamForever will retry.
+func showReconnect(err error, delay time.Duration) {
+	fmt.Fprintf(os.Stderr, "%s (reconnecting in %s)\n", err, delay)
+}
+
+var errHistoryDone = errors.New("reached start of time range")
+
+// List the operations or effects of an account, ledger, or
+// transaction in reverse chronological order.  If types is not
+// empty, it is a comma-separated list of the (case-insensitive)
+// horizon types to show.  Zero since or until times leave the time
+// range unbounded.
+func doHistory(net *StellarNet, arg string, effects bool, types string,
+	since, until time.Time) {
+	want := make(map[string]bool)
+	for _, t := range strings.Split(types, ",") {
+		if t != "" {
+			want[strings.ToLower(t)] = true
+		}
+	}
+	n := 0
+	show := func(typ string, when time.Time, rec fmt.Stringer) error {
+		if !since.IsZero() && when.Before(since) {
+			return errHistoryDone
+		} else if (!until.IsZero() && when.After(until)) ||
+			(len(want) > 0 && !want[strings.ToLower(typ)]) {
+			return nil
+		}
+		if n++; n > 1 {
+			fmt.Println()
+		}
+		fmt.Print(rec)
+		return nil
+	}
+
+	ctx := context.Background()
+	opts := &PageOptions{Order: "desc", PageSize: 200}
+	var err error
+	if effects {
+		err = Iterate(ctx, net, EffectsQuery(arg), opts,
+			func(ef *HorizonEffect, _ string) error {
+				return show(ef.Type, ef.Created_at, ef)
+			})
+	} else {
+		err = Iterate(ctx, net, OperationsQuery(arg), opts,
+			func(op *HorizonOperation, _ string) error {
+				return show(op.Type, op.Created_at, op)
+			})
+	}
+	if err != nil && err != errHistoryDone {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Export the balance changes of an account's transactions, oldest
+// first, as CSV (format "csv") or JSON lines (format "jsonl"), with
+// one row per change to a balance.  Output is appended to outfile,
+// or written to standard output if outfile is empty; the CSV header
+// is only written when the output starts out empty.  Zero since or
+// until times leave the time range unbounded.  If cursorFile is not
+// empty, the paging token of each exported transaction is saved
+// there, and the export resumes after the saved token, so that
+// repeating the command exports only new transactions.
+func doExport(net *StellarNet, arg, format, outfile, cursorFile string,
+	since, until time.Time) {
+	var acct AccountID
+	if _, err := fmt.Sscan(arg, &acct); err != nil {
+		fmt.Fprintln(os.Stderr, "syntactically invalid account")
+		os.Exit(1)
+	} else if format != "csv" && format != "jsonl" {
+		fmt.Fprintf(os.Stderr, "unknown export format %q\n", format)
+		os.Exit(2)
+	}
+	cursor := ""
+	if cursorFile != "" {
+		if data, _, err := stcdetail.ReadFile(cursorFile); err == nil {
+			cursor = strings.TrimSpace(string(data))
+		} else if !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	out, empty := os.Stdout, true
+	if outfile != "" {
+		f, err := os.OpenFile(outfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+			0666)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+			empty = false
+		}
+		out = f
+	}
+	cw, je := csv.NewWriter(out), json.NewEncoder(out)
+	if format == "csv" && empty {
+		cw.Write(AccountingCSVHeader)
+	}
+
+	query := "accounts/" + arg + "/transactions?order=asc&limit=200"
+	if cursor != "" {
+		query += "&cursor=" + url.QueryEscape(cursor)
+	}
+	err := net.IterateJSON(nil, query, func(r *HorizonTxResult) error {
+		if !until.IsZero() && r.Time.After(until) {
+			return errHistoryDone
+		} else if since.IsZero() || !r.Time.Before(since) {
+			entries, err := AccountingEntries(r, &acct)
+			if err != nil {
+				return err
+			}
+			for i := range entries {
+				if format == "csv" {
+					cw.Write(entries[i].CSVRecord())
+				} else if err = je.Encode(&entries[i]); err != nil {
+					return err
+				}
+			}
+			if cw.Flush(); cw.Error() != nil {
+				return cw.Error()
+			}
+		}
+		if cursorFile == "" {
+			return nil
+		}
+		return stcdetail.SafeWriteFile(cursorFile, r.PagingToken+"\n",
+			0666)
+	})
+	if err == nil {
+		cw.Flush()
+		err = cw.Error()
+	}
+	if err != nil && err != errHistoryDone {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func parseDate(arg string) (time.Time, error) {
+	for _, f := range dateFormats {
+		t, err := time.ParseInLocation(f, arg, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse date %q", arg)
+}
+
 func b2i(bs ...bool) int {
 	ret := 0
 	for _, b := range bs {
@@ -523,15 +1026,24 @@ func main() {
 	opt_sign := flag.Bool("sign", false, "Sign the transaction")
 	opt_payload := flag.String("payload", "false",
 		"Add signature on raw `HEX-STRING` instead of on this transaction")
-	opt_key := flag.String("key", "", "Use secret signing key in `FILE`")
+	opt_key := flag.String("key", "",
+		"Use secret signing key in `FILE` (with -post, to resubmit)")
 	opt_netname := flag.String("net", "",
 		"Use Network `NET` (e.g., test); default: $STCNET or \"default\"")
 	opt_update := flag.Bool("u", false,
 		"Query network to update fee and sequence number")
+	opt_fee := flag.String("fee", "",
+		"Choose fees according to `POLICY` (e.g., p50,max=1000)")
+	opt_feebump := flag.String("feebump", "",
+		"Wrap the transaction in a fee bump paid by `ACCT`")
+	opt_upgrade := flag.Bool("upgrade-envelope", false,
+		"Convert a legacy V0 transaction envelope to V1")
 	opt_learn := flag.Bool("l", false, "Learn new signers")
 	opt_help := flag.Bool("help", false, "Print usage information")
 	opt_post := flag.Bool("post", false,
 		"Post transaction instead of editing it")
+	opt_wait := flag.Bool("wait", false,
+		"With -post, wait for the transaction to be included in a ledger")
 	opt_nopass := flag.Bool("nopass", false, "Never prompt for passwords")
 	opt_edit := flag.Bool("edit", false,
 		"keep editing the file until it doesn't change")
@@ -551,6 +1063,53 @@ func main() {
 		"Query Horizon for information on transaction")
 	opt_txacct := flag.Bool("qta", false,
 		"Query Horizon for transactions on account")
+	opt_offers := flag.Bool("qo", false,
+		"Query Horizon for offers of account")
+	opt_trades := flag.Bool("qtr", false,
+		"Query Horizon for recent trades of account or asset pair")
+	opt_orderbook := flag.Bool("qob", false,
+		"Query Horizon for order book of asset pair")
+	opt_path_send := flag.Bool("path-send", false,
+		"Create a PathPaymentStrictSend transaction using the best path")
+	opt_path_receive := flag.Bool("path-receive", false,
+		"Create a PathPaymentStrictReceive transaction using the best path")
+	opt_claimable := flag.Bool("qcb", false,
+		"Query Horizon for claimable balances of account")
+	opt_claim := flag.Bool("claim", false,
+		"Create a transaction claiming all currently claimable balances")
+	opt_pools := flag.Bool("qlp", false,
+		"Query Horizon for liquidity pool by ID or reserve assets")
+	opt_pool_deposit := flag.Bool("pool-deposit", false,
+		"Create a transaction depositing into a liquidity pool")
+	opt_pool_withdraw := flag.Bool("pool-withdraw", false,
+		"Create a transaction withdrawing from a liquidity pool")
+	opt_ops := flag.Bool("qop", false,
+		"Query Horizon for operations of account, ledger, or transaction")
+	opt_effects := flag.Bool("qef", false,
+		"Query Horizon for effects of account, ledger, or transaction")
+	opt_type := flag.String("type", "",
+		"With -qop or -qef, only show records of comma-separated `TYPES`")
+	opt_export := flag.String("export", "",
+		"Export balance changes of account's transactions as `FORMAT`"+
+			" csv or jsonl")
+	opt_since := flag.String("since", "",
+		"With -qop, -qef, or -export, only show records created at or"+
+			" after `DATE`")
+	opt_until := flag.String("until", "",
+		"With -qop, -qef, or -export, only show records created at or"+
+			" before `DATE`")
+	opt_watch := flag.Bool("watch", false,
+		"Stream transactions of account as they happen")
+	opt_watch_ledgers := flag.Bool("watch-ledgers", false,
+		"Stream ledger headers as ledgers close")
+	opt_payments := flag.Bool("payments", false,
+		"With -watch, stream payments instead of transactions")
+	opt_cursor := flag.String("cursor", "",
+		"With -watch or -export, save and resume from paging token"+
+			" in `FILE`")
+	opt_slippage := flag.Uint("slippage", 100,
+		"Tolerate `BP` basis points of price slippage in path payments"+
+			" and liquidity pool operations")
 	opt_mux := flag.Bool("mux", false,
 		"Created a MuxedAccount from an AccountID and uint64")
 	opt_demux := flag.Bool("demux", false,
@@ -578,17 +1137,38 @@ func main() {
 	}
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(),
-			`Usage: %[1]s [-net=ID] [-z] [-sign] [-c|-json] [-l] [-u] \
+			`Usage: %[1]s [-net=ID] [-z] [-sign] [-c|-json] [-l] \
+           [-u [-fee=POLICY]] [-feebump=ACCT] [-upgrade-envelope] \
            [-i | -o OUTPUT-FILE] INPUT-FILE
        %[1]s -edit [-net=ID] FILE
-       %[1]s -post [-net=ID] INPUT-FILE
+       %[1]s -post [-net=ID] [-wait] [-key=FILE] INPUT-FILE
        %[1]s -preauth [-net=ID] INPUT-FILE
        %[1]s -txhash [-net=ID] INPUT-FILE
        %[1]s -fee-stats
-       %[1]s -ledger-header
+       %[1]s -ledger-header [-net=ID] [LEDGER]
+       %[1]s -watch-ledgers [-net=ID]
        %[1]s -qa [-net=ID] ACCT
        %[1]s -qt [-net=ID] TXHASH
        %[1]s -qta [-net=ID] ACCT
+       %[1]s -qo [-net=ID] ACCT
+       %[1]s -qtr [-net=ID] {ACCT | BASE-ASSET COUNTER-ASSET}
+       %[1]s -qob [-net=ID] SELLING-ASSET BUYING-ASSET
+       %[1]s {-qop | -qef} [-net=ID] [-type=TYPES] [-since=DATE] \
+           [-until=DATE] {ACCT | LEDGER | TXHASH}
+       %[1]s -export={csv|jsonl} [-net=ID] [-since=DATE] [-until=DATE] \
+           [-cursor=FILE] [-o OUTPUT-FILE] ACCT
+       %[1]s -path-send [-net=ID] [-slippage=BP] [-o OUTPUT-FILE] \
+           SOURCE-ACCT SEND-ASSET DEST-ACCT DEST-ASSET SEND-AMOUNT
+       %[1]s -path-receive [-net=ID] [-slippage=BP] [-o OUTPUT-FILE] \
+           SOURCE-ACCT SEND-ASSET DEST-ACCT DEST-ASSET DEST-AMOUNT
+       %[1]s -watch [-net=ID] [-payments] [-cursor=FILE] [-v] ACCT
+       %[1]s -qcb [-net=ID] ACCT
+       %[1]s -claim [-net=ID] [-o OUTPUT-FILE] ACCT
+       %[1]s -qlp [-net=ID] {POOL | ASSET-A ASSET-B}
+       %[1]s -pool-deposit [-net=ID] [-slippage=BP] [-o OUTPUT-FILE] \
+           SOURCE-ACCT POOL MAX-A MAX-B
+       %[1]s -pool-withdraw [-net=ID] [-slippage=BP] [-o OUTPUT-FILE] \
+           SOURCE-ACCT POOL SHARES
        %[1]s -create [-net=ID] ACCT
        %[1]s -keygen [NAME]
        %[1]s -genesis-key [NAME]
@@ -627,17 +1207,34 @@ func main() {
 		*opt_import_key, *opt_export_key, *opt_acctinfo, *opt_txinfo,
 		*opt_txacct, *opt_friendbot, *opt_list_keys, *opt_fee_stats,
 		*opt_ledger_header, *opt_print_default_config, *opt_mux,
-		*opt_demux, *opt_pack, *opt_unpack, *opt_opid, *opt_hint)
+		*opt_demux, *opt_pack, *opt_unpack, *opt_opid, *opt_hint,
+		*opt_offers, *opt_trades, *opt_orderbook, *opt_path_send,
+		*opt_path_receive, *opt_claimable, *opt_claim, *opt_pools,
+		*opt_pool_deposit, *opt_pool_withdraw, *opt_ops, *opt_effects,
+		*opt_watch, *opt_watch_ledgers, *opt_export != "")
+	pathmode := *opt_path_send || *opt_path_receive
+	poolmode := *opt_pool_deposit || *opt_pool_withdraw
+	// Modes other than the default that output a new transaction
+	txmode := pathmode || poolmode || *opt_claim
 
 	argsMin, argsMax := 1, 1
 	switch {
-	case *opt_fee_stats || *opt_ledger_header ||
+	case *opt_fee_stats || *opt_watch_ledgers ||
 		*opt_print_default_config || *opt_list_keys:
 		argsMin, argsMax = 0, 0
-	case *opt_keygen || *opt_sec2pub || *opt_genesis_key:
+	case *opt_keygen || *opt_sec2pub || *opt_genesis_key ||
+		*opt_ledger_header:
 		argsMin = 0
-	case *opt_mux, *opt_pack:
+	case *opt_mux, *opt_pack, *opt_orderbook:
 		argsMin, argsMax = 2, 2
+	case *opt_trades || *opt_pools:
+		argsMax = 2
+	case pathmode:
+		argsMin, argsMax = 5, 5
+	case *opt_pool_deposit:
+		argsMin, argsMax = 4, 4
+	case *opt_pool_withdraw:
+		argsMin, argsMax = 3, 3
 	case *opt_opid:
 		argsMax, argsMax = 3, 3
 	}
@@ -658,9 +1255,14 @@ func main() {
 		outfmt = fmt_json
 	}
 
+	if *opt_wait && !*opt_post {
+		fmt.Fprintln(os.Stderr, "-wait only availble with -post")
+		os.Exit(2)
+	}
+
 	if nmode > 0 {
 		bail := false
-		if *opt_sign || *opt_key != "" {
+		if *opt_sign || (*opt_key != "" && !*opt_post) {
 			fmt.Fprintln(os.Stderr,
 				"--sign, --key, and --payload only availble in default mode")
 			bail = true
@@ -669,7 +1271,13 @@ func main() {
 			fmt.Fprintln(os.Stderr, "-l and -u only availble in default mode")
 			bail = true
 		}
-		if *opt_inplace || *opt_output != "" {
+		if *opt_feebump != "" || *opt_upgrade {
+			fmt.Fprintln(os.Stderr,
+				"-feebump and -upgrade-envelope only availble in default mode")
+			bail = true
+		}
+		if *opt_inplace ||
+			(*opt_output != "" && !txmode && *opt_export == "") {
 			fmt.Fprintln(os.Stderr, "-i and -o only availble in default mode")
 			bail = true
 		}
@@ -806,15 +1414,13 @@ func main() {
 		fmt.Printf("%s\n%x\n", pk, spl.Payload)
 		return
 	case *opt_date:
-		for _, f := range dateFormats {
-			t, err := time.ParseInLocation(f, arg, time.Local)
-			if err == nil {
-				fmt.Printf("%d\n", t.Unix())
-				return
-			}
+		t, err := parseDate(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", progname, err)
+			os.Exit(1)
 		}
-		fmt.Fprintf(os.Stderr, "%s: cannot parse date %q\n", progname, arg)
-		os.Exit(1)
+		fmt.Printf("%d\n", t.Unix())
+		return
 	case *opt_keygen:
 		if arg != "" {
 			arg = AdjustKeyName(arg)
@@ -859,6 +1465,17 @@ func main() {
 		fmt.Fprintf(os.Stderr, "unknown network %q\n", *opt_netname)
 		os.Exit(1)
 	}
+	if *opt_fee != "" {
+		fp := DefaultFeePolicy
+		if net.FeePolicy != nil {
+			fp = *net.FeePolicy
+		}
+		if err := fp.Set(*opt_fee); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		net.FeePolicy = &fp
+	}
 
 	if *opt_genesis_key {
 		if arg != "" {
@@ -874,7 +1491,15 @@ func main() {
 			fmt.Fprintln(os.Stderr, "syntactically invalid account")
 			os.Exit(1)
 		}
-		if ae, err := net.GetAccountEntry(arg); err != nil {
+		if c := net.RPCClient(); c != nil {
+			if ae, err := c.GetAccountEntry(context.Background(),
+				acct); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			} else {
+				fmt.Print(net.ToRep(ae))
+			}
+		} else if ae, err := net.GetAccountEntry(arg); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		} else {
@@ -914,17 +1539,98 @@ func main() {
 		err := net.IterateJSON(nil, "accounts/"+arg+
 			"/transactions?order=desc&limit=200",
 			func(r *HorizonTxResult) {
-				if *opt_verbose {
-					if !nl {
-						nl = true
-					} else {
-						fmt.Println()
-					}
-					fmt.Print(r)
-				} else {
-					fmt.Printf("%x\n  time %s\n", r.Txhash, r.Time)
-					fmt.Printf(net.AccountDelta(&r.StellarMetas, &acct, "  "))
+				showAccountTx(net, r, &acct, *opt_verbose, &nl)
+			})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *opt_ops || *opt_effects || *opt_export != "" {
+		var since, until time.Time
+		var err error
+		if *opt_since != "" {
+			since, err = parseDate(*opt_since)
+		}
+		if err == nil && *opt_until != "" {
+			until, err = parseDate(*opt_until)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if *opt_export != "" {
+			doExport(net, arg, *opt_export, *opt_output, *opt_cursor,
+				since, until)
+		} else {
+			doHistory(net, arg, *opt_effects, *opt_type, since, until)
+		}
+		return
+	}
+
+	if *opt_watch {
+		doWatch(net, arg, *opt_payments, *opt_verbose, *opt_cursor)
+		return
+	}
+
+	if *opt_offers {
+		var acct AccountID
+		if _, err := fmt.Sscan(arg, &acct); err != nil {
+			fmt.Fprintln(os.Stderr, "syntactically invalid account")
+			os.Exit(1)
+		}
+		nl := false
+		err := Iterate(context.Background(), net,
+			"accounts/"+arg+"/offers", nil,
+			func(o *HorizonOffer, _ string) error {
+				if nl {
+					fmt.Println()
+				}
+				nl = true
+				fmt.Print(o)
+				return nil
+			})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *opt_trades {
+		var query string
+		if len(flag.Args()) == 1 {
+			var acct AccountID
+			if _, err := fmt.Sscan(arg, &acct); err != nil {
+				fmt.Fprintln(os.Stderr, "syntactically invalid account")
+				os.Exit(1)
+			}
+			query = "accounts/" + arg + "/trades"
+		} else {
+			var base, counter stx.Asset
+			if _, err := fmt.Sscan(arg, &base); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid asset %q: %s\n", arg, err)
+				os.Exit(1)
+			} else if _, err = fmt.Sscan(flag.Args()[1],
+				&counter); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid asset %q: %s\n",
+					flag.Args()[1], err)
+				os.Exit(1)
+			}
+			query = TradesQuery(&base, &counter)
+		}
+		nl := false
+		err := Iterate(context.Background(), net, query,
+			&PageOptions{Order: "desc", PageSize: 200, Max: 200},
+			func(t *HorizonTrade, _ string) error {
+				if nl {
+					fmt.Println()
 				}
+				nl = true
+				fmt.Print(t)
+				return nil
 			})
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -933,6 +1639,48 @@ func main() {
 		return
 	}
 
+	if *opt_orderbook {
+		var selling, buying stx.Asset
+		if _, err := fmt.Sscan(arg, &selling); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid asset %q: %s\n", arg, err)
+			os.Exit(1)
+		} else if _, err = fmt.Sscan(flag.Args()[1], &buying); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid asset %q: %s\n",
+				flag.Args()[1], err)
+			os.Exit(1)
+		}
+		ob, err := net.GetOrderBook(context.Background(),
+			&selling, &buying, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(ob)
+		return
+	}
+
+	if *opt_claimable || *opt_claim {
+		doClaim(net, arg, *opt_claim, *opt_output)
+		return
+	}
+
+	if pathmode {
+		doPathPayment(net, *opt_path_receive, uint32(*opt_slippage),
+			flag.Args(), *opt_output)
+		return
+	}
+
+	if *opt_pools {
+		doQueryPools(net, flag.Args())
+		return
+	}
+
+	if poolmode {
+		doPool(net, *opt_pool_withdraw, uint32(*opt_slippage),
+			flag.Args(), *opt_output)
+		return
+	}
+
 	if *opt_friendbot {
 		var acct AccountID
 		if _, err := fmt.Sscan(arg, &acct); err != nil {
@@ -957,10 +1705,24 @@ func main() {
 		return
 	}
 
+	if *opt_watch_ledgers {
+		doWatchLedgers(net)
+		return
+	}
+
 	if *opt_ledger_header {
-		lh, err := net.GetLedgerHeader()
+		var lh *LedgerHeader
+		var err error
+		if arg == "" {
+			lh, err = net.GetLedgerHeader()
+		} else if seq, perr := strconv.ParseUint(arg, 10, 32); perr != nil {
+			fmt.Fprintf(os.Stderr, "invalid ledger number %q\n", arg)
+			os.Exit(2)
+		} else {
+			lh, err = net.GetLedgerHeaderBySeq(uint32(seq))
+		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error fetching fee stats: %s\n",
+			fmt.Fprintf(os.Stderr, "error fetching ledger header: %s\n",
 				err.Error())
 			os.Exit(1)
 		}
@@ -973,14 +1735,60 @@ func main() {
 		return
 	}
 
+	var rpc *RPCClient
+	if *opt_post {
+		rpc = net.RPCClient()
+	}
+	if rpc != nil && (*opt_wait || *opt_key != "") {
+		// RPC submissions always wait and are never resubmitted
+		fmt.Fprintln(os.Stderr,
+			"-wait and -key not available with -post through net.rpc")
+		os.Exit(2)
+	}
+	if *opt_post && *opt_key != "" && net.Resubmit == nil {
+		// With -post, the key is only used to resubmit
+		fmt.Fprintln(os.Stderr,
+			"-key with -post requires the net.resubmit setting")
+		os.Exit(2)
+	}
+
 	e, infmt := mustReadTx(arg)
+	if *opt_post && *opt_key != "" {
+		// The key re-signs transactions and pays for fee bumps
+		sk, err := getSecKey(AdjustKeyName(*opt_key))
+		if err != nil {
+			os.Exit(1)
+		}
+		net.Resubmit.Keys, net.Resubmit.FeeSource = []PrivateKey{sk}, &sk
+	}
 	switch {
+	case *opt_post && rpc != nil:
+		res, err := rpc.Submit(context.Background(), e)
+		if res != nil {
+			fmt.Print(xdr.XdrToString(&res.Result))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Post transaction failed: %s\n",
+				net.ExplainError(context.Background(), e, err))
+			os.Exit(1)
+		}
+	case *opt_post && *opt_wait:
+		res, err := net.PostWait(context.Background(), e)
+		if res != nil {
+			fmt.Print(res)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Post transaction failed: %s\n",
+				net.ExplainError(context.Background(), e, err))
+			os.Exit(1)
+		}
 	case *opt_post:
 		res, err := net.Post(e)
 		if err == nil {
 			fmt.Print(xdr.XdrToString(res))
 		} else {
-			fmt.Fprintf(os.Stderr, "Post transaction failed: %s\n", err)
+			fmt.Fprintf(os.Stderr, "Post transaction failed: %s\n",
+				net.ExplainError(context.Background(), e, err))
 			os.Exit(1)
 		}
 	case *opt_txhash:
@@ -990,6 +1798,12 @@ func main() {
 		*sk.PreAuthTx() = *net.HashTx(e)
 		fmt.Println(&sk)
 	default:
+		if *opt_upgrade {
+			e.ToV1()
+		}
+		if *opt_feebump != "" {
+			e = feeBump(net, e, *opt_feebump)
+		}
 		getAccounts(net, e, *opt_learn)
 		if *opt_zerosig {
 			*e.Signatures() = nil
@@ -1010,6 +1824,8 @@ func main() {
 		}
 		if *opt_learn {
 			net.Save()
+		} else {
+			net.AccountCache.Save()
 		}
 		if *opt_inplace {
 			*opt_output = arg
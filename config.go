@@ -9,7 +9,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const configFileName = "stc.conf"
@@ -149,6 +151,13 @@ type stellarNetParser struct {
 	// tells us we need to save it to the configuration file.
 	// (setName means set it in the configuration file.)
 	setName bool
+
+	// Whether the resubmit setting has been seen, and the value of
+	// resubmit-max-base-fee, which may come before or after it.  As
+	// with other settings, the first file to set one wins, so that
+	// resubmit = 0 can disable resubmission enabled by a later file.
+	setResubmit    bool
+	resubmitMaxFee uint32
 }
 
 func (snp *stellarNetParser) Item(ii ini.IniItem) error {
@@ -171,7 +180,55 @@ func (snp *stellarNetParser) doNet(ii ini.IniItem) error {
 			snp.setName = false
 		}
 	case "horizon":
-		target = &snp.Horizon
+		doURLs(ii, &snp.Horizon, &snp.HorizonURLs)
+	case "rpc":
+		doURLs(ii, &snp.RPC, &snp.RPCURLs)
+	case "account-cache":
+		if ii.Value == nil {
+			snp.AccountCache = nil
+		} else if snp.AccountCache == nil {
+			ttl, err := time.ParseDuration(ii.Val())
+			if err != nil {
+				return ini.BadValue(err.Error())
+			}
+			snp.AccountCache = &AccountCache{TTL: ttl, StaleIfError: true}
+		}
+	case "fee":
+		if ii.Value != nil && snp.FeePolicy == nil {
+			fp := DefaultFeePolicy
+			if err := fp.Set(ii.Val()); err != nil {
+				return ini.BadValue(err.Error())
+			}
+			snp.FeePolicy = &fp
+		}
+	case "resubmit":
+		if ii.Value == nil || snp.setResubmit {
+			break
+		}
+		n, err := strconv.ParseUint(ii.Val(), 10, 31)
+		if err != nil {
+			return ini.BadValue(err.Error())
+		}
+		snp.setResubmit = true
+		if n == 0 {
+			snp.Resubmit = nil
+			break
+		} else if snp.Resubmit == nil {
+			snp.Resubmit = &ResubmitPolicy{MaxBaseFee: snp.resubmitMaxFee}
+		}
+		snp.Resubmit.MaxResubmits = int(n)
+	case "resubmit-max-base-fee":
+		if ii.Value == nil || snp.resubmitMaxFee != 0 {
+			break
+		}
+		n, err := strconv.ParseUint(ii.Val(), 10, 32)
+		if err != nil {
+			return ini.BadValue(err.Error())
+		}
+		snp.resubmitMaxFee = uint32(n)
+		if snp.Resubmit != nil && snp.Resubmit.MaxBaseFee == 0 {
+			snp.Resubmit.MaxBaseFee = snp.resubmitMaxFee
+		}
 	case "native-asset":
 		target = &snp.NativeAsset
 	case "network-id":
@@ -187,6 +244,23 @@ func (snp *stellarNetParser) doNet(ii ini.IniItem) error {
 	return nil
 }
 
+// Parse a horizon or rpc setting, which may list several URLs
+// separated by whitespace.  The first URL is stored in *first, and all
+// of them in *all if there is more than one.
+func doURLs(ii ini.IniItem, first *string, all *[]string) {
+	if ii.Value == nil {
+		*first, *all = "", nil
+	} else if *first == "" {
+		urls := strings.Fields(ii.Val())
+		if len(urls) > 0 {
+			*first = urls[0]
+		}
+		if len(urls) > 1 {
+			*all = urls
+		}
+	}
+}
+
 func (snp *stellarNetParser) doAccounts(ii ini.IniItem) error {
 	var acct MuxedAccount
 	if _, err := fmt.Sscan(ii.Key, &acct); err != nil {
@@ -278,6 +352,11 @@ func LoadStellarNet(name string, paths ...string) (*StellarNet, error) {
 	} else if err = ret.Validate(); err != nil {
 		return nil, err
 	}
+	if c := ret.AccountCache; c != nil && c.Path == "" &&
+		ret.SavePath != "" {
+		c.Path = strings.TrimSuffix(ret.SavePath, ".net") + ".accounts"
+		c.Load()
+	}
 	ret.Save()
 	return &ret, nil
 }
@@ -317,9 +396,11 @@ func DefaultStellarNet(name string) *StellarNet {
 
 // Save any changes to SavePath.  If SavePath does not exist, then
 // create it with permissions Perm (subject to umask, of course).
+// Also saves AccountCache, if it has changed.
 func (net *StellarNet) SavePerm(perm os.FileMode) error {
+	cacheErr := net.AccountCache.Save()
 	if len(net.Edits) == 0 {
-		return nil
+		return cacheErr
 	}
 	if net.SavePath == "" {
 		return os.ErrInvalid
@@ -0,0 +1,290 @@
+package stc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+	"math"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Render a price as a decimal number.
+func priceString(p stx.Price) string {
+	if p.D == 0 {
+		return "NaN"
+	}
+	s := big.NewRat(int64(p.N), int64(p.D)).FloatString(7)
+	return strings.TrimRight(strings.TrimRight(s, "0"), ".")
+}
+
+// A price as horizon represents it in JSON.  Depending on the
+// endpoint and the version of horizon, the numerator and denominator
+// may be numbers or strings.
+type horizonPrice struct {
+	N json.Number
+	D json.Number
+}
+
+// Convert the price to an stx.Price.  Trade prices can have 64-bit
+// numerators and denominators; if they do not fit in 32 bits even
+// after reducing the fraction, they are approximated.
+func (jp *horizonPrice) toPrice(p *stx.Price) error {
+	n, err := stcdetail.JsonNumberToI64(jp.N)
+	if err != nil {
+		return err
+	}
+	d, err := stcdetail.JsonNumberToI64(jp.D)
+	if err != nil {
+		return err
+	}
+	if n < 0 || d <= 0 {
+		return horizonFailure(fmt.Sprintf("invalid price %d/%d", n, d))
+	}
+	ratToPrice(big.NewRat(n, d), p)
+	return nil
+}
+
+// Convert a non-negative rational number to an stx.Price.  If the
+// reduced numerator or denominator does not fit in 32 bits, uses the
+// last convergent of r's continued fraction that does (as
+// stellar-core does when approximating prices), clamping non-zero
+// prices to the range 1/MaxInt32 through MaxInt32/1.
+func ratToPrice(r *big.Rat, p *stx.Price) {
+	max := big.NewInt(math.MaxInt32)
+	if r.Num().Cmp(max) <= 0 && r.Denom().Cmp(max) <= 0 {
+		p.N, p.D = int32(r.Num().Int64()), int32(r.Denom().Int64())
+		return
+	}
+	// h1/k1 is the latest convergent and h0/k0 the one before
+	h0, h1 := big.NewInt(0), big.NewInt(1)
+	k0, k1 := big.NewInt(1), big.NewInt(0)
+	num, den := new(big.Int).Set(r.Num()), new(big.Int).Set(r.Denom())
+	for den.Sign() != 0 {
+		a, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+		h := new(big.Int).Add(new(big.Int).Mul(a, h1), h0)
+		k := new(big.Int).Add(new(big.Int).Mul(a, k1), k0)
+		if h.Cmp(max) > 0 || k.Cmp(max) > 0 {
+			break
+		}
+		h0, h1, k0, k1 = h1, h, k1, k
+		num, den = den, rem
+	}
+	switch {
+	case k1.Sign() == 0:
+		p.N, p.D = math.MaxInt32, 1
+	case h1.Sign() == 0:
+		p.N, p.D = 1, math.MaxInt32
+	default:
+		p.N, p.D = int32(h1.Int64()), int32(k1.Int64())
+	}
+}
+
+// Return horizon query parameters specifying an asset, where prefix
+// (e.g., "selling_" or "base_") is prepended to the names of the
+// asset_type, asset_code, and asset_issuer parameters.
+func assetParams(v url.Values, prefix string, a *stx.Asset) {
+	switch a.Type {
+	case stx.ASSET_TYPE_NATIVE:
+		v.Set(prefix+"asset_type", "native")
+	case stx.ASSET_TYPE_CREDIT_ALPHANUM4:
+		v.Set(prefix+"asset_type", "credit_alphanum4")
+		v.Set(prefix+"asset_code", strings.TrimRight(
+			string(a.AlphaNum4().AssetCode[:]), "\x00"))
+		v.Set(prefix+"asset_issuer", a.AlphaNum4().Issuer.String())
+	case stx.ASSET_TYPE_CREDIT_ALPHANUM12:
+		v.Set(prefix+"asset_type", "credit_alphanum12")
+		v.Set(prefix+"asset_code", strings.TrimRight(
+			string(a.AlphaNum12().AssetCode[:]), "\x00"))
+		v.Set(prefix+"asset_issuer", a.AlphaNum12().Issuer.String())
+	}
+}
+
+// An offer on the decentralized exchange, as returned by horizon's
+// offers endpoints, such as "accounts/ACCOUNT/offers".  Iterate over
+// offers with Iterate, Pager, or Stream.
+type HorizonOffer struct {
+	Net                  *StellarNet `json:"-"`
+	Id                   stcdetail.JsonInt64
+	Paging_token         string
+	Seller               AccountID
+	Selling              stx.Asset `json:"-"`
+	Buying               stx.Asset `json:"-"`
+	Amount               stcdetail.JsonInt64e7
+	Price                stx.Price `json:"-"`
+	Last_modified_ledger uint32
+	Last_modified_time   *time.Time
+	Sponsor              *AccountID
+}
+
+func (o *HorizonOffer) UnmarshalJSON(data []byte) error {
+	type jho HorizonOffer
+	var j struct {
+		*jho
+		Selling horizonAsset
+		Buying  horizonAsset
+		Price_r horizonPrice
+	}
+	j.jho = (*jho)(o)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	} else if err = j.Selling.toAsset(&o.Selling); err != nil {
+		return err
+	} else if err = j.Buying.toAsset(&o.Buying); err != nil {
+		return err
+	}
+	return j.Price_r.toPrice(&o.Price)
+}
+
+func (o *HorizonOffer) String() string {
+	return stcdetail.PrettyPrintAux(o.Net.prettyPrintAux, o)
+}
+
+// A trade on the decentralized exchange, as returned by horizon's
+// trades endpoints, such as "accounts/ACCOUNT/trades" or the query
+// returned by TradesQuery.  For trades against a liquidity pool,
+// the pool ID is reported instead of an offer ID and account.  Price
+// is the price of the base asset in terms of the counter asset.
+type HorizonTrade struct {
+	Net                       *StellarNet `json:"-"`
+	Id                        string
+	Paging_token              string
+	Ledger_close_time         time.Time
+	Trade_type                string
+	Base_offer_id             string
+	Base_account              *AccountID
+	Base_liquidity_pool_id    string
+	Base_amount               stcdetail.JsonInt64e7
+	Base_asset                stx.Asset `json:"-"`
+	Counter_offer_id          string
+	Counter_account           *AccountID
+	Counter_liquidity_pool_id string
+	Counter_amount            stcdetail.JsonInt64e7
+	Counter_asset             stx.Asset `json:"-"`
+	Base_is_seller            bool
+	Price                     stx.Price `json:"-"`
+	Liquidity_pool_fee_bp     uint32
+}
+
+func (t *HorizonTrade) UnmarshalJSON(data []byte) error {
+	type jht HorizonTrade
+	var j struct {
+		*jht
+		Base_asset_type      string
+		Base_asset_code      string
+		Base_asset_issuer    AccountID
+		Counter_asset_type   string
+		Counter_asset_code   string
+		Counter_asset_issuer AccountID
+		Price                horizonPrice
+	}
+	j.jht = (*jht)(t)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	base := horizonAsset{
+		Asset_type:   j.Base_asset_type,
+		Asset_code:   j.Base_asset_code,
+		Asset_issuer: j.Base_asset_issuer,
+	}
+	counter := horizonAsset{
+		Asset_type:   j.Counter_asset_type,
+		Asset_code:   j.Counter_asset_code,
+		Asset_issuer: j.Counter_asset_issuer,
+	}
+	if err := base.toAsset(&t.Base_asset); err != nil {
+		return err
+	} else if err = counter.toAsset(&t.Counter_asset); err != nil {
+		return err
+	}
+	return j.Price.toPrice(&t.Price)
+}
+
+func (t *HorizonTrade) String() string {
+	return stcdetail.PrettyPrintAux(t.Net.prettyPrintAux, t)
+}
+
+// Return a horizon query for trades between two assets, suitable for
+// Iterate, Pager, or Stream.
+func TradesQuery(base, counter *stx.Asset) string {
+	v := url.Values{}
+	assetParams(v, "base_", base)
+	assetParams(v, "counter_", counter)
+	return "trades?" + v.Encode()
+}
+
+// One price level of an order book.
+type HorizonOrderBookEntry struct {
+	Price  stx.Price `json:"-"`
+	Amount stcdetail.JsonInt64e7
+}
+
+func (e *HorizonOrderBookEntry) UnmarshalJSON(data []byte) error {
+	type jhe HorizonOrderBookEntry
+	var j struct {
+		*jhe
+		Price_r horizonPrice
+	}
+	j.jhe = (*jhe)(e)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	return j.Price_r.toPrice(&e.Price)
+}
+
+// The order book for an asset pair, as returned by horizon.  Asks
+// are offers to sell the Base asset for the Counter asset, and Bids
+// are offers to buy the Base asset with the Counter asset.  In both
+// cases, Price is the price of the Base asset in terms of the Counter
+// asset, and Amount is denominated in the Base asset for asks and in
+// the Counter asset for bids.
+type HorizonOrderBook struct {
+	Net     *StellarNet `json:"-"`
+	Base    stx.Asset   `json:"-"`
+	Counter stx.Asset   `json:"-"`
+	Bids    []HorizonOrderBookEntry
+	Asks    []HorizonOrderBookEntry
+}
+
+func (ob *HorizonOrderBook) UnmarshalJSON(data []byte) error {
+	type jhob HorizonOrderBook
+	var j struct {
+		*jhob
+		Base    horizonAsset
+		Counter horizonAsset
+	}
+	j.jhob = (*jhob)(ob)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	} else if err = j.Base.toAsset(&ob.Base); err != nil {
+		return err
+	}
+	return j.Counter.toAsset(&ob.Counter)
+}
+
+func (ob *HorizonOrderBook) String() string {
+	return stcdetail.PrettyPrintAux(ob.Net.prettyPrintAux, ob)
+}
+
+// Fetch the order book for offers selling one asset for another.  If
+// limit is greater than 0, it bounds the number of price levels
+// returned on each side of the book.
+func (net *StellarNet) GetOrderBook(ctx context.Context,
+	selling, buying *stx.Asset, limit int) (*HorizonOrderBook, error) {
+	v := url.Values{}
+	assetParams(v, "selling_", selling)
+	assetParams(v, "buying_", buying)
+	if limit > 0 {
+		v.Set("limit", fmt.Sprint(limit))
+	}
+	ret := HorizonOrderBook{Net: net}
+	if err := net.GetJSONCtx(ctx, "order_book?"+v.Encode(),
+		&ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
@@ -0,0 +1,386 @@
+package stc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to avoid a server after it fails with a temporary error.
+const endpointDownTime = 30 * time.Second
+
+// The health of a horizon or RPC server, as reported by
+// CheckEndpoints.  Err is nil if the server is healthy.
+type EndpointStatus struct {
+	URL       string
+	RPC       bool
+	NetworkId string
+	Latency   time.Duration
+	Err       error
+}
+
+func (st *EndpointStatus) String() string {
+	kind := "horizon"
+	if st.RPC {
+		kind = "rpc"
+	}
+	if st.Err != nil {
+		return fmt.Sprintf("%s %s: %s", kind, st.URL, st.Err)
+	}
+	return fmt.Sprintf("%s %s: ok (%s)", kind, st.URL,
+		st.Latency.Round(time.Millisecond))
+}
+
+// Returned (in EndpointStatus) when a server reports a different
+// network passphrase from the other servers of the StellarNet.
+// Requests are never sent to such a server.
+type ErrWrongNetwork struct {
+	URL      string
+	Expected string
+	Got      string
+}
+
+func (e *ErrWrongNetwork) Error() string {
+	return fmt.Sprintf("%s reports network %q instead of %q",
+		e.URL, e.Got, e.Expected)
+}
+
+type endpoint struct {
+	url       string
+	latency   time.Duration
+	downUntil time.Time
+	wrongNet  error
+}
+
+// The servers of one kind (horizon or RPC) for a StellarNet.
+type endpointGroup struct {
+	urls []string
+	eps  []endpoint
+}
+
+// Rebuild the group if the configured URLs have changed.
+func (g *endpointGroup) sync(urls []string) {
+	if len(g.urls) == len(urls) {
+		same := true
+		for i := range urls {
+			same = same && g.urls[i] == urls[i]
+		}
+		if same {
+			return
+		}
+	}
+	g.urls = append([]string(nil), urls...)
+	g.eps = make([]endpoint, len(urls))
+	for i := range urls {
+		g.eps[i].url = urls[i]
+	}
+}
+
+// Return the preferred endpoint other than skip, preferring servers
+// that are up, then servers that will be up soonest, then lower
+// latency, then configuration order.  Returns nil if there is no
+// server on the right network.
+func (g *endpointGroup) pick(now time.Time, skip *endpoint) *endpoint {
+	var best *endpoint
+	for i := range g.eps {
+		ep := &g.eps[i]
+		if ep == skip || ep.wrongNet != nil {
+			continue
+		} else if best == nil {
+			best = ep
+			continue
+		}
+		up, bestUp := !now.Before(ep.downUntil), !now.Before(best.downUntil)
+		if up != bestUp {
+			if up {
+				best = ep
+			}
+		} else if !up {
+			if ep.downUntil.Before(best.downUntil) {
+				best = ep
+			}
+		} else if ep.latency < best.latency {
+			best = ep
+		}
+	}
+	return best
+}
+
+// Return the endpoint whose URL is the longest prefix of u, or nil.
+func (g *endpointGroup) find(u string) *endpoint {
+	var ret *endpoint
+	for i := range g.eps {
+		ep := &g.eps[i]
+		if strings.HasPrefix(u, ep.url) &&
+			(ret == nil || len(ep.url) > len(ret.url)) {
+			ret = ep
+		}
+	}
+	return ret
+}
+
+type endpointState struct {
+	mu      sync.Mutex
+	checked bool
+	horizon endpointGroup
+	rpc     endpointGroup
+}
+
+// Protects the lazy initialization of StellarNet's unexported state.
+var netStateMu sync.Mutex
+
+func (net *StellarNet) endpointState() *endpointState {
+	netStateMu.Lock()
+	defer netStateMu.Unlock()
+	if net.endpoints == nil {
+		net.endpoints = &endpointState{}
+	}
+	return net.endpoints
+}
+
+func (net *StellarNet) horizonURLs() []string {
+	if len(net.HorizonURLs) > 0 {
+		return net.HorizonURLs
+	} else if net.Horizon != "" {
+		return []string{net.Horizon}
+	}
+	return nil
+}
+
+func (net *StellarNet) rpcURLs() []string {
+	if len(net.RPCURLs) > 0 {
+		return net.RPCURLs
+	} else if net.RPC != "" {
+		return []string{net.RPC}
+	}
+	return nil
+}
+
+// Return the URL of the preferred server in urls.
+func (net *StellarNet) preferredURL(urls []string, rpc bool) string {
+	if len(urls) <= 1 {
+		if len(urls) == 0 {
+			return ""
+		}
+		return urls[0]
+	}
+	s := net.endpointState()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := &s.horizon
+	if rpc {
+		g = &s.rpc
+	}
+	g.sync(urls)
+	if ep := g.pick(time.Now(), nil); ep != nil {
+		return ep.url
+	}
+	return urls[0]
+}
+
+// If several horizon and RPC servers are configured in all and have
+// not yet been checked, check them.
+func (net *StellarNet) checkEndpointsOnce(ctx context.Context) {
+	if len(net.horizonURLs())+len(net.rpcURLs()) <= 1 {
+		return
+	}
+	s := net.endpointState()
+	s.mu.Lock()
+	check := !s.checked
+	s.checked = true
+	s.mu.Unlock()
+	if check {
+		net.CheckEndpoints(ctx)
+	}
+}
+
+// Return the base URL of the preferred horizon server, or "" if none
+// is configured.  If several servers are configured and have not yet
+// been checked, checks them first.
+func (net *StellarNet) horizonBase(ctx context.Context) string {
+	net.checkEndpointsOnce(ctx)
+	return net.preferredURL(net.horizonURLs(), false)
+}
+
+// Return the URL of the preferred RPC server, or "" if none is
+// configured.  If several servers are configured and have not yet
+// been checked, checks them first.
+func (net *StellarNet) rpcBase(ctx context.Context) string {
+	net.checkEndpointsOnce(ctx)
+	return net.preferredURL(net.rpcURLs(), true)
+}
+
+// If u is a URL on one of several configured servers, mark that
+// server as down and return u rewritten to use the preferred server
+// that is still up.  Otherwise, returns "".
+func (net *StellarNet) failover(u string) string {
+	hurls, rurls := net.horizonURLs(), net.rpcURLs()
+	if len(hurls) <= 1 && len(rurls) <= 1 {
+		return ""
+	}
+	s := net.endpointState()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, g := range []struct {
+		g    *endpointGroup
+		urls []string
+	}{{&s.horizon, hurls}, {&s.rpc, rurls}} {
+		if len(g.urls) <= 1 {
+			continue
+		}
+		g.g.sync(g.urls)
+		cur := g.g.find(u)
+		if cur == nil {
+			continue
+		}
+		cur.downUntil = now.Add(endpointDownTime)
+		if next := g.g.pick(now, cur); next != nil &&
+			!now.Before(next.downUntil) {
+			return next.url + u[len(cur.url):]
+		}
+		return ""
+	}
+	return ""
+}
+
+// Check the health of one server, filling in st.
+func (net *StellarNet) checkEndpoint(ctx context.Context,
+	st *EndpointStatus) {
+	var req *http.Request
+	if st.RPC {
+		req, st.Err = http.NewRequestWithContext(ctx, "POST", st.URL,
+			strings.NewReader(
+				`{"jsonrpc":"2.0","id":1,"method":"getNetwork"}`))
+		if st.Err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	} else {
+		req, st.Err = http.NewRequestWithContext(ctx, "GET", st.URL, nil)
+	}
+	if st.Err != nil {
+		return
+	}
+	start := time.Now()
+	resp, err := net.doOnce(req, true)
+	if err != nil {
+		st.Err = err
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	st.Latency = time.Since(start)
+	if err != nil {
+		st.Err = err
+		return
+	} else if resp.StatusCode != 200 {
+		st.Err = newHorizonProblem(resp, body)
+		return
+	}
+	var reply struct {
+		Network_passphrase string
+		Result             struct{ Passphrase string }
+		Error              *RPCError
+	}
+	if err = json.Unmarshal(body, &reply); err != nil {
+		st.Err = err
+	} else if reply.Error != nil {
+		st.Err = reply.Error
+	} else if st.RPC {
+		st.NetworkId = reply.Result.Passphrase
+	} else {
+		st.NetworkId = reply.Network_passphrase
+	}
+	if st.Err == nil && st.NetworkId == "" {
+		st.Err = horizonFailure("no network passphrase in response")
+	}
+}
+
+// Check the health of all configured horizon and RPC servers by
+// querying the root endpoint of each horizon server and the
+// getNetwork method of each RPC server, measuring their latency.
+// Subsequent requests go to the healthy server with the lowest
+// latency.  A server reporting a network passphrase other than
+// NetworkId (or, if NetworkId is empty, other than the first healthy
+// server's) gets an ErrWrongNetwork and is never used.
+// CheckEndpoints is called automatically before the first request to
+// a network with more than one server (horizon and RPC combined).
+func (net *StellarNet) CheckEndpoints(ctx context.Context) []EndpointStatus {
+	ctx = ctxOrBackground(ctx)
+	hurls, rurls := net.horizonURLs(), net.rpcURLs()
+	ret := make([]EndpointStatus, len(hurls)+len(rurls))
+	var wg sync.WaitGroup
+	for i := range ret {
+		st := &ret[i]
+		if i < len(hurls) {
+			st.URL = hurls[i]
+		} else {
+			st.URL, st.RPC = rurls[i-len(hurls)], true
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			net.checkEndpoint(ctx, st)
+		}()
+	}
+	wg.Wait()
+
+	expected := net.NetworkId
+	for i := range ret {
+		if expected == "" && ret[i].Err == nil {
+			expected = ret[i].NetworkId
+		}
+	}
+	for i := range ret {
+		if ret[i].Err == nil && ret[i].NetworkId != expected {
+			ret[i].Err = &ErrWrongNetwork{
+				URL:      ret[i].URL,
+				Expected: expected,
+				Got:      ret[i].NetworkId,
+			}
+		}
+	}
+
+	s := net.endpointState()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checked = true
+	s.horizon.sync(hurls)
+	s.rpc.sync(rurls)
+	now := time.Now()
+	for i := range ret {
+		var ep *endpoint
+		if ret[i].RPC {
+			ep = &s.rpc.eps[i-len(hurls)]
+		} else {
+			ep = &s.horizon.eps[i]
+		}
+		ep.latency, ep.downUntil, ep.wrongNet =
+			ret[i].Latency, time.Time{}, nil
+		var wn *ErrWrongNetwork
+		if errors.As(ret[i].Err, &wn) {
+			ep.wrongNet = wn
+		} else if ret[i].Err != nil {
+			ep.downUntil = now.Add(endpointDownTime)
+		}
+	}
+	return ret
+}
+
+// Return a copy of req sent to u instead.
+func retarget(req *http.Request, u string) (*http.Request, error) {
+	nu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	ret := req.Clone(req.Context())
+	ret.URL, ret.Host = nu, ""
+	return ret, nil
+}
@@ -0,0 +1,388 @@
+package stc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xdrpp/goxdr/xdr"
+	"github.com/xdrpp/stc/stx"
+	"strings"
+)
+
+// Why a transaction or one of its operations failed, as returned by
+// ExplainTxFailure.
+type FailureExplanation struct {
+	// The 0-based index of the failed operation, or -1 if the
+	// transaction failed as a whole.
+	OpIndex int
+
+	// The failed operation, or nil if OpIndex is -1.
+	Op *stx.Operation
+
+	// The most specific result code, such as a PaymentResultCode for
+	// a failed PAYMENT operation.
+	Code xdr.XdrEnum
+
+	// A plain-language explanation of Code and the likely fix, or ""
+	// if stc does not know anything more about Code than its comment
+	// in the XDR.
+	Explanation string
+	Fix         string
+}
+
+type failureHelp struct {
+	explanation, fix string
+}
+
+// Help for a destination that cannot receive an asset.
+var destNoTrust = failureHelp{
+	"The destination account has no trustline for the asset.",
+	"Have the destination add a trustline (CHANGE_TRUST) first.",
+}
+
+// Explanations of result codes.  Keys beginning with "_" apply to any
+// operation result code ending with the key, so long as no key
+// matches the code more specifically.
+var failureHelps = map[string]failureHelp{
+	"txTOO_EARLY": {
+		"The transaction's time or ledger bounds have not yet started.",
+		"Wait until the minimum time or ledger, or relax the bounds.",
+	},
+	"txTOO_LATE": {
+		"The transaction's time or ledger bounds have already passed.",
+		"Set new bounds, update the sequence number, and sign again.",
+	},
+	"txMISSING_OPERATION": {
+		"The transaction has no operations.",
+		"Add at least one operation.",
+	},
+	"txBAD_SEQ": {
+		"The transaction's sequence number is not the source account's" +
+			" next sequence number.",
+		"Update the sequence number (stc -u) and sign again.",
+	},
+	"txBAD_AUTH": {
+		"The signatures do not meet the source account's thresholds," +
+			" or were made for a different network.",
+		"Sign with enough of the account's signers, using the right" +
+			" network.",
+	},
+	"txBAD_AUTH_EXTRA": {
+		"The transaction has signatures that were not needed.",
+		"Remove the unused signatures.",
+	},
+	"txINSUFFICIENT_BALANCE": {
+		"Paying the fee would bring the source account's balance below" +
+			" its minimum reserve.",
+		"Fund the source account or lower the fee.",
+	},
+	"txNO_ACCOUNT": {
+		"The source account does not exist.",
+		"Create and fund the source account first.",
+	},
+	"txINSUFFICIENT_FEE": {
+		"The fee is lower than the network currently requires.",
+		"Raise the fee (see stc -fee-stats) and sign again.",
+	},
+	"txBAD_SPONSORSHIP": {
+		"A sponsorship was begun but not ended within the transaction.",
+		"Pair each BEGIN_SPONSORING_FUTURE_RESERVES with an" +
+			" END_SPONSORING_FUTURE_RESERVES.",
+	},
+	"txBAD_MIN_SEQ_AGE_OR_GAP": {
+		"The transaction's minimum sequence age or ledger gap has not" +
+			" been reached.",
+		"Wait, or relax the transaction's preconditions.",
+	},
+	"txMALFORMED": {
+		"The transaction is invalid, for example its preconditions are" +
+			" inconsistent.",
+		"Check the transaction's preconditions and fields.",
+	},
+	"opBAD_AUTH": {
+		"The signatures do not meet the operation's source account's" +
+			" thresholds.",
+		"Sign with enough of the operation source account's signers.",
+	},
+	"opNO_ACCOUNT": {
+		"The operation's source account does not exist.",
+		"Create and fund the operation's source account first.",
+	},
+	"opTOO_MANY_SUBENTRIES": {
+		"The account has too many trustlines, offers, signers, and" +
+			" data entries.",
+		"Remove some of the account's subentries.",
+	},
+	"opTOO_MANY_SPONSORING": {
+		"The account sponsors too many ledger entries.",
+		"Revoke some of the account's sponsorships.",
+	},
+	"_MALFORMED": {
+		"The operation's arguments are invalid, for example a negative" +
+			" amount or an invalid asset code.",
+		"Check the operation's fields.",
+	},
+	"_UNDERFUNDED": {
+		"The source account does not hold enough of the asset being" +
+			" sent, after accounting for its reserve and liabilities.",
+		"Fund the source account or reduce the amount.",
+	},
+	"_LOW_RESERVE": {
+		"The operation would bring the account's XLM balance below the" +
+			" minimum reserve for its number of subentries.",
+		"Fund the account with more XLM or remove some of its" +
+			" subentries.",
+	},
+	"_NO_DESTINATION": {
+		"The destination account does not exist.",
+		"Create the account with CREATE_ACCOUNT, or check the" +
+			" destination.",
+	},
+	"PAYMENT_NO_TRUST":                     destNoTrust,
+	"PATH_PAYMENT_STRICT_RECEIVE_NO_TRUST": destNoTrust,
+	"PATH_PAYMENT_STRICT_SEND_NO_TRUST":    destNoTrust,
+	"_SRC_NO_TRUST": {
+		"The source account has no trustline for the asset it sends.",
+		"Add a trustline (CHANGE_TRUST) to the source account first.",
+	},
+	"_SELL_NO_TRUST": {
+		"The account has no trustline for the asset it is selling.",
+		"Add a trustline (CHANGE_TRUST) for the selling asset.",
+	},
+	"_BUY_NO_TRUST": {
+		"The account has no trustline for the asset it is buying.",
+		"Add a trustline (CHANGE_TRUST) for the buying asset.",
+	},
+	"_NOT_AUTHORIZED": {
+		"The issuer has not authorized the account to hold the asset.",
+		"Ask the asset's issuer to authorize the trustline.",
+	},
+	"_SRC_NOT_AUTHORIZED": {
+		"The issuer has not authorized the source account to send the" +
+			" asset.",
+		"Ask the asset's issuer to authorize the trustline.",
+	},
+	"_LINE_FULL": {
+		"The receiving account would exceed its trustline's limit.",
+		"Raise the trustline's limit (CHANGE_TRUST) or send less.",
+	},
+	"_NO_ISSUER": {
+		"The asset's issuer account does not exist.",
+		"Check the asset's issuer.",
+	},
+	"_CROSS_SELF": {
+		"The offer would trade with one of the account's own offers.",
+		"Cancel or change the account's crossing offer.",
+	},
+	"_TOO_FEW_OFFERS": {
+		"The order book does not have enough offers along the path.",
+		"Try a different path (stc -path-send or -path-receive find" +
+			" one) or a smaller amount.",
+	},
+	"_OVER_SENDMAX": {
+		"Delivering the amount would cost more than the maximum send" +
+			" amount.",
+		"Raise the maximum send amount or find a better path.",
+	},
+	"_UNDER_DESTMIN": {
+		"The amount delivered would be less than the minimum" +
+			" destination amount.",
+		"Lower the minimum destination amount or find a better path.",
+	},
+	"CREATE_ACCOUNT_ALREADY_EXIST": {
+		"The account being created already exists.",
+		"Send a PAYMENT instead.",
+	},
+	"CREATE_ACCOUNT_LOW_RESERVE": {
+		"The starting balance is less than the minimum reserve.",
+		"Raise the starting balance.",
+	},
+	"ACCOUNT_MERGE_HAS_SUB_ENTRIES": {
+		"The account being merged still has trustlines, offers, or" +
+			" data entries.",
+		"Remove the account's subentries before merging.",
+	},
+	"ACCOUNT_MERGE_SEQNUM_TOO_FAR": {
+		"The account's sequence number is too high for it to be" +
+			" merged and recreated.",
+		"The account cannot be merged.",
+	},
+	"ACCOUNT_MERGE_IS_SPONSOR": {
+		"The account being merged sponsors other ledger entries.",
+		"Revoke or transfer the account's sponsorships first.",
+	},
+	"SET_OPTIONS_TOO_MANY_SIGNERS": {
+		"The account already has the maximum number of signers.",
+		"Remove a signer first.",
+	},
+	"CHANGE_TRUST_INVALID_LIMIT": {
+		"The limit is less than the trustline's current balance and" +
+			" liabilities.",
+		"Raise the limit, or empty the trustline before removing it.",
+	},
+	"CREATE_CLAIMABLE_BALANCE_NO_TRUST": {
+		"The source account has no trustline for the balance's asset.",
+		"Add a trustline (CHANGE_TRUST) to the source account first.",
+	},
+	"CLAIM_CLAIMABLE_BALANCE_NO_TRUST": {
+		"The claiming account has no trustline for the balance's" +
+			" asset.",
+		"Add a trustline (CHANGE_TRUST) before claiming.",
+	},
+	"CLAWBACK_NO_TRUST": {
+		"The account being clawed back from has no trustline for the" +
+			" asset.",
+		"Check the from account and the asset.",
+	},
+	"CLAWBACK_UNDERFUNDED": {
+		"The account being clawed back from holds less of the asset" +
+			" than the amount.",
+		"Claw back a smaller amount.",
+	},
+	"LIQUIDITY_POOL_DEPOSIT_NO_TRUST": {
+		"The account has no trustline for one of the pool's assets.",
+		"Add trustlines (CHANGE_TRUST) for both of the pool's assets.",
+	},
+	"LIQUIDITY_POOL_WITHDRAW_NO_TRUST": {
+		"The account has no trustline for the pool's shares.",
+		"Check the liquidity pool ID.",
+	},
+	"CLAIM_CLAIMABLE_BALANCE_CANNOT_CLAIM": {
+		"The account is not a claimant, or the claim predicate is not" +
+			" satisfied.",
+		"Check the balance's claimants and predicates (stc -qcb).",
+	},
+}
+
+// Look up the help for a result code, preferring an exact match,
+// then the longest matching suffix.
+func getFailureHelp(code string) (failureHelp, bool) {
+	if h, ok := failureHelps[code]; ok {
+		return h, true
+	}
+	best := ""
+	for k := range failureHelps {
+		if strings.HasPrefix(k, "_") && strings.HasSuffix(code, k) &&
+			len(k) > len(best) {
+			best = k
+		}
+	}
+	h, ok := failureHelps[best]
+	return h, ok
+}
+
+func newFailureExplanation(i int, op *stx.Operation,
+	code xdr.XdrEnum) FailureExplanation {
+	ret := FailureExplanation{OpIndex: i, Op: op, Code: code}
+	if h, ok := getFailureHelp(code.String()); ok {
+		ret.Explanation, ret.Fix = h.explanation, h.fix
+	}
+	return ret
+}
+
+// Explain why a transaction failed, given the transaction and the
+// TxFailure that Post (or PostWait or RPCClient.Submit) returned for
+// it.  Returns one FailureExplanation for each failed operation, or a
+// single one with OpIndex -1 if the transaction failed as a whole.
+// When the failure is a bad sequence number, ExplainTxFailure fetches
+// the source account to report the sequence number that was
+// expected.
+func (net *StellarNet) ExplainTxFailure(ctx context.Context,
+	e *TransactionEnvelope, txf TxFailure) []FailureExplanation {
+	env := e.TransactionEnvelope
+	code := txf.Result.Code
+	var results []stx.OperationResult
+	switch code {
+	case stx.TxFAILED:
+		results = *txf.Result.Results()
+	case stx.TxFEE_BUMP_INNER_FAILED:
+		inner := &txf.Result.InnerResultPair().Result.Result
+		env, code = innerEnvelope(env), inner.Code
+		if code == stx.TxFAILED {
+			results = *inner.Results()
+		}
+	}
+	if code != stx.TxFAILED {
+		ret := newFailureExplanation(-1, nil, &code)
+		if code == stx.TxBAD_SEQ {
+			ret.Explanation = net.explainBadSeq(ctx, env)
+		}
+		return []FailureExplanation{ret}
+	}
+
+	var ret []FailureExplanation
+	ops := env.Operations()
+	for i := range results {
+		var op *stx.Operation
+		if ops != nil && i < len(*ops) {
+			op = &(*ops)[i]
+		}
+		if code := results[i].Code; code != stx.OpINNER {
+			ret = append(ret, newFailureExplanation(i, op, &code))
+		} else if opcode := resultCode(
+			results[i].Tr().XdrUnionBody()); opcode != nil &&
+			opcode.GetU32() != 0 {
+			// All operation result codes other than SUCCESS are
+			// non-zero
+			ret = append(ret, newFailureExplanation(i, op, opcode))
+		}
+	}
+	return ret
+}
+
+// Explain a bad sequence number by comparing the transaction's
+// sequence number to its source account's.
+func (net *StellarNet) explainBadSeq(ctx context.Context,
+	env *stx.TransactionEnvelope) string {
+	var used stx.SequenceNumber
+	switch env.Type {
+	case stx.ENVELOPE_TYPE_TX_V0:
+		used = env.V0().Tx.SeqNum
+	case stx.ENVELOPE_TYPE_TX:
+		used = env.V1().Tx.SeqNum
+	}
+	src := (&TransactionEnvelope{TransactionEnvelope: env}).SourceAccount()
+	ae, err := net.GetAccountEntryCtx(ctx, src.ToSignerKey().String())
+	if err != nil {
+		return fmt.Sprintf("The transaction's sequence number %d is not"+
+			" the source account's next sequence number.", used)
+	}
+	return fmt.Sprintf("The transaction's sequence number is %d, but"+
+		" the source account's next sequence number is %d.",
+		used, ae.NextSeq())
+}
+
+// Describe an error returned when submitting e.  If err is a
+// TxFailure, the description explains each failure reported by
+// ExplainTxFailure and shows the failed operations in txrep format.
+// Otherwise, it is just err.Error().
+func (net *StellarNet) ExplainError(ctx context.Context,
+	e *TransactionEnvelope, err error) string {
+	var txf TxFailure
+	if !errors.As(err, &txf) {
+		return err.Error()
+	}
+	out := strings.Builder{}
+	out.WriteString(enumDesc(&txf.Result.Code))
+	for _, fe := range net.ExplainTxFailure(ctx, e, txf) {
+		if fe.OpIndex < 0 {
+			fmt.Fprintf(&out, "\ntransaction: %s", enumDesc(fe.Code))
+		} else {
+			fmt.Fprintf(&out, "\noperation %d: %s", fe.OpIndex,
+				enumDesc(fe.Code))
+		}
+		if fe.Explanation != "" {
+			fmt.Fprintf(&out, "\n  %s", fe.Explanation)
+		}
+		if fe.Fix != "" {
+			fmt.Fprintf(&out, "\n  Fix: %s", fe.Fix)
+		}
+		if fe.Op != nil {
+			rep := strings.Builder{}
+			net.WriteRep(&rep, "operation", fe.Op)
+			out.WriteString("\n  " + strings.ReplaceAll(
+				strings.TrimSuffix(rep.String(), "\n"), "\n", "\n  "))
+		}
+	}
+	return out.String()
+}
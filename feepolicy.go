@@ -0,0 +1,168 @@
+package stc
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/xdrpp/stc/stx"
+)
+
+// Ledger capacity usage at or above which a FeePolicy's
+// CongestionMultiplier applies, if its CongestionUsage is zero.
+const DefaultCongestionUsage = 0.9
+
+// How to choose the base fee (the fee per operation) of a
+// transaction.  See StellarNet.FeePolicy.
+type FeePolicy struct {
+	// Percentile of recently offered fees (see FeeStats.Percentile)
+	// to offer.  If zero, uses DefaultFeePolicy.Percentile.
+	Percentile int
+
+	// If non-zero, offer this base fee instead of a percentile of
+	// recent fees.
+	Fixed uint32
+
+	// If non-zero, never offer a base fee higher than MaxBaseFee.
+	MaxBaseFee uint32
+
+	// If non-zero, multiply the base fee by CongestionMultiplier when
+	// the network is congested, meaning the Ledger_capacity_usage of
+	// its fee statistics is at least CongestionUsage (or
+	// DefaultCongestionUsage if CongestionUsage is zero).
+	CongestionMultiplier float64
+	CongestionUsage      float64
+}
+
+// The fee policy used when StellarNet.FeePolicy is nil.
+var DefaultFeePolicy = FeePolicy{Percentile: 20}
+
+func (net *StellarNet) feePolicy() *FeePolicy {
+	if net.FeePolicy != nil {
+		return net.FeePolicy
+	}
+	return &DefaultFeePolicy
+}
+
+// True if the policy depends on the network's fee statistics.
+func (fp *FeePolicy) NeedsFeeStats() bool {
+	return fp.Fixed == 0 || fp.CongestionMultiplier != 0
+}
+
+// Return the base fee to offer given the network's fee statistics,
+// which may be nil if NeedsFeeStats returns false.
+func (fp *FeePolicy) BaseFee(fs *FeeStats) uint32 {
+	fee := float64(fp.Fixed)
+	if fee == 0 && fs != nil {
+		p := fp.Percentile
+		if p == 0 {
+			p = DefaultFeePolicy.Percentile
+		}
+		fee = float64(fs.Percentile(p))
+	}
+	usage := fp.CongestionUsage
+	if usage == 0 {
+		usage = DefaultCongestionUsage
+	}
+	if fp.CongestionMultiplier != 0 && fs != nil &&
+		fs.Ledger_capacity_usage >= usage {
+		fee *= fp.CongestionMultiplier
+	}
+	if fp.MaxBaseFee != 0 && fee > float64(fp.MaxBaseFee) {
+		fee = float64(fp.MaxBaseFee)
+	}
+	if fee > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(fee)
+}
+
+// Render the policy in the format accepted by Set.
+func (fp *FeePolicy) String() string {
+	var items []string
+	if fp.Fixed != 0 {
+		items = append(items, strconv.FormatUint(uint64(fp.Fixed), 10))
+	} else if fp.Percentile != 0 {
+		items = append(items, fmt.Sprintf("p%d", fp.Percentile))
+	}
+	if fp.MaxBaseFee != 0 {
+		items = append(items, fmt.Sprintf("max=%d", fp.MaxBaseFee))
+	}
+	if fp.CongestionMultiplier != 0 {
+		items = append(items, "congested="+strconv.FormatFloat(
+			fp.CongestionMultiplier, 'g', -1, 64))
+	}
+	return strings.Join(items, ",")
+}
+
+// Update the policy from a comma-separated list of settings, each of
+// which is one of the following:
+//
+//	pN           offer the Nth percentile of recent fees
+//	N            offer a fixed base fee of N stroops
+//	max=N        never offer more than N stroops per operation
+//	congested=F  multiply the base fee by F when the network is
+//	             congested
+//
+// Settings not mentioned in the list are left unchanged, except that
+// pN and N replace each other.
+func (fp *FeePolicy) Set(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		var err error
+		var n uint64
+		switch {
+		case item == "":
+		case strings.HasPrefix(item, "p"):
+			if n, err = strconv.ParseUint(item[1:], 10, 7); n > 100 {
+				err = strconv.ErrRange
+			} else if err == nil {
+				fp.Percentile, fp.Fixed = int(n), 0
+			}
+		case strings.HasPrefix(item, "max="):
+			if n, err = strconv.ParseUint(item[4:], 10, 32); err == nil {
+				fp.MaxBaseFee = uint32(n)
+			}
+		case strings.HasPrefix(item, "congested="):
+			var f float64
+			if f, err = strconv.ParseFloat(item[10:], 64); err == nil {
+				fp.CongestionMultiplier = f
+			}
+		default:
+			if n, err = strconv.ParseUint(item, 10, 32); err == nil {
+				fp.Fixed = uint32(n)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid fee setting %q", item)
+		}
+	}
+	return nil
+}
+
+// Set the fee of a transaction (including a fee-bump transaction)
+// according to net.FeePolicy, fetching the network's fee statistics
+// if the policy requires them.  A fee-bump transaction is never given
+// a lower fee per operation than its inner transaction.
+func (net *StellarNet) ApplyFeePolicy(ctx context.Context,
+	e *TransactionEnvelope) error {
+	fp := net.feePolicy()
+	var fs *FeeStats
+	if fp.NeedsFeeStats() {
+		var err error
+		if fs, err = net.GetFeeStatsCtx(ctx); err != nil {
+			return err
+		}
+	}
+	fee := fp.BaseFee(fs)
+	if e.Type == stx.ENVELOPE_TYPE_TX_FEE_BUMP {
+		if min := minFeeBumpBaseFee(
+			e.FeeBump().Tx.InnerTx.V1()); fee < min {
+			fee = min
+		}
+	}
+	e.SetFee(fee)
+	return nil
+}
@@ -53,8 +53,108 @@ func (e horizonFailure) Error() string {
 
 const badHorizonURL horizonFailure = "Missing or invalid horizon URL"
 
-func getURL(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+// Result codes horizon reports for a failed transaction submission.
+type HorizonResultCodes struct {
+	Transaction       string
+	Inner_transaction string
+	Operations        []string
+}
+
+// Extra information horizon includes in some problem reports.
+type HorizonProblemExtras struct {
+	Envelope_xdr  string
+	Result_xdr    string
+	Result_codes  HorizonResultCodes
+	Invalid_field string
+	Reason        string
+	Hash          string
+}
+
+// An error reported by horizon in the "application/problem+json"
+// format of RFC 7807.  Any non-200 response from horizon is turned
+// into a HorizonProblem, even if the body is not valid JSON (in which
+// case Detail contains the raw body).  Use errors.As to extract the
+// problem from errors returned by StellarNet methods.
+type HorizonProblem struct {
+	Type     string
+	Title    string
+	Status   int
+	Detail   string
+	Instance string
+	Extras   HorizonProblemExtras
+}
+
+func (p *HorizonProblem) Error() string {
+	out := strings.Builder{}
+	out.WriteString(p.Title)
+	if p.Detail != "" {
+		fmt.Fprintf(&out, ": %s", p.Detail)
+	}
+	if rc := &p.Extras.Result_codes; rc.Transaction != "" {
+		fmt.Fprintf(&out, " (%s", rc.Transaction)
+		if rc.Inner_transaction != "" {
+			fmt.Fprintf(&out, ", inner %s", rc.Inner_transaction)
+		}
+		if len(rc.Operations) > 0 {
+			fmt.Fprintf(&out, ", operations %s",
+				strings.Join(rc.Operations, " "))
+		}
+		out.WriteString(")")
+	} else if p.Extras.Invalid_field != "" {
+		fmt.Fprintf(&out, " (invalid field %s)", p.Extras.Invalid_field)
+	}
+	return out.String()
+}
+
+// Returns true if the problem indicates horizon is overloaded or
+// unavailable, in which case the request may succeed if retried.
+func (p *HorizonProblem) Temporary() bool {
+	return retryableStatus(p.Status)
+}
+
+// Construct a HorizonProblem from the status and body of a non-200
+// response.
+func newHorizonProblem(resp *http.Response, body []byte) *HorizonProblem {
+	ret := &HorizonProblem{}
+	if json.Unmarshal(body, ret) != nil {
+		ret = &HorizonProblem{
+			Detail: strings.TrimSpace(string(body)),
+		}
+	}
+	if ret.Status == 0 {
+		ret.Status = resp.StatusCode
+	}
+	if ret.Title == "" {
+		ret.Title = resp.Status
+	}
+	return ret
+}
+
+// Read the body of a non-200 response and return a HorizonProblem.
+func readHorizonProblem(resp *http.Response) *HorizonProblem {
+	var body []byte
+	if resp.Body != nil {
+		body, _ = ioutil.ReadAll(resp.Body)
+	}
+	return newHorizonProblem(resp, body)
+}
+
+// Returns ctx, or context.Background() if ctx is nil.
+func ctxOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+func (net *StellarNet) getURL(ctx context.Context, url string) (
+	[]byte, error) {
+	req, err := http.NewRequestWithContext(ctxOrBackground(ctx),
+		"GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := net.do(req, true)
 	if err != nil {
 		return nil, err
 	}
@@ -64,22 +164,35 @@ func getURL(url string) ([]byte, error) {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, horizonFailure(body)
+		return nil, newHorizonProblem(resp, body)
 	}
 	return body, nil
 }
 
 // Send an HTTP request to horizon
 func (net *StellarNet) Get(query string) ([]byte, error) {
-	if net.Horizon == "" {
+	return net.GetCtx(context.Background(), query)
+}
+
+// Like Get, but the request is abandoned if ctx is Done.
+func (net *StellarNet) GetCtx(ctx context.Context, query string) (
+	[]byte, error) {
+	base := net.horizonBase(ctx)
+	if base == "" {
 		return nil, badHorizonURL
 	}
-	return getURL(net.Horizon + query)
+	return net.getURL(ctx, base+query)
 }
 
 // Send an HTTP request to horizon and perse the result as JSON
 func (net *StellarNet) GetJSON(query string, out interface{}) error {
-	if body, err := net.Get(query); err != nil {
+	return net.GetJSONCtx(context.Background(), query, out)
+}
+
+// Like GetJSON, but the request is abandoned if ctx is Done.
+func (net *StellarNet) GetJSONCtx(ctx context.Context, query string,
+	out interface{}) error {
+	if body, err := net.GetCtx(ctx, query); err != nil {
 		return err
 	} else {
 		return json.Unmarshal(body, out)
@@ -108,14 +221,9 @@ func setField(v reflect.Value, field string, val reflect.Value) {
 	}
 }
 
-// Stream a series of events.  cb is a callback function which must
-// have type func(obj *T)error or func(obj *T), where *T is a type
-// into which JSON can be unmarshalled.  Returns if there is an error
-// or the ctx argument is Done.  You likely want to call this in a
-// goroutine, and might want to call it in a loop to try again after
-// errors.
-func (net *StellarNet) StreamJSON(
-	ctx context.Context, query string, cb interface{}) error {
+// Check that cb has type func(*T) or func(*T)error, and return cb
+// as a reflect.Value along with type T.
+func checkCb(cb interface{}) (reflect.Value, reflect.Type) {
 	cbv := reflect.ValueOf(cb)
 	tp := cbv.Type()
 	if tp.Kind() != reflect.Func ||
@@ -124,73 +232,88 @@ func (net *StellarNet) StreamJSON(
 		(tp.NumOut() == 1 && tp.Out(0).String() != "error") {
 		panic(badCb)
 	}
-	tp = tp.In(0).Elem()
-
-	if net.Horizon == "" {
-		return badHorizonURL
-	}
-	query = net.Horizon + query
+	return cbv, tp.In(0).Elem()
+}
 
+// Return a callback that unmarshals raw JSON into a new *T (with any
+// Net field set to net) and passes it to cb, where cb was checked by
+// checkCb.
+func (net *StellarNet) jsonCb(cbv reflect.Value,
+	tp reflect.Type) func(json.RawMessage) error {
 	netval := reflect.ValueOf(net)
-	return stcdetail.Stream(ctx, query, func(evtype string, data []byte) error {
-		switch evtype {
-		case "error":
-			return ErrEventStream(data)
-		case "message":
-			v := reflect.New(tp)
-			setField(v, "Net", netval)
-			if err := json.Unmarshal(data, v.Interface()); err != nil {
+	return func(data json.RawMessage) error {
+		v := reflect.New(tp)
+		setField(v, "Net", netval)
+		if err := json.Unmarshal(data, v.Interface()); err != nil {
+			return err
+		}
+		errs := cbv.Call([]reflect.Value{v})
+		if len(errs) != 0 {
+			if err, ok := errs[0].Interface().(error); ok && err != nil {
 				return err
 			}
-			errs := cbv.Call([]reflect.Value{v})
-			if len(errs) != 0 {
-				if err, ok := errs[0].Interface().(error); ok && err != nil {
-					return err
-				}
-			}
 		}
 		return nil
-	})
-}
-
-type jsonInterface struct {
-	i interface{}
+	}
 }
 
-func (ji *jsonInterface) UnmarshalJSON(data []byte) error {
-	return json.Unmarshal(data, ji.i)
+// Stream the raw JSON of a series of events from horizon.
+func (h HorizonBackend) Stream(ctx context.Context, query string,
+	cb func(json.RawMessage) error) error {
+	net := h.Net
+	base := net.horizonBase(ctx)
+	if base == "" {
+		return badHorizonURL
+	}
+	err := stcdetail.StreamClient(ctx, streamDoer{net}, base+query,
+		func(evtype string, data []byte) error {
+			switch evtype {
+			case "error":
+				return ErrEventStream(data)
+			case "message":
+				return cb(data)
+			}
+			return nil
+		})
+	var he *stcdetail.HTTPerror
+	if errors.As(err, &he) {
+		return newHorizonProblem(he.Resp, he.Body)
+	}
+	return err
 }
 
-// Send a request to horizon and iterate through a series of embedded
-// records in the response, continuing to fetch more records until
-// zero records are returned.  cb is a callback function which must
+// Stream a series of events.  cb is a callback function which must
 // have type func(obj *T)error or func(obj *T), where *T is a type
 // into which JSON can be unmarshalled.  Returns if there is an error
-// or the ctx argument is Done.
-func (net *StellarNet) IterateJSON(
+// or the ctx argument is Done.  You likely want to call this in a
+// goroutine, and might want to call it in a loop to try again after
+// errors.
+func (net *StellarNet) StreamJSON(
 	ctx context.Context, query string, cb interface{}) error {
-	if net.Horizon == "" {
-		return badHorizonURL
-	}
+	cbv, tp := checkCb(cb)
+	return net.streamRaw(ctx, query, net.jsonCb(cbv, tp))
+}
 
-	var resp *http.Response
-	cleanup := func() {
-		if resp != nil && resp.Body != nil {
-			resp.Body.Close()
+// Fetch one page of a collection from horizon.  query may either be
+// relative to the horizon URL or an absolute URL (such as the next
+// link of a previous page).  Returns the raw JSON of the embedded
+// records and the URL of the next page.
+func (h HorizonBackend) GetPage(ctx context.Context, query string) (
+	[]json.RawMessage, string, error) {
+	net := h.Net
+	if u, err := url.Parse(query); err != nil {
+		return nil, "", err
+	} else if !u.IsAbs() {
+		base := net.horizonBase(ctx)
+		if base == "" {
+			return nil, "", badHorizonURL
 		}
+		query = base + query
 	}
-	defer cleanup()
-
-	cbv := reflect.ValueOf(cb)
-	tp := cbv.Type()
-	if tp.Kind() != reflect.Func ||
-		tp.NumIn() != 1 || tp.In(0).Kind() != reflect.Ptr ||
-		tp.NumOut() > 1 ||
-		(tp.NumOut() == 1 && tp.Out(0).String() != "error") {
-		panic(badCb)
+	body, err := net.getURL(ctx, query)
+	if err != nil {
+		return nil, "", err
 	}
-	tp = tp.In(0).Elem()
-
 	var j struct {
 		Links struct {
 			Next struct {
@@ -198,137 +321,179 @@ func (net *StellarNet) IterateJSON(
 			}
 		} `json:"_links"`
 		Embedded struct {
-			Records jsonInterface
+			Records []json.RawMessage
 		} `json:"_embedded"`
 	}
-	j.Embedded.Records.i = reflect.New(reflect.SliceOf(tp)).Interface()
-
-	netval := reflect.ValueOf(net)
+	if err = json.Unmarshal(body, &j); err != nil {
+		return nil, "", err
+	}
+	return j.Embedded.Records, j.Links.Next.Href, nil
+}
 
-	backoff := time.Second
-	for url := net.Horizon + query; ctx == nil || ctx.Err() == nil; url =
-		j.Links.Next.Href {
-		req, err := http.NewRequest("GET", url, nil)
+// Call cb on the raw JSON of each record in a collection, fetching
+// pages until one contains no records.
+func (net *StellarNet) iterateRaw(ctx context.Context, query string,
+	cb func(json.RawMessage) error) error {
+	ctx = ctxOrBackground(ctx)
+	for ctx.Err() == nil {
+		records, next, err := net.getPage(ctx, query)
 		if err != nil {
 			return err
-		} else if ctx != nil {
-			req = req.WithContext(ctx)
-		}
-		cleanup()
-		resp, err = http.DefaultClient.Do(req)
-		if err != nil || ctx != nil && ctx.Err() != nil {
-			return err
-		} else if resp.StatusCode != 200 {
-			if resp.StatusCode != 429 {
-				return stcdetail.NewHTTPerror(resp)
-			}
-			if ctx != nil {
-				select {
-				case <-ctx.Done():
-				case <-time.After(backoff):
-				}
-			} else {
-				time.Sleep(backoff)
-			}
-			backoff *= 2
-			continue
-		}
-		backoff = time.Second
-		dec := json.NewDecoder(resp.Body)
-		if err = dec.Decode(&j); err != nil {
-			return err
-		}
-		v := reflect.ValueOf(j.Embedded.Records.i).Elem()
-		n := v.Len()
-		if n == 0 {
+		} else if len(records) == 0 {
 			break
 		}
-		for i := 0; i < n; i++ {
-			setField(v.Index(i), "Net", netval)
-			errs := cbv.Call([]reflect.Value{v.Index(i).Addr()})
-			if len(errs) != 0 {
-				if err, ok := errs[0].Interface().(error); ok && err != nil {
-					return err
-				}
+		for i := range records {
+			if err = cb(records[i]); err != nil {
+				return err
 			}
 		}
+		query = next
 	}
 	return nil
 }
 
+// Send a request to horizon and iterate through a series of embedded
+// records in the response, continuing to fetch more records until
+// zero records are returned.  cb is a callback function which must
+// have type func(obj *T)error or func(obj *T), where *T is a type
+// into which JSON can be unmarshalled.  Returns if there is an error
+// or the ctx argument is Done.
+func (net *StellarNet) IterateJSON(
+	ctx context.Context, query string, cb interface{}) error {
+	cbv, tp := checkCb(cb)
+	return net.iterateRaw(ctx, query, net.jsonCb(cbv, tp))
+}
+
 type HorizonThresholds struct {
 	Low_threshold  uint8
 	Med_threshold  uint8
 	High_threshold uint8
 }
 type HorizonFlags struct {
-	Auth_required  bool
-	Auth_revocable bool
-	Auth_immutable bool
+	Auth_required         bool
+	Auth_revocable        bool
+	Auth_immutable        bool
+	Auth_clawback_enabled bool
 }
 type HorizonSigner struct {
-	Key    SignerKey
-	Weight uint32
+	Key     SignerKey
+	Weight  uint32
+	Type    string
+	Sponsor *AccountID
 }
 
 type HorizonBalance struct {
-	Balance             stcdetail.JsonInt64e7
-	Buying_liabilities  stcdetail.JsonInt64e7
-	Selling_liabilities stcdetail.JsonInt64e7
-	Limit               stcdetail.JsonInt64e7
-	Asset               stx.Asset `json:"-"`
+	Balance                               stcdetail.JsonInt64e7
+	Buying_liabilities                    stcdetail.JsonInt64e7
+	Selling_liabilities                   stcdetail.JsonInt64e7
+	Limit                                 stcdetail.JsonInt64e7
+	Asset                                 stx.Asset `json:"-"`
+	Is_authorized                         bool
+	Is_authorized_to_maintain_liabilities bool
+	Is_clawback_enabled                   bool
+	Sponsor                               *AccountID
+	Last_modified_ledger                  uint32
 }
 
-func (hb *HorizonBalance) UnmarshalJSON(data []byte) error {
-	type jhb HorizonBalance
-	var jasset struct {
-		Asset_type   string
-		Asset_code   string
-		Asset_issuer AccountID
-	}
-	if err := json.Unmarshal(data, (*jhb)(hb)); err != nil {
-		return err
-	} else if err = json.Unmarshal(data, &jasset); err != nil {
-		return err
-	}
+// An asset as horizon represents it in JSON.
+type horizonAsset struct {
+	Asset_type   string
+	Asset_code   string
+	Asset_issuer AccountID
+}
+
+func (ja *horizonAsset) toAsset(asset *stx.Asset) error {
 	var code []byte
-	switch jasset.Asset_type {
+	switch ja.Asset_type {
 	case "native":
-		hb.Asset.Type = stx.ASSET_TYPE_NATIVE
+		asset.Type = stx.ASSET_TYPE_NATIVE
 		return nil
 	case "credit_alphanum4":
-		hb.Asset.Type = stx.ASSET_TYPE_CREDIT_ALPHANUM4
-		a := hb.Asset.AlphaNum4()
-		a.Issuer = jasset.Asset_issuer
+		asset.Type = stx.ASSET_TYPE_CREDIT_ALPHANUM4
+		a := asset.AlphaNum4()
+		a.Issuer = ja.Asset_issuer
 		code = a.AssetCode[:]
 	case "credit_alphanum12":
-		hb.Asset.Type = stx.ASSET_TYPE_CREDIT_ALPHANUM12
-		a := hb.Asset.AlphaNum12()
-		a.Issuer = jasset.Asset_issuer
+		asset.Type = stx.ASSET_TYPE_CREDIT_ALPHANUM12
+		a := asset.AlphaNum12()
+		a.Issuer = ja.Asset_issuer
 		code = a.AssetCode[:]
 	default:
-		return horizonFailure("unknown asset type " + jasset.Asset_type)
+		return horizonFailure("unknown asset type " + ja.Asset_type)
 	}
 	for i := range code {
 		code[i] = 0
 	}
-	copy(code, jasset.Asset_code)
+	copy(code, ja.Asset_code)
+	return nil
+}
+
+func (hb *HorizonBalance) UnmarshalJSON(data []byte) error {
+	type jhb HorizonBalance
+	var jasset horizonAsset
+	if err := json.Unmarshal(data, (*jhb)(hb)); err != nil {
+		return err
+	} else if err = json.Unmarshal(data, &jasset); err != nil {
+		return err
+	}
+	return jasset.toAsset(&hb.Asset)
+}
+
+// A balance of liquidity pool shares, which horizon reports among
+// the balances of an account with asset type "liquidity_pool_shares".
+type HorizonPoolShare struct {
+	Liquidity_pool_id                     stx.PoolID `json:"-"`
+	Balance                               stcdetail.JsonInt64e7
+	Limit                                 stcdetail.JsonInt64e7
+	Is_authorized                         bool
+	Is_authorized_to_maintain_liabilities bool
+	Is_clawback_enabled                   bool
+	Sponsor                               *AccountID
+	Last_modified_ledger                  uint32
+}
+
+func (ps *HorizonPoolShare) UnmarshalJSON(data []byte) error {
+	type jps HorizonPoolShare
+	var jid struct {
+		Liquidity_pool_id string
+	}
+	if err := json.Unmarshal(data, (*jps)(ps)); err != nil {
+		return err
+	} else if err = json.Unmarshal(data, &jid); err != nil {
+		return err
+	} else if _, err = fmt.Sscanf(jid.Liquidity_pool_id, "%v",
+		stx.XDR_PoolID(&ps.Liquidity_pool_id)); err != nil {
+		return err
+	}
 	return nil
 }
 
 // Structure into which you can unmarshal JSON returned by a query to
-// horizon for an account endpoint
+// horizon for an account endpoint.  The native balance is reported
+// in Balance, Buying_liabilities, and Selling_liabilities rather
+// than in Balances, while liquidity pool shares are reported in
+// Pool_shares.
 type HorizonAccountEntry struct {
 	Net                   *StellarNet `json:"-"`
+	Account_id            AccountID
 	Sequence              stcdetail.JsonInt64
+	Seq_ledger            uint32
+	Seq_time              stcdetail.JsonInt64
 	Balance               stcdetail.JsonInt64e7
+	Buying_liabilities    stcdetail.JsonInt64e7 `json:"-"`
+	Selling_liabilities   stcdetail.JsonInt64e7 `json:"-"`
 	Subentry_count        uint32
+	Num_sponsoring        uint32
+	Num_sponsored         uint32
+	Sponsor               *AccountID
 	Inflation_destination *AccountID
 	Home_domain           string
 	Last_modified_ledger  uint32
+	Last_modified_time    *time.Time
 	Flags                 HorizonFlags
 	Thresholds            HorizonThresholds
 	Balances              []HorizonBalance
+	Pool_shares           []HorizonPoolShare `json:"-"`
 	Signers               []HorizonSigner
 	Data                  map[string]string
 }
@@ -336,6 +501,14 @@ type HorizonAccountEntry struct {
 func (net *StellarNet) prettyPrintAux(i interface{}) (string, bool) {
 	if _, ok := i.(StellarNet); ok {
 		return "", true
+	} else if id, ok := i.(stx.PoolID); ok {
+		return fmt.Sprintf("%x", id[:]), true
+	} else if p, ok := i.(stx.Price); ok {
+		return fmt.Sprintf("%d/%d (%s)", p.N, p.D, priceString(p)), true
+	} else if p, ok := i.(stx.ClaimPredicate); ok {
+		return predicateString(&p), true
+	} else if id, ok := i.(stx.ClaimableBalanceID); ok {
+		return fmt.Sprintf("%x", stcdetail.XdrToBin(&id)), true
 	} else if net == nil {
 		return "", false
 	}
@@ -372,27 +545,277 @@ func (ae *HorizonAccountEntry) NextSeq() stx.SequenceNumber {
 	}
 }
 
+// Return a copy of the account entry that shares no slices, maps, or
+// pointers with the original (other than Net), so that changes to one
+// do not affect the other.
+func (ae *HorizonAccountEntry) Copy() *HorizonAccountEntry {
+	ret := *ae
+	if ae.Sponsor != nil {
+		ret.Sponsor = NewAccountID(*ae.Sponsor)
+	}
+	if ae.Inflation_destination != nil {
+		ret.Inflation_destination = NewAccountID(*ae.Inflation_destination)
+	}
+	if ae.Last_modified_time != nil {
+		t := *ae.Last_modified_time
+		ret.Last_modified_time = &t
+	}
+	if ae.Balances != nil {
+		ret.Balances = make([]HorizonBalance, len(ae.Balances))
+		for i, b := range ae.Balances {
+			if b.Sponsor != nil {
+				b.Sponsor = NewAccountID(*b.Sponsor)
+			}
+			ret.Balances[i] = b
+		}
+	}
+	if ae.Pool_shares != nil {
+		ret.Pool_shares = make([]HorizonPoolShare, len(ae.Pool_shares))
+		for i, ps := range ae.Pool_shares {
+			if ps.Sponsor != nil {
+				ps.Sponsor = NewAccountID(*ps.Sponsor)
+			}
+			ret.Pool_shares[i] = ps
+		}
+	}
+	if ae.Signers != nil {
+		ret.Signers = make([]HorizonSigner, len(ae.Signers))
+		for i, s := range ae.Signers {
+			if s.Sponsor != nil {
+				s.Sponsor = NewAccountID(*s.Sponsor)
+			}
+			ret.Signers[i] = s
+		}
+	}
+	if ae.Data != nil {
+		ret.Data = make(map[string]string, len(ae.Data))
+		for k, v := range ae.Data {
+			ret.Data[k] = v
+		}
+	}
+	return &ret
+}
+
 func (ae *HorizonAccountEntry) UnmarshalJSON(data []byte) error {
 	type hae HorizonAccountEntry
-	if err := json.Unmarshal(data, (*hae)(ae)); err != nil {
+	var j struct {
+		*hae
+		Balances []json.RawMessage
+	}
+	j.hae = (*hae)(ae)
+	if err := json.Unmarshal(data, &j); err != nil {
 		return err
 	}
-	for i := range ae.Balances {
-		if ae.Balances[i].Asset.Type == stx.ASSET_TYPE_NATIVE {
-			ae.Balance = ae.Balances[i].Balance
-			ae.Balances = append(ae.Balances[:i], ae.Balances[i+1:]...)
-			break
+	ae.Balances = ae.Balances[:0]
+	ae.Pool_shares = ae.Pool_shares[:0]
+	for _, raw := range j.Balances {
+		var jtype struct {
+			Asset_type string
+		}
+		if err := json.Unmarshal(raw, &jtype); err != nil {
+			return err
+		} else if jtype.Asset_type == "liquidity_pool_shares" {
+			var ps HorizonPoolShare
+			if err = json.Unmarshal(raw, &ps); err != nil {
+				return err
+			}
+			ae.Pool_shares = append(ae.Pool_shares, ps)
+			continue
+		}
+		var hb HorizonBalance
+		if err := json.Unmarshal(raw, &hb); err != nil {
+			return err
+		} else if hb.Asset.Type == stx.ASSET_TYPE_NATIVE {
+			ae.Balance = hb.Balance
+			ae.Buying_liabilities = hb.Buying_liabilities
+			ae.Selling_liabilities = hb.Selling_liabilities
+			continue
 		}
+		ae.Balances = append(ae.Balances, hb)
 	}
 	return nil
 }
 
+// Set the fields describing an asset in horizon's JSON format.
+func assetJSON(a *stx.Asset, out map[string]interface{}) {
+	switch a.Type {
+	case stx.ASSET_TYPE_NATIVE:
+		out["asset_type"] = "native"
+	case stx.ASSET_TYPE_CREDIT_ALPHANUM4:
+		out["asset_type"] = "credit_alphanum4"
+		out["asset_code"] = strings.TrimRight(
+			string(a.AlphaNum4().AssetCode[:]), "\x00")
+		out["asset_issuer"] = a.AlphaNum4().Issuer.String()
+	case stx.ASSET_TYPE_CREDIT_ALPHANUM12:
+		out["asset_type"] = "credit_alphanum12"
+		out["asset_code"] = strings.TrimRight(
+			string(a.AlphaNum12().AssetCode[:]), "\x00")
+		out["asset_issuer"] = a.AlphaNum12().Issuer.String()
+	}
+}
+
+// Set the fields of a trustline shared by asset and pool share
+// balances in horizon's JSON format.
+func trustlineJSON(out map[string]interface{}, authorized, maintain,
+	clawback bool, sponsor *AccountID, lastModified uint32) {
+	out["is_authorized"] = authorized
+	out["is_authorized_to_maintain_liabilities"] = maintain
+	out["is_clawback_enabled"] = clawback
+	out["last_modified_ledger"] = lastModified
+	if sponsor != nil {
+		out["sponsor"] = sponsor.String()
+	}
+}
+
+// Return horizon's name for the type of a signer key.
+func signerType(k *SignerKey) string {
+	switch k.Type {
+	case stx.SIGNER_KEY_TYPE_ED25519:
+		return "ed25519_public_key"
+	case stx.SIGNER_KEY_TYPE_PRE_AUTH_TX:
+		return "preauth_tx"
+	case stx.SIGNER_KEY_TYPE_HASH_X:
+		return "sha256_hash"
+	case stx.SIGNER_KEY_TYPE_ED25519_SIGNED_PAYLOAD:
+		return "ed25519_signed_payload"
+	}
+	return ""
+}
+
+// Marshal an account entry in horizon's JSON format, so that
+// UnmarshalJSON restores it.
+func (ae *HorizonAccountEntry) MarshalJSON() ([]byte, error) {
+	native := map[string]interface{}{
+		"balance":             ae.Balance,
+		"buying_liabilities":  ae.Buying_liabilities,
+		"selling_liabilities": ae.Selling_liabilities,
+		"asset_type":          "native",
+	}
+	balances := []interface{}{}
+	for i := range ae.Balances {
+		b := &ae.Balances[i]
+		if b.Asset.Type == stx.ASSET_TYPE_NATIVE {
+			native["buying_liabilities"] = b.Buying_liabilities
+			native["selling_liabilities"] = b.Selling_liabilities
+			continue
+		}
+		jb := map[string]interface{}{
+			"balance":             b.Balance,
+			"buying_liabilities":  b.Buying_liabilities,
+			"selling_liabilities": b.Selling_liabilities,
+			"limit":               b.Limit,
+		}
+		assetJSON(&b.Asset, jb)
+		trustlineJSON(jb, b.Is_authorized,
+			b.Is_authorized_to_maintain_liabilities,
+			b.Is_clawback_enabled, b.Sponsor, b.Last_modified_ledger)
+		balances = append(balances, jb)
+	}
+	for i := range ae.Pool_shares {
+		ps := &ae.Pool_shares[i]
+		jb := map[string]interface{}{
+			"balance":           ps.Balance,
+			"limit":             ps.Limit,
+			"asset_type":        "liquidity_pool_shares",
+			"liquidity_pool_id": fmt.Sprintf("%x", ps.Liquidity_pool_id[:]),
+		}
+		trustlineJSON(jb, ps.Is_authorized,
+			ps.Is_authorized_to_maintain_liabilities,
+			ps.Is_clawback_enabled, ps.Sponsor, ps.Last_modified_ledger)
+		balances = append(balances, jb)
+	}
+	balances = append(balances, native)
+
+	signers := []interface{}{}
+	for i := range ae.Signers {
+		s := &ae.Signers[i]
+		js := map[string]interface{}{
+			"key":    s.Key.String(),
+			"weight": s.Weight,
+			"type":   s.Type,
+		}
+		if s.Type == "" {
+			js["type"] = signerType(&s.Key)
+		}
+		if s.Sponsor != nil {
+			js["sponsor"] = s.Sponsor.String()
+		}
+		signers = append(signers, js)
+	}
+	data := ae.Data
+	if data == nil {
+		data = map[string]string{}
+	}
+	acct := ae.Account_id.String()
+	ret := map[string]interface{}{
+		"id":                   acct,
+		"account_id":           acct,
+		"sequence":             ae.Sequence,
+		"seq_ledger":           ae.Seq_ledger,
+		"seq_time":             ae.Seq_time,
+		"subentry_count":       ae.Subentry_count,
+		"num_sponsoring":       ae.Num_sponsoring,
+		"num_sponsored":        ae.Num_sponsored,
+		"home_domain":          ae.Home_domain,
+		"last_modified_ledger": ae.Last_modified_ledger,
+		"thresholds":           ae.Thresholds,
+		"flags":                ae.Flags,
+		"balances":             balances,
+		"signers":              signers,
+		"data":                 data,
+		"paging_token":         acct,
+	}
+	if ae.Last_modified_time != nil {
+		ret["last_modified_time"] = ae.Last_modified_time.UTC().Format(
+			"2006-01-02T15:04:05Z")
+	}
+	if ae.Sponsor != nil {
+		ret["sponsor"] = ae.Sponsor.String()
+	}
+	if ae.Inflation_destination != nil {
+		ret["inflation_destination"] = ae.Inflation_destination.String()
+	}
+	return json.Marshal(ret)
+}
+
 // Fetch the sequence number and signers of an account over the
-// network.
+// network.  If net.AccountCache is non-nil, returns a fresh cached
+// entry if there is one, and otherwise adds the fetched entry to the
+// cache.
 func (net *StellarNet) GetAccountEntry(acct string) (
 	*HorizonAccountEntry, error) {
-	ret := HorizonAccountEntry{Net: net}
-	if err := net.GetJSON("accounts/"+acct, &ret); err != nil {
+	return net.GetAccountEntryCtx(context.Background(), acct)
+}
+
+// Like GetAccountEntry, but the request is abandoned if ctx is Done.
+func (net *StellarNet) GetAccountEntryCtx(ctx context.Context,
+	acct string) (*HorizonAccountEntry, error) {
+	ctx = ctxOrBackground(ctx)
+	if ret := net.AccountCache.Get(acct); ret != nil {
+		ret.Net = net
+		return ret, nil
+	}
+	ret, err := net.backend().GetAccountEntry(ctx, acct)
+	if err != nil {
+		var hp *HorizonProblem
+		if net.AccountCache != nil && net.AccountCache.StaleIfError &&
+			ctx.Err() == nil && !errors.As(err, &hp) {
+			if ret, _ = net.AccountCache.GetStale(acct); ret != nil {
+				ret.Net = net
+				return ret, nil
+			}
+		}
+		return nil, err
+	}
+	ret.Net = net
+	net.AccountCache.Put(ret)
+	return ret, nil
+}
+
+func (h HorizonBackend) GetAccountEntry(ctx context.Context,
+	acct string) (*HorizonAccountEntry, error) {
+	ret := HorizonAccountEntry{Net: h.Net}
+	if err := h.Net.GetJSONCtx(ctx, "accounts/"+acct, &ret); err != nil {
 		return nil, err
 	}
 	return &ret, nil
@@ -402,20 +825,36 @@ func (net *StellarNet) GetAccountEntry(acct string) (
 // IDs to ensure that signature are not valid across networks (e.g., a
 // testnet signature cannot work on the public network).  If the
 // network ID is not cached in the StellarNet structure itself, then
-// this function fetches it from the network.
+// this function fetches it from horizon or, failing that, the RPC
+// server.
 //
 // Note StellarMainNet already contains the network ID, while
 // StellarTestNet requires fetching the network ID since the Stellar
 // test network is periodically reset.
 func (net *StellarNet) GetNetworkId() string {
-	if net.NetworkId == "" {
+	return net.GetNetworkIdCtx(context.Background())
+}
+
+// Like GetNetworkId, but if the network ID must be fetched, the
+// request is abandoned if ctx is Done.
+func (net *StellarNet) GetNetworkIdCtx(ctx context.Context) string {
+	if net.NetworkId == "" && len(net.horizonURLs()) > 0 {
 		var np struct{ Network_passphrase string }
-		if err := net.GetJSON("/", &np); err == nil &&
+		if err := net.GetJSONCtx(ctx, "/", &np); err == nil &&
 			np.Network_passphrase != "" {
 			net.NetworkId = np.Network_passphrase
 			net.Edits.Set("net", "network-id", net.NetworkId)
 		}
 	}
+	if net.NetworkId == "" {
+		if c := net.rpcClient(ctx); c != nil {
+			np, err := c.GetNetwork(ctx)
+			if err == nil && np.Passphrase != "" {
+				net.NetworkId = np.Passphrase
+				net.Edits.Set("net", "network-id", net.NetworkId)
+			}
+		}
+	}
 	return net.NetworkId
 }
 
@@ -558,9 +997,28 @@ func (r *HorizonTxResult) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Fetch the result of a transaction, where txid is the hex-encoded
+// transaction hash.
 func (net *StellarNet) GetTxResult(txid string) (*HorizonTxResult, error) {
-	ret := HorizonTxResult{Net: net}
-	if err := net.GetJSON("transactions/"+txid, &ret); err != nil {
+	return net.GetTxResultCtx(context.Background(), txid)
+}
+
+// Like GetTxResult, but the request is abandoned if ctx is Done.
+func (net *StellarNet) GetTxResultCtx(ctx context.Context, txid string) (
+	*HorizonTxResult, error) {
+	ret, err := net.backend().GetTxResult(ctxOrBackground(ctx), txid)
+	if err != nil {
+		return nil, err
+	}
+	ret.Net = net
+	return ret, nil
+}
+
+func (h HorizonBackend) GetTxResult(ctx context.Context, txid string) (
+	*HorizonTxResult, error) {
+	ret := HorizonTxResult{Net: h.Net}
+	if err := h.Net.GetJSONCtx(ctx, "transactions/"+txid,
+		&ret); err != nil {
 		return nil, err
 	}
 	return &ret, nil
@@ -790,28 +1248,61 @@ func capitalize(s string) string {
 
 // Queries the network for the latest fee statistics.
 func (net *StellarNet) GetFeeStats() (*FeeStats, error) {
-	var ret FeeStats
+	return net.GetFeeStatsCtx(context.Background())
+}
+
+// Like GetFeeStats, but the request is abandoned if ctx is Done.
+func (net *StellarNet) GetFeeStatsCtx(ctx context.Context) (
+	*FeeStats, error) {
 	now := time.Now()
-	if err := net.GetJSON("fee_stats", &ret); err != nil {
+	ret, err := net.backend().GetFeeStats(ctxOrBackground(ctx))
+	if err != nil {
 		return nil, err
 	}
-	net.FeeCache = &ret
+	net.FeeCache = ret
 	net.FeeCacheTime = now
+	return ret, nil
+}
+
+func (h HorizonBackend) GetFeeStats(ctx context.Context) (
+	*FeeStats, error) {
+	var ret FeeStats
+	if err := h.Net.GetJSONCtx(ctx, "fee_stats", &ret); err != nil {
+		return nil, err
+	}
 	return &ret, nil
 }
 
 // Like GetFeeStats but a version cached for 1 minute
 func (net *StellarNet) GetFeeCache() (*FeeStats, error) {
+	return net.GetFeeCacheCtx(context.Background())
+}
+
+// Like GetFeeCache, but if the cache is stale the request is
+// abandoned if ctx is Done.
+func (net *StellarNet) GetFeeCacheCtx(ctx context.Context) (
+	*FeeStats, error) {
 	now := time.Now()
 	if net.FeeCache != nil && now.Sub(net.FeeCacheTime) < 60*time.Second {
 		return net.FeeCache, nil
 	}
-	return net.GetFeeStats()
+	return net.GetFeeStatsCtx(ctx)
 }
 
 // Fetch the latest ledger header over the network.
 func (net *StellarNet) GetLedgerHeader() (*LedgerHeader, error) {
-	body, err := net.Get("ledgers?limit=1&order=desc")
+	return net.GetLedgerHeaderCtx(context.Background())
+}
+
+// Like GetLedgerHeader, but the request is abandoned if ctx is Done.
+func (net *StellarNet) GetLedgerHeaderCtx(ctx context.Context) (
+	*LedgerHeader, error) {
+	return net.backend().GetLedgerHeader(ctxOrBackground(ctx))
+}
+
+func (h HorizonBackend) GetLedgerHeader(ctx context.Context) (
+	*LedgerHeader, error) {
+	body, err := h.Net.GetCtx(ctx, "ledgers?limit=1&order=desc")
 	if err != nil {
 		return nil, err
 	}
@@ -857,29 +1348,34 @@ type TxFailure struct {
 }
 
 type codeExtractor struct {
-	msg string
+	code xdr.XdrEnum
 }
 
 func (x *codeExtractor) Sprintf(string, ...interface{}) string {
 	return ""
 }
 func (x *codeExtractor) Marshal(name string, val xdr.XdrType) {
-	if x.msg != "" {
+	if x.code != nil {
 		return
 	}
 	switch t := val.(type) {
 	case xdr.XdrEnum:
-		x.msg = enumDesc(t)
+		x.code = t
 	case xdr.XdrAggregate:
 		t.XdrRecurse(x, "")
 	}
 }
 
-func extractCode(t xdr.XdrType) string {
+// Return the first enum (such as a result code) in t, or nil.
+func resultCode(t xdr.XdrType) xdr.XdrEnum {
 	e := codeExtractor{}
 	e.Marshal("", t)
-	if e.msg != "" {
-		return e.msg
+	return e.code
+}
+
+func extractCode(t xdr.XdrType) string {
+	if code := resultCode(t); code != nil {
+		return enumDesc(code)
 	}
 
 	out := strings.Builder{}
@@ -911,36 +1407,93 @@ func (e TxFailure) Error() string {
 // Post a new transaction to the network.  In the event that the
 // transaction is successfully submitted to horizon but rejected by
 // the Stellar network, the error will be of type TxFailure, which
-// contains the transaction result.
+// contains the transaction result.  Other errors reported by horizon
+// (such as a malformed transaction) are of type *HorizonProblem.
 func (net *StellarNet) Post(e *TransactionEnvelope) (
 	*TransactionResult, error) {
-	if net.Horizon == "" {
+	return net.PostCtx(context.Background(), e)
+}
+
+// Like Post, but the request is abandoned if ctx is Done.  Note that
+// abandoning the request does not mean the transaction will not
+// execute, since it may already have been submitted to the network.
+//
+// If net.Resubmit is non-nil and the transaction fails with txBAD_SEQ
+// or txINSUFFICIENT_FEE, PostCtx updates the sequence number or fee
+// of e in place, re-signs it, and resubmits it, as allowed by the
+// policy.  Hence, when PostCtx returns, e is the transaction last
+// submitted.
+func (net *StellarNet) PostCtx(ctx context.Context,
+	e *TransactionEnvelope) (*TransactionResult, error) {
+	ctx = ctxOrBackground(ctx)
+	for i := 0; ; i++ {
+		ret, err := net.backend().Post(ctx, e)
+		var txf TxFailure
+		if err == nil || errors.As(err, &txf) {
+			// Even failed transactions consume fees and sequence numbers
+			net.AccountCache.InvalidateTx(e)
+		}
+		rp := net.Resubmit
+		if txf.TransactionResult == nil || rp == nil ||
+			i >= rp.MaxResubmits {
+			return ret, err
+		} else if txf.Result.Code == stx.TxBAD_SEQ {
+			// Don't resubmit a transaction that has already executed
+			txid := fmt.Sprintf("%x", *net.HashTx(e))
+			if res, err2 := net.lookupTx(ctx, txid); res != nil {
+				return &res.Result, err2
+			}
+		}
+		if !rp.fix(ctx, net, e, txf) {
+			return ret, err
+		}
+	}
+}
+
+func (h HorizonBackend) Post(ctx context.Context,
+	e *TransactionEnvelope) (*TransactionResult, error) {
+	net := h.Net
+	base := net.horizonBase(ctx)
+	if base == "" {
 		return nil, badHorizonURL
 	}
 	tx := stcdetail.XdrToBase64(e)
-	resp, err := http.PostForm(net.Horizon+"transactions/",
-		url.Values{"tx": {tx}})
+	req, err := http.NewRequestWithContext(ctxOrBackground(ctx), "POST",
+		base+"transactions/",
+		strings.NewReader(url.Values{"tx": {tx}}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := net.do(req, true)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	js := json.NewDecoder(resp.Body)
-	var res struct {
-		Result_xdr string
-		Extras     struct {
-			Result_xdr string
+	var resultXdr string
+	if resp.StatusCode == 200 {
+		var res struct {
+			Result_xdr      string
+			Result_meta_xdr string
 		}
-	}
-	if err = js.Decode(&res); err != nil {
-		return nil, err
-	}
-	if res.Result_xdr == "" {
-		res.Result_xdr = res.Extras.Result_xdr
+		if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return nil, err
+		}
+		resultXdr = res.Result_xdr
+		var meta stx.TransactionMeta
+		if net.AccountCache != nil && stcdetail.XdrFromBase64(&meta,
+			res.Result_meta_xdr) == nil {
+			net.AccountCache.InvalidateMetas(&meta)
+		}
+	} else if p := readHorizonProblem(resp); p.Extras.Result_xdr == "" {
+		return nil, p
+	} else {
+		resultXdr = p.Extras.Result_xdr
 	}
 
 	var ret TransactionResult
-	if err = stcdetail.XdrFromBase64(&ret, res.Result_xdr); err != nil {
+	if err = stcdetail.XdrFromBase64(&ret, resultXdr); err != nil {
 		return nil, err
 	}
 	if ret.Result.Code != stx.TxSUCCESS {
@@ -0,0 +1,273 @@
+package stc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Options controlling which records of a horizon collection are
+// returned by Pager, Iterate, Stream, and StreamForever.  The zero
+// value requests horizon's defaults.
+type PageOptions struct {
+	// Start after the record with this paging token.  For Stream,
+	// the empty string means "now" (i.e., only new records).
+	Cursor string
+
+	// Either "asc" or "desc".  Ignored by Stream.
+	Order string
+
+	// Number of records to request per page (horizon allows at most
+	// 200).  Ignored by Stream.
+	PageSize int
+
+	// If non-zero, stop after returning this many records.
+	Max int
+}
+
+// Add the options to the query parameters of a horizon query.
+func (opts *PageOptions) apply(query string, stream bool) string {
+	if opts == nil {
+		return query
+	}
+	u, err := url.Parse(query)
+	if err != nil {
+		// Let the request itself fail
+		return query
+	}
+	q := u.Query()
+	if opts.Cursor != "" {
+		q.Set("cursor", opts.Cursor)
+	}
+	if !stream {
+		if opts.Order != "" {
+			q.Set("order", opts.Order)
+		}
+		if opts.PageSize > 0 {
+			q.Set("limit", strconv.Itoa(opts.PageSize))
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Decode a record of type T, setting its Net field (if any) to net,
+// and extract its paging token.
+func decodeRecord[T any](net *StellarNet, data json.RawMessage) (
+	*T, string, error) {
+	ret := new(T)
+	setField(reflect.ValueOf(ret), "Net", reflect.ValueOf(net))
+	if err := json.Unmarshal(data, ret); err != nil {
+		return nil, "", err
+	}
+	var pt struct {
+		Paging_token string
+	}
+	json.Unmarshal(data, &pt)
+	return ret, pt.Paging_token, nil
+}
+
+// A Pager fetches the records of a horizon collection one page at a
+// time, decoding each one into a value of type T.  It is a type-safe
+// alternative to StellarNet.IterateJSON.  Use it like a
+// bufio.Scanner:
+//
+//	p := NewPager[HorizonTxResult](net, "accounts/"+acct+"/transactions",
+//		&PageOptions{Order: "desc"})
+//	for p.Next(ctx) {
+//		fmt.Println(p.PagingToken(), p.Value().Txhash)
+//	}
+//	if err := p.Err(); err != nil {
+//		...
+//	}
+//
+// If T contains a field Net of type *StellarNet, it is set to the
+// network from which the record was fetched.
+type Pager[T any] struct {
+	net   *StellarNet
+	next  string
+	max   int
+	count int
+	buf   []json.RawMessage
+	done  bool
+	err   error
+	val   *T
+	token string
+}
+
+// Create a Pager for a horizon query such as
+// "accounts/ACCOUNT/transactions".  opts may be nil.
+func NewPager[T any](net *StellarNet, query string,
+	opts *PageOptions) *Pager[T] {
+	ret := &Pager[T]{
+		net:  net,
+		next: opts.apply(query, false),
+	}
+	if opts != nil {
+		ret.max = opts.Max
+	}
+	return ret
+}
+
+// Advance to the next record, fetching another page from horizon if
+// necessary.  Returns false when there are no more records, the
+// maximum number of records has been returned, ctx is done, or there
+// is an error (which can be retrieved with Err).
+func (p *Pager[T]) Next(ctx context.Context) bool {
+	ctx = ctxOrBackground(ctx)
+	p.val, p.token = nil, ""
+	if p.err != nil || (p.max > 0 && p.count >= p.max) {
+		return false
+	}
+	for len(p.buf) == 0 {
+		if p.done {
+			return false
+		} else if p.err = ctx.Err(); p.err != nil {
+			return false
+		}
+		p.buf, p.next, p.err = p.net.getPage(ctx, p.next)
+		if p.err != nil {
+			return false
+		} else if len(p.buf) == 0 || p.next == "" {
+			p.done = true
+		}
+	}
+	p.val, p.token, p.err = decodeRecord[T](p.net, p.buf[0])
+	if p.err != nil {
+		return false
+	}
+	p.buf = p.buf[1:]
+	p.count++
+	return true
+}
+
+// The current record (or nil if Next has not been called or returned
+// false).
+func (p *Pager[T]) Value() *T {
+	return p.val
+}
+
+// The paging token of the current record.  To resume iteration
+// later, pass this value as the Cursor field of PageOptions.
+func (p *Pager[T]) PagingToken() string {
+	return p.token
+}
+
+// Returns the error, if any, that caused Next to return false.
+func (p *Pager[T]) Err() error {
+	return p.err
+}
+
+// Iterate through the records of a horizon collection, calling cb on
+// each record and its paging token.  Returns when there are no more
+// records, when ctx is done, or when cb returns a non-nil error.
+// This is a type-safe version of StellarNet.IterateJSON.
+func Iterate[T any](ctx context.Context, net *StellarNet, query string,
+	opts *PageOptions, cb func(rec *T, pagingToken string) error) error {
+	p := NewPager[T](net, query, opts)
+	for p.Next(ctx) {
+		if err := cb(p.Value(), p.PagingToken()); err != nil {
+			return err
+		}
+	}
+	return p.Err()
+}
+
+var errStreamDone = errors.New("stream reached maximum record count")
+
+// Stream new records from a horizon endpoint as they are created,
+// calling cb on each record and its paging token.  Returns when ctx
+// is done, when cb returns a non-nil error, or when there is an
+// error (after which you may wish to call Stream again with the
+// paging token of the last record received as the Cursor).  This is
+// a type-safe version of StellarNet.StreamJSON.
+func Stream[T any](ctx context.Context, net *StellarNet, query string,
+	opts *PageOptions, cb func(rec *T, pagingToken string) error) error {
+	max, count := 0, 0
+	if opts != nil {
+		max = opts.Max
+	}
+	err := net.streamRaw(ctx, opts.apply(query, true),
+		func(data json.RawMessage) error {
+			rec, token, err := decodeRecord[T](net, data)
+			if err != nil {
+				return err
+			} else if err = cb(rec, token); err != nil {
+				return err
+			} else if count++; max > 0 && count >= max {
+				return errStreamDone
+			}
+			return nil
+		})
+	if err == errStreamDone {
+		return nil
+	}
+	return err
+}
+
+// Like Stream, but instead of returning after an error, reconnects
+// with exponential backoff as specified by net.Retry (ignoring its
+// MaxRetries) and resumes after the last record received, so that no
+// records are missed or repeated.  Receiving a record resets the
+// backoff.  If onError is not nil, it is called with each error and
+// the delay before reconnecting.  Returns when ctx is done, when cb
+// returns a non-nil error, when opts.Max records have been received,
+// or when horizon reports an error that retrying would not fix (a 4xx
+// status other than 429).
+func StreamForever[T any](ctx context.Context, net *StellarNet,
+	query string, opts *PageOptions,
+	cb func(rec *T, pagingToken string) error,
+	onError func(err error, delay time.Duration)) error {
+	ctx = ctxOrBackground(ctx)
+	o := PageOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	max, count := o.Max, 0
+	o.Max = 0
+	retry := net.retryPolicy()
+	backoff := retry.MinBackoff
+	var cbErr error
+	for {
+		err := Stream(ctx, net, query, &o,
+			func(rec *T, token string) error {
+				backoff = retry.MinBackoff
+				o.Cursor = token
+				if cbErr = cb(rec, token); cbErr != nil {
+					return cbErr
+				} else if count++; max > 0 && count >= max {
+					return errStreamDone
+				}
+				return nil
+			})
+		// Stream turns errStreamDone into nil, so check the count
+		var hp *HorizonProblem
+		if max > 0 && count >= max {
+			return nil
+		} else if cbErr != nil {
+			return cbErr
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		} else if errors.As(err, &hp) && hp.Status >= 400 &&
+			hp.Status < 500 && hp.Status != http.StatusTooManyRequests {
+			return err
+		} else if err == nil {
+			err = ErrEventStream("stream closed")
+		}
+		if onError != nil {
+			onError(err, backoff)
+		}
+		if err = sleepCtx(ctx, backoff); err != nil {
+			return err
+		}
+		if backoff *= 2; retry.MaxBackoff > 0 &&
+			backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+	}
+}
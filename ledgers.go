@@ -0,0 +1,121 @@
+package stc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/xdrpp/stc/stcdetail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A ledger, as returned by horizon's ledgers endpoints.  Header is
+// decoded from the ledger's header_xdr.  Iterate over ledgers with
+// IterateLedgers, or stream them as they close with Stream and the
+// query "ledgers".
+type HorizonLedger struct {
+	Net                          *StellarNet `json:"-"`
+	Paging_token                 string
+	Sequence                     uint32
+	Closed_at                    time.Time
+	Successful_transaction_count uint32
+	Failed_transaction_count     uint32
+	Operation_count              uint32
+	Tx_set_operation_count       uint32
+	Header                       LedgerHeader `json:"-"`
+}
+
+func (l *HorizonLedger) UnmarshalJSON(data []byte) error {
+	type jhl HorizonLedger
+	var j struct {
+		*jhl
+		Header_xdr string
+	}
+	j.jhl = (*jhl)(l)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	return stcdetail.XdrFromBase64(&l.Header, j.Header_xdr)
+}
+
+func (l *HorizonLedger) String() string {
+	out := strings.Builder{}
+	closeTime := time.Unix(int64(l.Header.ScpValue.CloseTime), 0)
+	fmt.Fprintf(&out, "ledger: %d\n", l.Header.LedgerSeq)
+	fmt.Fprintf(&out, "close_time: %d (%s)\n", closeTime.Unix(),
+		closeTime.Format(time.UnixDate))
+	fmt.Fprintf(&out, "protocol_version: %d\n", l.Header.LedgerVersion)
+	fmt.Fprintf(&out, "base_fee: %d\n", l.Header.BaseFee)
+	fmt.Fprintf(&out, "base_reserve: %s\n",
+		stcdetail.JsonInt64e7(l.Header.BaseReserve))
+	fmt.Fprintf(&out, "max_tx_set_size: %d\n", l.Header.MaxTxSetSize)
+	fmt.Fprintf(&out, "transactions: %d (%d failed)\n",
+		l.Successful_transaction_count+l.Failed_transaction_count,
+		l.Failed_transaction_count)
+	fmt.Fprintf(&out, "operations: %d\n", l.Tx_set_operation_count)
+	return out.String()
+}
+
+// Return the paging token of the ledger before seq, so as to start
+// iterating ledgers at seq.
+func ledgerCursor(seq uint32) string {
+	if seq == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(seq-1)<<32, 10)
+}
+
+// Iterate over ledgers first through last (inclusive), in order,
+// calling cb on each.  If last is 0, continues through the most
+// recent ledger.  Returns when there are no more ledgers in the
+// range, when ctx is done, or when cb returns a non-nil error.
+func (net *StellarNet) IterateLedgers(ctx context.Context,
+	first, last uint32, cb func(*HorizonLedger) error) error {
+	err := Iterate(ctx, net, "ledgers", &PageOptions{
+		Cursor:   ledgerCursor(first),
+		Order:    "asc",
+		PageSize: 200,
+	}, func(l *HorizonLedger, _ string) error {
+		if last != 0 && l.Sequence > last {
+			return errLedgersDone
+		}
+		return cb(l)
+	})
+	if err == errLedgersDone {
+		return nil
+	}
+	return err
+}
+
+var errLedgersDone = horizonFailure("end of ledger range")
+
+// Fetch a particular ledger by sequence number.  If horizon does not
+// have the ledger, returns a *HorizonProblem with Status 404.
+func (net *StellarNet) GetLedgerBySeq(ctx context.Context,
+	seq uint32) (*HorizonLedger, error) {
+	var ret HorizonLedger
+	if err := net.GetJSONCtx(ctx, fmt.Sprintf("ledgers/%d", seq),
+		&ret); err != nil {
+		return nil, err
+	}
+	ret.Net = net
+	return &ret, nil
+}
+
+// Fetch the header of a particular ledger by sequence number.
+func (net *StellarNet) GetLedgerHeaderBySeq(seq uint32) (
+	*LedgerHeader, error) {
+	return net.GetLedgerHeaderBySeqCtx(context.Background(), seq)
+}
+
+// Like GetLedgerHeaderBySeq, but the request is abandoned if ctx is
+// Done.
+func (net *StellarNet) GetLedgerHeaderBySeqCtx(ctx context.Context,
+	seq uint32) (*LedgerHeader, error) {
+	l, err := net.GetLedgerBySeq(ctx, seq)
+	if err != nil {
+		return nil, err
+	}
+	return &l.Header, nil
+}
@@ -0,0 +1,210 @@
+package stc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Return the horizon resource whose history is of, which can be an
+// account (in strkey format), a ledger (a decimal sequence number),
+// or a transaction (a hex hash).
+func historyResource(of string) string {
+	if _, err := strconv.ParseUint(of, 10, 32); err == nil {
+		return "ledgers/" + of
+	} else if _, err = hex.DecodeString(of); err == nil && len(of) == 64 {
+		return "transactions/" + strings.ToLower(of)
+	}
+	return "accounts/" + of
+}
+
+// Render an account, with its annotation if it has one.
+func (net *StellarNet) accountString(acct *AccountID) string {
+	if s, ok := net.prettyPrintAux(*acct); ok {
+		return s
+	}
+	return acct.String()
+}
+
+// Return a horizon query for the operations of an account (in strkey
+// format), a ledger (a decimal sequence number), or a transaction (a
+// hex hash), suitable for Iterate, Pager, or Stream.  The query asks
+// horizon to include each operation's transaction, so that
+// HorizonOperation can decode the operation itself.
+func OperationsQuery(of string) string {
+	return historyResource(of) + "/operations?join=transactions"
+}
+
+// Return a horizon query for the payments (operations that send or
+// receive funds, such as PAYMENT, CREATE_ACCOUNT, and ACCOUNT_MERGE)
+// of an account, a ledger, or a transaction, specified as for
+// OperationsQuery.
+func PaymentsQuery(of string) string {
+	return historyResource(of) + "/payments?join=transactions"
+}
+
+// Return a horizon query for the effects of an account, a ledger, or
+// a transaction, specified as for OperationsQuery.
+func EffectsQuery(of string) string {
+	return historyResource(of) + "/effects"
+}
+
+// An operation, as returned by horizon's operations endpoints.
+// Operation is decoded from the envelope of the operation's
+// transaction, which horizon only includes when the query contains
+// join=transactions (as do queries returned by OperationsQuery).
+// Otherwise, only Operation.Body.Type is set.  Source_account is the
+// operation's effective source account, which may come from the
+// transaction rather than the operation.
+type HorizonOperation struct {
+	Net                    *StellarNet `json:"-"`
+	Id                     string
+	Paging_token           string
+	Transaction_successful bool
+	Source_account         AccountID
+	Type                   string
+	Created_at             time.Time
+	Transaction_hash       string
+	Operation              stx.Operation `json:"-"`
+}
+
+func (op *HorizonOperation) UnmarshalJSON(data []byte) error {
+	type jho HorizonOperation
+	var j struct {
+		*jho
+		Type_i      int32
+		Transaction *struct {
+			Envelope_xdr string
+		}
+	}
+	j.jho = (*jho)(op)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	op.Operation = stx.Operation{}
+	op.Operation.Body.Type = stx.OperationType(j.Type_i)
+	if j.Transaction == nil {
+		return nil
+	}
+	var e stx.TransactionEnvelope
+	if err := stcdetail.XdrFromBase64(&e,
+		j.Transaction.Envelope_xdr); err != nil {
+		return err
+	}
+	// The low 12 bits of an operation ID are its 1-based index in
+	// the transaction
+	id, err := strconv.ParseUint(op.Id, 10, 64)
+	if err != nil {
+		return err
+	}
+	ops, i := innerEnvelope(&e).Operations(), int(id&0xfff)-1
+	if ops == nil || i < 0 || i >= len(*ops) {
+		return horizonFailure(fmt.Sprintf(
+			"operation %s not found in transaction %s", op.Id,
+			op.Transaction_hash))
+	}
+	op.Operation = (*ops)[i]
+	return nil
+}
+
+func (op *HorizonOperation) String() string {
+	out := strings.Builder{}
+	fmt.Fprintf(&out, "id: %s\ntransaction_hash: %s\n", op.Id,
+		op.Transaction_hash)
+	fmt.Fprintf(&out, "created_at: %d (%s)\ntransaction_successful: %v\n",
+		op.Created_at.Unix(), op.Created_at.Format(time.UnixDate),
+		op.Transaction_successful)
+	fmt.Fprintf(&out, "source_account: %s\n",
+		op.Net.accountString(&op.Source_account))
+	op.Net.WriteRep(&out, "operation", &op.Operation)
+	fmt.Fprintf(&out, "paging_token: %s\n", op.Paging_token)
+	return out.String()
+}
+
+// An effect, as returned by horizon's effects endpoints.  Amount and
+// Asset are set for effects that report them (such as
+// account_credited and account_debited), while Asset is nil for
+// other effects.  The remaining type-specific fields are stored in
+// Details as JSON text, except that strings are unquoted.
+type HorizonEffect struct {
+	Net          *StellarNet `json:"-"`
+	Id           string
+	Paging_token string
+	Account      AccountID
+	Type         string
+	Type_i       int32
+	Created_at   time.Time
+	Amount       stcdetail.JsonInt64e7
+	Asset        *stx.Asset        `json:"-"`
+	Details      map[string]string `json:"-"`
+}
+
+func (ef *HorizonEffect) UnmarshalJSON(data []byte) error {
+	type jhe HorizonEffect
+	var jasset horizonAsset
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, (*jhe)(ef)); err != nil {
+		return err
+	} else if err = json.Unmarshal(data, &fields); err != nil {
+		return err
+	} else if err = json.Unmarshal(data, &jasset); err != nil {
+		return err
+	}
+	ef.Asset = nil
+	if jasset.Asset_type != "" {
+		var asset stx.Asset
+		// Assets horizon does not represent this way (e.g., pool
+		// shares) are left in Details
+		if jasset.toAsset(&asset) == nil {
+			ef.Asset = &asset
+			delete(fields, "asset_type")
+			delete(fields, "asset_code")
+			delete(fields, "asset_issuer")
+		}
+	}
+	ef.Details = make(map[string]string)
+	for k, v := range fields {
+		switch k {
+		case "_links", "id", "paging_token", "account", "type", "type_i",
+			"created_at", "amount":
+			continue
+		}
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			ef.Details[k] = s
+		} else {
+			ef.Details[k] = string(v)
+		}
+	}
+	return nil
+}
+
+func (ef *HorizonEffect) String() string {
+	out := strings.Builder{}
+	fmt.Fprintf(&out, "id: %s\ntype: %s\n", ef.Id, ef.Type)
+	fmt.Fprintf(&out, "created_at: %d (%s)\n", ef.Created_at.Unix(),
+		ef.Created_at.Format(time.UnixDate))
+	fmt.Fprintf(&out, "account: %s\n", ef.Net.accountString(&ef.Account))
+	if ef.Asset != nil || ef.Amount != 0 {
+		fmt.Fprintf(&out, "amount: %s\n", ef.Amount)
+	}
+	if ef.Asset != nil {
+		fmt.Fprintf(&out, "asset: %s\n", ef.Asset)
+	}
+	keys := make([]string, 0, len(ef.Details))
+	for k := range ef.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&out, "%s: %s\n", k, ef.Details[k])
+	}
+	fmt.Fprintf(&out, "paging_token: %s\n", ef.Paging_token)
+	return out.String()
+}
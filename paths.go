@@ -0,0 +1,222 @@
+package stc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+	"math"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+// A payment path found by horizon's strict-send or strict-receive
+// path finding endpoints.  Path lists the intermediary assets
+// between Source_asset and Destination_asset.
+type HorizonPath struct {
+	Source_asset       stx.Asset `json:"-"`
+	Source_amount      stcdetail.JsonInt64e7
+	Destination_asset  stx.Asset `json:"-"`
+	Destination_amount stcdetail.JsonInt64e7
+	Path               []stx.Asset `json:"-"`
+}
+
+func (p *HorizonPath) UnmarshalJSON(data []byte) error {
+	type jhp HorizonPath
+	var j struct {
+		*jhp
+		Source_asset_type        string
+		Source_asset_code        string
+		Source_asset_issuer      AccountID
+		Destination_asset_type   string
+		Destination_asset_code   string
+		Destination_asset_issuer AccountID
+		Path                     []horizonAsset
+	}
+	j.jhp = (*jhp)(p)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	src := horizonAsset{
+		Asset_type:   j.Source_asset_type,
+		Asset_code:   j.Source_asset_code,
+		Asset_issuer: j.Source_asset_issuer,
+	}
+	dst := horizonAsset{
+		Asset_type:   j.Destination_asset_type,
+		Asset_code:   j.Destination_asset_code,
+		Asset_issuer: j.Destination_asset_issuer,
+	}
+	if err := src.toAsset(&p.Source_asset); err != nil {
+		return err
+	} else if err = dst.toAsset(&p.Destination_asset); err != nil {
+		return err
+	}
+	p.Path = make([]stx.Asset, len(j.Path))
+	for i := range j.Path {
+		if err := j.Path[i].toAsset(&p.Path[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *HorizonPath) String() string {
+	return stcdetail.PrettyPrint(p)
+}
+
+// Returned when horizon finds no path for a path payment.
+var ErrNoPath error = horizonFailure("No payment path found")
+
+func assetList(assets []stx.Asset) string {
+	ret := make([]string, len(assets))
+	for i := range assets {
+		ret[i] = assets[i].String()
+	}
+	return strings.Join(ret, ",")
+}
+
+// Format an amount in stroops as a decimal string for horizon.
+func horizonAmount(amount int64) string {
+	text, _ := stcdetail.JsonInt64e7(amount).MarshalText()
+	return string(text)
+}
+
+func (net *StellarNet) getPaths(ctx context.Context, query string) (
+	[]HorizonPath, error) {
+	records, _, err := net.getPage(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]HorizonPath, len(records))
+	for i := range records {
+		if err = json.Unmarshal(records[i], &ret[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Find paths for sending exactly sendAmount of sendAsset that result
+// in the receipt of any of destAssets.
+func (net *StellarNet) StrictSendPaths(ctx context.Context,
+	sendAsset *stx.Asset, sendAmount int64, destAssets ...stx.Asset) (
+	[]HorizonPath, error) {
+	v := url.Values{}
+	assetParams(v, "source_", sendAsset)
+	v.Set("source_amount", horizonAmount(sendAmount))
+	v.Set("destination_assets", assetList(destAssets))
+	return net.getPaths(ctx, "paths/strict-send?"+v.Encode())
+}
+
+// Find paths for receiving exactly destAmount of destAsset by sending
+// any of sourceAssets.
+func (net *StellarNet) StrictReceivePaths(ctx context.Context,
+	destAsset *stx.Asset, destAmount int64, sourceAssets ...stx.Asset) (
+	[]HorizonPath, error) {
+	v := url.Values{}
+	assetParams(v, "destination_", destAsset)
+	v.Set("destination_amount", horizonAmount(destAmount))
+	v.Set("source_assets", assetList(sourceAssets))
+	return net.getPaths(ctx, "paths/strict-receive?"+v.Encode())
+}
+
+// Scale amount by (10000 + bp)/10000, rounding away from amount (so
+// as to err on the side of tolerating more slippage) and clamping the
+// result to the range 0 to MaxInt64.
+func applySlippage(amount int64, bp int64) int64 {
+	r := new(big.Int).Mul(big.NewInt(amount), big.NewInt(10000+bp))
+	m := new(big.Int)
+	r.DivMod(r, big.NewInt(10000), m)
+	if bp > 0 && m.Sign() != 0 {
+		r.Add(r, big.NewInt(1))
+	}
+	if !r.IsInt64() {
+		return math.MaxInt64
+	} else if r.Sign() < 0 {
+		return 0
+	}
+	return r.Int64()
+}
+
+// Find the path that delivers the most destAsset in exchange for
+// exactly sendAmount of sendAsset, and return a PathPaymentStrictSend
+// operation body (suitable for TransactionEnvelope.Append) using
+// that path.  The operation's DestMin is the amount horizon expects
+// the path to deliver, reduced by slippageBP basis points (hundredths
+// of a percent) to tolerate price movement before the transaction
+// executes.  Returns ErrNoPath if horizon finds no paths.
+func (net *StellarNet) FindPathPaymentStrictSend(ctx context.Context,
+	sendAsset *stx.Asset, sendAmount int64, dest *stx.MuxedAccount,
+	destAsset *stx.Asset, slippageBP uint32) (
+	*PathPaymentStrictSend, error) {
+	paths, err := net.StrictSendPaths(ctx, sendAsset, sendAmount,
+		*destAsset)
+	if err != nil {
+		return nil, err
+	}
+	var best *HorizonPath
+	for i := range paths {
+		if stcdetail.XdrToBin(&paths[i].Destination_asset) !=
+			stcdetail.XdrToBin(destAsset) {
+			continue
+		}
+		if best == nil || paths[i].Destination_amount >
+			best.Destination_amount {
+			best = &paths[i]
+		}
+	}
+	if best == nil {
+		return nil, ErrNoPath
+	}
+	return &PathPaymentStrictSend{
+		SendAsset:   *sendAsset,
+		SendAmount:  sendAmount,
+		Destination: *dest,
+		DestAsset:   *destAsset,
+		DestMin: applySlippage(int64(best.Destination_amount),
+			-int64(slippageBP)),
+		Path: best.Path,
+	}, nil
+}
+
+// Find the path that delivers exactly destAmount of destAsset for
+// the least sendAsset, and return a PathPaymentStrictReceive
+// operation body (suitable for TransactionEnvelope.Append) using
+// that path.  The operation's SendMax is the amount horizon expects
+// the path to cost, increased by slippageBP basis points (hundredths
+// of a percent) to tolerate price movement before the transaction
+// executes.  Returns ErrNoPath if horizon finds no paths.
+func (net *StellarNet) FindPathPaymentStrictReceive(ctx context.Context,
+	sendAsset *stx.Asset, dest *stx.MuxedAccount, destAsset *stx.Asset,
+	destAmount int64, slippageBP uint32) (
+	*PathPaymentStrictReceive, error) {
+	paths, err := net.StrictReceivePaths(ctx, destAsset, destAmount,
+		*sendAsset)
+	if err != nil {
+		return nil, err
+	}
+	var best *HorizonPath
+	for i := range paths {
+		if stcdetail.XdrToBin(&paths[i].Source_asset) !=
+			stcdetail.XdrToBin(sendAsset) {
+			continue
+		}
+		if best == nil || paths[i].Source_amount < best.Source_amount {
+			best = &paths[i]
+		}
+	}
+	if best == nil {
+		return nil, ErrNoPath
+	}
+	return &PathPaymentStrictReceive{
+		SendAsset: *sendAsset,
+		SendMax: applySlippage(int64(best.Source_amount),
+			int64(slippageBP)),
+		Destination: *dest,
+		DestAsset:   *destAsset,
+		DestAmount:  destAmount,
+		Path:        best.Path,
+	}, nil
+}
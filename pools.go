@@ -0,0 +1,239 @@
+package stc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+	"math"
+	"math/big"
+	"net/url"
+	"time"
+)
+
+// Return the parameters of the constant-product liquidity pool for a
+// pair of assets with a particular fee in basis points (normally
+// stx.LIQUIDITY_POOL_FEE_V18).  The assets may be given in either
+// order, as they are sorted into the order the network requires.
+func LiquidityPoolParameters(a, b *stx.Asset,
+	fee int32) stx.LiquidityPoolParameters {
+	if stcdetail.XdrToBin(a) > stcdetail.XdrToBin(b) {
+		a, b = b, a
+	}
+	ret := stx.LiquidityPoolParameters{
+		Type: stx.LIQUIDITY_POOL_CONSTANT_PRODUCT,
+	}
+	cp := ret.ConstantProduct()
+	cp.AssetA, cp.AssetB, cp.Fee = *a, *b, fee
+	return ret
+}
+
+// Compute the ID of the liquidity pool with the given parameters.
+func LiquidityPoolID(params *stx.LiquidityPoolParameters) stx.PoolID {
+	return sha256.Sum256([]byte(stcdetail.XdrToBin(params)))
+}
+
+// One of the two reserves of a liquidity pool.
+type HorizonPoolReserve struct {
+	Asset  stx.Asset `json:"-"`
+	Amount stcdetail.JsonInt64e7
+}
+
+func (r *HorizonPoolReserve) UnmarshalJSON(data []byte) error {
+	type jhr HorizonPoolReserve
+	var j struct {
+		*jhr
+		Asset string
+	}
+	j.jhr = (*jhr)(r)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	_, err := fmt.Sscan(j.Asset, &r.Asset)
+	return err
+}
+
+// A liquidity pool, as returned by horizon's liquidity_pools
+// endpoints.  Reserves are listed in the pool's asset order (asset A
+// followed by asset B).
+type HorizonLiquidityPool struct {
+	Net                  *StellarNet `json:"-"`
+	Id                   stx.PoolID  `json:"-"`
+	Paging_token         string
+	Fee_bp               int32
+	Type                 string
+	Total_trustlines     stcdetail.JsonInt64
+	Total_shares         stcdetail.JsonInt64e7
+	Reserves             []HorizonPoolReserve
+	Last_modified_ledger uint32
+	Last_modified_time   *time.Time
+}
+
+func (lp *HorizonLiquidityPool) UnmarshalJSON(data []byte) error {
+	type jhlp HorizonLiquidityPool
+	var j struct {
+		*jhlp
+		Id string
+	}
+	j.jhlp = (*jhlp)(lp)
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	_, err := fmt.Sscan(j.Id, stx.XDR_PoolID(&lp.Id))
+	return err
+}
+
+func (lp *HorizonLiquidityPool) String() string {
+	return stcdetail.PrettyPrintAux(lp.Net.prettyPrintAux, lp)
+}
+
+func (lp *HorizonLiquidityPool) reserves() (a, b, total int64, err error) {
+	if len(lp.Reserves) != 2 {
+		return 0, 0, 0, horizonFailure(fmt.Sprintf(
+			"liquidity pool has %d reserves instead of 2", len(lp.Reserves)))
+	}
+	return int64(lp.Reserves[0].Amount), int64(lp.Reserves[1].Amount),
+		int64(lp.Total_shares), nil
+}
+
+// Return the parameters of the pool, which are needed to establish a
+// trustline to the pool's shares.
+func (lp *HorizonLiquidityPool) Parameters() (
+	*stx.LiquidityPoolParameters, error) {
+	if _, _, _, err := lp.reserves(); err != nil {
+		return nil, err
+	}
+	ret := LiquidityPoolParameters(&lp.Reserves[0].Asset,
+		&lp.Reserves[1].Asset, lp.Fee_bp)
+	return &ret, nil
+}
+
+// Compute a*b/c, rounding up if roundUp is true and down otherwise,
+// and clamping the result to MaxInt64.
+func mulDiv(a, b, c int64, roundUp bool) int64 {
+	r := new(big.Int).Mul(big.NewInt(a), big.NewInt(b))
+	m := new(big.Int)
+	r.DivMod(r, big.NewInt(c), m)
+	if roundUp && m.Sign() != 0 {
+		r.Add(r, big.NewInt(1))
+	}
+	if !r.IsInt64() {
+		return math.MaxInt64
+	}
+	return r.Int64()
+}
+
+// Compute the amounts of the pool's two assets that a deposit of at
+// most maxA of asset A and maxB of asset B would actually deposit at
+// the pool's current reserves, as well as the number of pool shares
+// the deposit would yield.  The computation rounds the same way the
+// network does.
+func (lp *HorizonLiquidityPool) ExpectedDeposit(maxA, maxB int64) (
+	amountA, amountB, shares int64, err error) {
+	ra, rb, total, err := lp.reserves()
+	if err != nil {
+		return 0, 0, 0, err
+	} else if maxA <= 0 || maxB <= 0 {
+		return 0, 0, 0, horizonFailure("deposit amounts must be positive")
+	}
+	if total == 0 {
+		shares = new(big.Int).Sqrt(new(big.Int).Mul(
+			big.NewInt(maxA), big.NewInt(maxB))).Int64()
+		return maxA, maxB, shares, nil
+	} else if ra == 0 || rb == 0 {
+		return 0, 0, 0, horizonFailure("liquidity pool reserves are empty")
+	}
+	shares = mulDiv(total, maxA, ra, false)
+	if sb := mulDiv(total, maxB, rb, false); sb < shares {
+		shares = sb
+	}
+	return mulDiv(shares, ra, total, true), mulDiv(shares, rb, total, true),
+		shares, nil
+}
+
+// Compute the amounts of the pool's two assets that withdrawing
+// shares pool shares would yield at the pool's current reserves.
+func (lp *HorizonLiquidityPool) ExpectedWithdraw(shares int64) (
+	amountA, amountB int64, err error) {
+	ra, rb, total, err := lp.reserves()
+	if err != nil {
+		return 0, 0, err
+	} else if shares <= 0 || shares > total {
+		return 0, 0, horizonFailure(fmt.Sprintf(
+			"cannot withdraw %s of %s pool shares", horizonAmount(shares),
+			horizonAmount(total)))
+	}
+	return mulDiv(shares, ra, total, false), mulDiv(shares, rb, total,
+		false), nil
+}
+
+// Return a LiquidityPoolDeposit operation body (suitable for
+// TransactionEnvelope.Append) depositing at most maxA of asset A and
+// maxB of asset B into the pool.  The operation's MinPrice and
+// MaxPrice bound the deposit price (asset A per unit of asset B) to
+// within slippageBP basis points (hundredths of a percent) of the
+// price implied by ExpectedDeposit.
+func (lp *HorizonLiquidityPool) DepositOp(maxA, maxB int64,
+	slippageBP uint32) (*LiquidityPoolDeposit, error) {
+	amountA, amountB, _, err := lp.ExpectedDeposit(maxA, maxB)
+	if err != nil {
+		return nil, err
+	} else if amountA == 0 || amountB == 0 {
+		return nil, horizonFailure("deposit too small for liquidity pool")
+	}
+	price := big.NewRat(amountA, amountB)
+	low := int64(10000) - int64(slippageBP)
+	if low < 1 {
+		low = 1
+	}
+	ret := &LiquidityPoolDeposit{
+		LiquidityPoolID: lp.Id,
+		MaxAmountA:      maxA,
+		MaxAmountB:      maxB,
+	}
+	ratToPrice(new(big.Rat).Mul(price, big.NewRat(low, 10000)),
+		&ret.MinPrice)
+	ratToPrice(new(big.Rat).Mul(price,
+		big.NewRat(10000+int64(slippageBP), 10000)), &ret.MaxPrice)
+	return ret, nil
+}
+
+// Return a LiquidityPoolWithdraw operation body (suitable for
+// TransactionEnvelope.Append) withdrawing shares pool shares.  The
+// operation's MinAmountA and MinAmountB are the amounts computed by
+// ExpectedWithdraw, reduced by slippageBP basis points (hundredths of
+// a percent).
+func (lp *HorizonLiquidityPool) WithdrawOp(shares int64,
+	slippageBP uint32) (*LiquidityPoolWithdraw, error) {
+	amountA, amountB, err := lp.ExpectedWithdraw(shares)
+	if err != nil {
+		return nil, err
+	}
+	return &LiquidityPoolWithdraw{
+		LiquidityPoolID: lp.Id,
+		Amount:          shares,
+		MinAmountA:      applySlippage(amountA, -int64(slippageBP)),
+		MinAmountB:      applySlippage(amountB, -int64(slippageBP)),
+	}, nil
+}
+
+// Fetch a liquidity pool by ID.
+func (net *StellarNet) GetLiquidityPool(ctx context.Context,
+	id *stx.PoolID) (*HorizonLiquidityPool, error) {
+	ret := HorizonLiquidityPool{Net: net}
+	if err := net.GetJSONCtx(ctx, fmt.Sprintf("liquidity_pools/%x",
+		id[:]), &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// Return a horizon query for liquidity pools holding all of the
+// given reserve assets, suitable for Iterate, Pager, or Stream.
+func LiquidityPoolsQuery(reserves ...stx.Asset) string {
+	v := url.Values{}
+	v.Set("reserves", assetList(reserves))
+	return "liquidity_pools?" + v.Encode()
+}
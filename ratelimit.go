@@ -0,0 +1,146 @@
+package stc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A server's request quota, as reported by the X-RateLimit-Limit,
+// X-RateLimit-Remaining, and X-RateLimit-Reset headers of its most
+// recent response.  Remaining also counts down requests sent since
+// that response.
+type RateLimit struct {
+	// Number of requests allowed per window
+	Limit int
+
+	// Number of requests left in the current window
+	Remaining int
+
+	// When the current window ends and the quota is replenished
+	Reset time.Time
+}
+
+// Once fewer than 1/ThrottleFraction of the requests in a rate limit
+// window remain, requests are spaced evenly over the rest of the
+// window rather than sent as quickly as possible.
+const ThrottleFraction = 10
+
+type rateLimiter struct {
+	mu    sync.Mutex
+	quota *RateLimit
+	next  time.Time
+}
+
+// Return the base URL whose quota governs requests to u:  the longest
+// configured horizon or RPC URL that is a prefix of u, or else the
+// scheme and host of u.  Each server enforces its own quota.
+func (net *StellarNet) rateLimitKey(u string) string {
+	key := ""
+	for _, urls := range [][]string{net.horizonURLs(), net.rpcURLs()} {
+		for _, base := range urls {
+			if strings.HasPrefix(u, base) && len(base) > len(key) {
+				key = base
+			}
+		}
+	}
+	if key == "" {
+		if pu, err := url.Parse(u); err == nil {
+			key = pu.Scheme + "://" + pu.Host + "/"
+		}
+	}
+	return key
+}
+
+// Return the rate limiter for requests to URL u.
+func (net *StellarNet) rateLimiter(u string) *rateLimiter {
+	key := net.rateLimitKey(u)
+	netStateMu.Lock()
+	defer netStateMu.Unlock()
+	if net.rate == nil {
+		net.rate = make(map[string]*rateLimiter)
+	}
+	rl := net.rate[key]
+	if rl == nil {
+		rl = &rateLimiter{}
+		net.rate[key] = rl
+	}
+	return rl
+}
+
+// Return the current request quota of the preferred horizon server,
+// or nil if that server has not reported one (or the reported window
+// has ended).
+func (net *StellarNet) RateLimit() *RateLimit {
+	base := net.preferredURL(net.horizonURLs(), false)
+	if base == "" {
+		return nil
+	}
+	rl := net.rateLimiter(base)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.quota == nil || !time.Now().Before(rl.quota.Reset) {
+		return nil
+	}
+	ret := *rl.quota
+	return &ret
+}
+
+// Wait until a request can be sent without exhausting the quota, and
+// count the request against it.
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	rl.mu.Lock()
+	now := time.Now()
+	var delay time.Duration
+	if q := rl.quota; q != nil && now.Before(q.Reset) {
+		if q.Remaining <= 0 {
+			delay = q.Reset.Sub(now)
+		} else if q.Remaining*ThrottleFraction < q.Limit {
+			start := now
+			if rl.next.After(now) {
+				start = rl.next
+			}
+			delay = start.Sub(now)
+			rl.next = start.Add(q.Reset.Sub(start) /
+				time.Duration(q.Remaining))
+		}
+		q.Remaining--
+	}
+	rl.mu.Unlock()
+	return sleepCtx(ctx, delay)
+}
+
+// Record the quota reported in the headers of a response.
+func (rl *rateLimiter) update(h http.Header) {
+	limit, err := strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseUint(h.Get("X-RateLimit-Reset"), 10, 32)
+	if err != nil {
+		return
+	}
+	q := RateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Now().Add(time.Duration(reset) * time.Second),
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	// Responses to concurrent requests can arrive out of order, so
+	// within a window trust the lowest count
+	if old := rl.quota; old != nil && old.Remaining < q.Remaining &&
+		q.Reset.Sub(old.Reset) < time.Second &&
+		old.Reset.Sub(q.Reset) < time.Second {
+		q.Remaining = old.Remaining
+	}
+	rl.quota = &q
+}
@@ -0,0 +1,163 @@
+package stc
+
+import (
+	"context"
+
+	"github.com/xdrpp/stc/stx"
+)
+
+// Policy for automatically resubmitting transactions that fail with
+// txBAD_SEQ or txINSUFFICIENT_FEE.  See StellarNet.Resubmit.
+type ResubmitPolicy struct {
+	// Maximum number of times to resubmit a transaction after the
+	// initial attempt.
+	MaxResubmits int
+
+	// Percentile of recently offered fees (see FeeStats.Percentile)
+	// to offer as the base fee after txINSUFFICIENT_FEE.  If zero,
+	// uses 50.  If the percentile is no higher than the transaction's
+	// current base fee, the base fee is doubled instead.
+	FeePercentile int
+
+	// Maximum base fee (per operation) to offer.  If zero, uses the
+	// MaxBaseFee of the network's FeePolicy.  Fees are never raised
+	// beyond this maximum, so if both are zero, transactions are not
+	// resubmitted after txINSUFFICIENT_FEE.
+	MaxBaseFee uint32
+
+	// Keys with which to re-sign transactions after updating their
+	// sequence numbers or fees.  A transaction is only updated if
+	// Keys contains the keys for all of its existing signatures.
+	Keys []PrivateKey
+
+	// When a transaction's fee must be raised but Keys cannot re-sign
+	// it, wrap the transaction in a fee-bump transaction whose fee is
+	// paid by FeeSource's account (and signed by FeeSource), unless
+	// FeeSource is nil.
+	FeeSource *PrivateKey
+}
+
+// Return the next sequence number for an account, fetched from the
+// RPC server if one is configured, and otherwise from horizon.
+func (net *StellarNet) GetNextSeq(ctx context.Context,
+	m *stx.MuxedAccount) (stx.SequenceNumber, error) {
+	acct, _ := DemuxAcct(m)
+	ctx = ctxOrBackground(ctx)
+	if c := net.rpcClient(ctx); c != nil {
+		ae, err := c.GetAccountEntry(ctx, *acct)
+		if err != nil {
+			return 0, err
+		}
+		return ae.SeqNum + 1, nil
+	}
+	ae, err := net.GetAccountEntryCtx(ctx, acct.String())
+	if err != nil {
+		return 0, err
+	}
+	return ae.NextSeq(), nil
+}
+
+// Return the keys in Keys for all of a transaction's signatures, or
+// false if some signature was made by another key or the transaction
+// is not signed at all.
+func (rp *ResubmitPolicy) signingKeys(e *TransactionEnvelope) (
+	[]PrivateKey, bool) {
+	if len(*e.Signatures()) == 0 {
+		return nil, false
+	}
+	var ret []PrivateKey
+sigs:
+	for _, sig := range *e.Signatures() {
+		for _, sk := range rp.Keys {
+			if sk.Public().Hint() == sig.Hint {
+				ret = append(ret, sk)
+				continue sigs
+			}
+		}
+		return nil, false
+	}
+	return ret, true
+}
+
+// Return the base fee for a transaction after txINSUFFICIENT_FEE, or
+// false if the policy does not allow raising the fee.
+func (rp *ResubmitPolicy) raiseFee(ctx context.Context, net *StellarNet,
+	e *TransactionEnvelope) (uint32, bool) {
+	var fee int64
+	switch e.Type {
+	case stx.ENVELOPE_TYPE_TX_V0:
+		fee = int64(e.V0().Tx.Fee)
+	case stx.ENVELOPE_TYPE_TX:
+		fee = int64(e.V1().Tx.Fee)
+	case stx.ENVELOPE_TYPE_TX_FEE_BUMP:
+		fee = e.FeeBump().Tx.Fee
+	}
+	cur := fee / feeOps(e.TransactionEnvelope)
+	percentile := rp.FeePercentile
+	if percentile == 0 {
+		percentile = 50
+	}
+	fs, err := net.GetFeeStatsCtx(ctx)
+	if err != nil {
+		return 0, false
+	}
+	ret := int64(fs.Percentile(percentile))
+	if ret <= cur {
+		ret = 2 * cur
+	}
+	limit := rp.MaxBaseFee
+	if limit == 0 {
+		limit = net.feePolicy().MaxBaseFee
+	}
+	if ret > int64(limit) {
+		ret = int64(limit)
+	}
+	return uint32(ret), ret > cur
+}
+
+// Update a failed transaction in place so that it can be resubmitted.
+// Returns false if the transaction cannot be fixed.
+func (rp *ResubmitPolicy) fix(ctx context.Context, net *StellarNet,
+	e *TransactionEnvelope, txf TxFailure) bool {
+	keys, canSign := rp.signingKeys(e)
+	switch txf.Result.Code {
+	case stx.TxBAD_SEQ:
+		if !canSign || e.Type == stx.ENVELOPE_TYPE_TX_FEE_BUMP {
+			return false
+		}
+		seq, err := net.GetNextSeq(ctx, e.SourceAccount())
+		if err != nil || seq == 0 {
+			return false
+		}
+		switch e.Type {
+		case stx.ENVELOPE_TYPE_TX:
+			e.V1().Tx.SeqNum = seq
+		case stx.ENVELOPE_TYPE_TX_V0:
+			e.V0().Tx.SeqNum = seq
+		}
+	case stx.TxINSUFFICIENT_FEE:
+		fee, ok := rp.raiseFee(ctx, net, e)
+		if !ok {
+			return false
+		} else if canSign {
+			e.SetFee(fee)
+		} else if rp.FeeSource != nil &&
+			e.Type != stx.ENVELOPE_TYPE_TX_FEE_BUMP {
+			pk := rp.FeeSource.Public()
+			e.TransactionEnvelope =
+				NewFeeBump(e, &pk, fee).TransactionEnvelope
+			keys = []PrivateKey{*rp.FeeSource}
+		} else {
+			return false
+		}
+	default:
+		return false
+	}
+	*e.Signatures() = nil
+	for _, sk := range keys {
+		if net.SignTx(sk, e) != nil {
+			return false
+		}
+	}
+	return true
+}
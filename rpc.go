@@ -0,0 +1,465 @@
+package stc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+)
+
+// A client for the JSON-RPC interface of a Stellar RPC server (the
+// successor to soroban-rpc), which can be used instead of or in
+// addition to horizon.  Requests are sent with the Client, Header,
+// UserAgent, Timeout, and Retry settings of the StellarNet.
+//
+// Note that the stx package does not include the smart contract XDR
+// types.  Hence, values that can only be expressed with those types
+// (such as contract event topics) are left as base64-encoded XDR.
+type RPCClient struct {
+	Net *StellarNet
+
+	// URL of the RPC endpoint.
+	URL string
+}
+
+// Return a client for the network's RPC server (the preferred one, if
+// RPCURLs lists several), or nil if no RPC server is configured.  If
+// several servers are configured, the first call checks them (see
+// CheckEndpoints).
+func (net *StellarNet) RPCClient() *RPCClient {
+	return net.rpcClient(context.Background())
+}
+
+// Like RPCClient, but checking the servers is abandoned if ctx is
+// Done.
+func (net *StellarNet) rpcClient(ctx context.Context) *RPCClient {
+	u := net.rpcBase(ctx)
+	if u == "" {
+		return nil
+	}
+	return &RPCClient{Net: net, URL: u}
+}
+
+// An error returned by the RPC server.
+type RPCError struct {
+	Code    int
+	Message string
+	Data    json.RawMessage
+}
+
+func (e *RPCError) Error() string {
+	if len(e.Data) > 0 {
+		return fmt.Sprintf("RPC error %d: %s (%s)", e.Code, e.Message,
+			string(e.Data))
+	}
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+// An integer that the RPC server may encode as either a JSON number
+// or a string.
+type rpcInt int64
+
+func (i *rpcInt) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	if len(data) == 0 || string(data) == "null" {
+		*i = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(string(data), 10, 64)
+	*i = rpcInt(v)
+	return err
+}
+
+func rpcTime(i rpcInt) time.Time {
+	if i == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(i), 0)
+}
+
+// Invoke method with params on the RPC server, and unmarshal the
+// result into out.
+func (c *RPCClient) Call(ctx context.Context, method string,
+	params interface{}, out interface{}) error {
+	body, err := json.Marshal(struct {
+		Jsonrpc string      `json:"jsonrpc"`
+		Id      int         `json:"id"`
+		Method  string      `json:"method"`
+		Params  interface{} `json:"params,omitempty"`
+	}{"2.0", 1, method, params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctxOrBackground(ctx), "POST",
+		c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Net.do(req, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return readHorizonProblem(resp)
+	}
+
+	var reply struct {
+		Result json.RawMessage
+		Error  *RPCError
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return err
+	} else if reply.Error != nil {
+		return reply.Error
+	} else if out != nil {
+		return json.Unmarshal(reply.Result, out)
+	}
+	return nil
+}
+
+// Result of the getNetwork method.
+type RPCNetwork struct {
+	Passphrase      string
+	ProtocolVersion uint32
+	FriendbotUrl    string
+}
+
+// Return general information about the network.
+func (c *RPCClient) GetNetwork(ctx context.Context) (*RPCNetwork, error) {
+	var ret RPCNetwork
+	if err := c.Call(ctx, "getNetwork", nil, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// Result of the getLatestLedger method.
+type RPCLatestLedger struct {
+	Id              string
+	ProtocolVersion uint32
+	Sequence        uint32
+}
+
+// Return the sequence number and hash of the most recent ledger.
+func (c *RPCClient) GetLatestLedger(ctx context.Context) (
+	*RPCLatestLedger, error) {
+	var ret RPCLatestLedger
+	if err := c.Call(ctx, "getLatestLedger", nil, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// A ledger entry returned by getLedgerEntries.
+type RPCLedgerEntry struct {
+	Key                   stx.LedgerKey
+	Data                  stx.XdrAnon_LedgerEntry_Data
+	LastModifiedLedgerSeq uint32
+	// Zero for entries that do not expire.
+	LiveUntilLedgerSeq uint32
+}
+
+// Result of the getLedgerEntries method.
+type RPCLedgerEntries struct {
+	Entries      []RPCLedgerEntry
+	LatestLedger uint32
+}
+
+// Fetch the current values of a set of ledger entries.  Entries that
+// do not exist are omitted from the result.
+func (c *RPCClient) GetLedgerEntries(ctx context.Context,
+	keys ...stx.LedgerKey) (*RPCLedgerEntries, error) {
+	var params struct {
+		Keys []string `json:"keys"`
+	}
+	for i := range keys {
+		params.Keys = append(params.Keys, stcdetail.XdrToBase64(&keys[i]))
+	}
+	var res struct {
+		Entries []struct {
+			Key                   string
+			Xdr                   string
+			LastModifiedLedgerSeq uint32
+			LiveUntilLedgerSeq    uint32
+		}
+		LatestLedger uint32
+	}
+	if err := c.Call(ctx, "getLedgerEntries", &params, &res); err != nil {
+		return nil, err
+	}
+	ret := RPCLedgerEntries{
+		Entries:      make([]RPCLedgerEntry, len(res.Entries)),
+		LatestLedger: res.LatestLedger,
+	}
+	for i := range res.Entries {
+		e := &ret.Entries[i]
+		if err := stcdetail.XdrFromBase64(&e.Key,
+			res.Entries[i].Key); err != nil {
+			return nil, err
+		} else if err = stcdetail.XdrFromBase64(&e.Data,
+			res.Entries[i].Xdr); err != nil {
+			return nil, err
+		}
+		e.LastModifiedLedgerSeq = res.Entries[i].LastModifiedLedgerSeq
+		e.LiveUntilLedgerSeq = res.Entries[i].LiveUntilLedgerSeq
+	}
+	return &ret, nil
+}
+
+// Fetch an account's ledger entry.  If the account does not exist,
+// the error is a *HorizonProblem with Status 404.
+func (c *RPCClient) GetAccountEntry(ctx context.Context,
+	acct AccountID) (*stx.AccountEntry, error) {
+	key := stx.LedgerKey{Type: stx.ACCOUNT}
+	key.Account().AccountID = acct
+	res, err := c.GetLedgerEntries(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res.Entries {
+		if res.Entries[i].Data.Type == stx.ACCOUNT {
+			return res.Entries[i].Data.Account(), nil
+		}
+	}
+	return nil, &HorizonProblem{
+		Title:  "Resource Missing",
+		Status: http.StatusNotFound,
+		Detail: fmt.Sprintf("account %s not found", acct.String()),
+	}
+}
+
+// Status values returned by sendTransaction
+const (
+	RPCSendPending       = "PENDING"
+	RPCSendDuplicate     = "DUPLICATE"
+	RPCSendTryAgainLater = "TRY_AGAIN_LATER"
+	RPCSendError         = "ERROR"
+)
+
+// Result of the sendTransaction method.
+type RPCSendResult struct {
+	Status                string
+	Hash                  string
+	LatestLedger          uint32
+	LatestLedgerCloseTime time.Time
+	// Only set when Status is RPCSendError
+	ErrorResult *stx.TransactionResult
+}
+
+// Submit a transaction.  Unlike horizon, the RPC server does not wait
+// for the transaction to execute; use GetTransaction to learn its
+// fate, or use Submit to do both.
+func (c *RPCClient) SendTransaction(ctx context.Context,
+	e *TransactionEnvelope) (*RPCSendResult, error) {
+	var res struct {
+		Status                string
+		Hash                  string
+		LatestLedger          uint32
+		LatestLedgerCloseTime rpcInt
+		ErrorResultXdr        string
+	}
+	if err := c.Call(ctx, "sendTransaction", map[string]string{
+		"transaction": stcdetail.XdrToBase64(e),
+	}, &res); err != nil {
+		return nil, err
+	}
+	ret := RPCSendResult{
+		Status:                res.Status,
+		Hash:                  res.Hash,
+		LatestLedger:          res.LatestLedger,
+		LatestLedgerCloseTime: rpcTime(res.LatestLedgerCloseTime),
+	}
+	if res.ErrorResultXdr != "" {
+		ret.ErrorResult = &stx.TransactionResult{}
+		if err := stcdetail.XdrFromBase64(ret.ErrorResult,
+			res.ErrorResultXdr); err != nil {
+			return nil, err
+		}
+	}
+	return &ret, nil
+}
+
+// Status values returned by getTransaction
+const (
+	RPCTxSuccess  = "SUCCESS"
+	RPCTxNotFound = "NOT_FOUND"
+	RPCTxFailed   = "FAILED"
+)
+
+// Result of the getTransaction method.  Fields other than Status and
+// LatestLedger are only set when Status is not RPCTxNotFound.
+type RPCTransaction struct {
+	Status           string
+	LatestLedger     uint32
+	Ledger           uint32
+	CreatedAt        time.Time
+	ApplicationOrder uint32
+	FeeBump          bool
+	Env              stx.TransactionEnvelope
+	Result           stx.TransactionResult
+	// The TransactionMeta, left in base64 as it may use a version
+	// not supported by the stx package.
+	ResultMetaXdr string
+}
+
+// Look up a transaction by its hex-encoded hash.
+func (c *RPCClient) GetTransaction(ctx context.Context, txid string) (
+	*RPCTransaction, error) {
+	var res struct {
+		Status           string
+		LatestLedger     uint32
+		Ledger           uint32
+		CreatedAt        rpcInt
+		ApplicationOrder uint32
+		FeeBump          bool
+		EnvelopeXdr      string
+		ResultXdr        string
+		ResultMetaXdr    string
+	}
+	if err := c.Call(ctx, "getTransaction", map[string]string{
+		"hash": txid,
+	}, &res); err != nil {
+		return nil, err
+	}
+	ret := RPCTransaction{
+		Status:           res.Status,
+		LatestLedger:     res.LatestLedger,
+		Ledger:           res.Ledger,
+		CreatedAt:        rpcTime(res.CreatedAt),
+		ApplicationOrder: res.ApplicationOrder,
+		FeeBump:          res.FeeBump,
+		ResultMetaXdr:    res.ResultMetaXdr,
+	}
+	if res.EnvelopeXdr != "" {
+		if err := stcdetail.XdrFromBase64(&ret.Env,
+			res.EnvelopeXdr); err != nil {
+			return nil, err
+		}
+	}
+	if res.ResultXdr != "" {
+		if err := stcdetail.XdrFromBase64(&ret.Result,
+			res.ResultXdr); err != nil {
+			return nil, err
+		}
+	}
+	return &ret, nil
+}
+
+// Submit a transaction and wait for it to execute, polling every
+// PostWaitInterval.  If the transaction is rejected or fails, the
+// error is a TxFailure (and in the latter case the RPCTransaction is
+// returned as well).
+func (c *RPCClient) Submit(ctx context.Context, e *TransactionEnvelope) (
+	*RPCTransaction, error) {
+	ctx = ctxOrBackground(ctx)
+	sr, err := c.SendTransaction(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	switch sr.Status {
+	case RPCSendPending, RPCSendDuplicate:
+	case RPCSendError:
+		if sr.ErrorResult != nil {
+			return nil, TxFailure{sr.ErrorResult}
+		}
+		fallthrough
+	default:
+		return nil, horizonFailure(fmt.Sprintf(
+			"sendTransaction returned status %s", sr.Status))
+	}
+	for {
+		tx, err := c.GetTransaction(ctx, sr.Hash)
+		if err != nil {
+			return nil, err
+		} else if tx.Status != RPCTxNotFound {
+			c.Net.AccountCache.InvalidateTx(e)
+			var meta stx.TransactionMeta
+			if stcdetail.XdrFromBase64(&meta, tx.ResultMetaXdr) == nil {
+				c.Net.AccountCache.InvalidateMetas(&meta)
+			}
+		}
+		switch tx.Status {
+		case RPCTxNotFound:
+		case RPCTxSuccess:
+			return tx, nil
+		default:
+			return tx, TxFailure{&tx.Result}
+		}
+		if err = sleepCtx(ctx, PostWaitInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Filter for contract events, as accepted by getEvents.
+type RPCEventFilter struct {
+	// "contract", "system", or "diagnostic"; empty for all
+	Type        string     `json:"type,omitempty"`
+	ContractIds []string   `json:"contractIds,omitempty"`
+	Topics      [][]string `json:"topics,omitempty"`
+}
+
+// A contract event returned by getEvents.  Topic and Value contain
+// base64-encoded SCVal XDR.
+type RPCEvent struct {
+	Type                     string
+	Ledger                   uint32
+	LedgerClosedAt           string
+	ContractId               string
+	Id                       string
+	PagingToken              string
+	Topic                    []string
+	Value                    string
+	InSuccessfulContractCall bool
+	TxHash                   string
+}
+
+// Result of the getEvents method.
+type RPCEvents struct {
+	Events       []RPCEvent
+	LatestLedger uint32
+	// Pass as cursor to fetch the next page of events
+	Cursor string
+}
+
+// Fetch contract events.  If cursor is non-empty, startLedger is
+// ignored and events after the cursor are returned.  A limit of 0
+// requests the server's default page size.
+func (c *RPCClient) GetEvents(ctx context.Context, startLedger uint32,
+	cursor string, limit int, filters ...RPCEventFilter) (
+	*RPCEvents, error) {
+	type pagination struct {
+		Cursor string `json:"cursor,omitempty"`
+		Limit  int    `json:"limit,omitempty"`
+	}
+	params := struct {
+		StartLedger uint32           `json:"startLedger,omitempty"`
+		Filters     []RPCEventFilter `json:"filters"`
+		Pagination  *pagination      `json:"pagination,omitempty"`
+	}{Filters: filters}
+	if params.Filters == nil {
+		params.Filters = []RPCEventFilter{}
+	}
+	if cursor != "" || limit > 0 {
+		params.Pagination = &pagination{cursor, limit}
+	}
+	if cursor == "" {
+		params.StartLedger = startLedger
+	}
+	var ret RPCEvents
+	if err := c.Call(ctx, "getEvents", &params, &ret); err != nil {
+		return nil, err
+	}
+	if ret.Cursor == "" && len(ret.Events) > 0 {
+		ret.Cursor = ret.Events[len(ret.Events)-1].PagingToken
+	}
+	return &ret, nil
+}
@@ -1,12 +1,26 @@
-package stc
+package stc_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/xdrpp/goxdr/xdr"
+	. "github.com/xdrpp/stc"
+	"github.com/xdrpp/stc/ini"
 	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stctest"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 import "github.com/xdrpp/stc/stx"
@@ -247,6 +261,1693 @@ func TestMaxInt64(t *testing.T) {
 	}
 }
 
+func TestGetCtxCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}))
+	defer srv.Close()
+	defer close(release)
+
+	net := StellarNet{Name: "custom", Horizon: srv.URL + "/"}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	if _, err := net.GetFeeStatsCtx(ctx); err == nil {
+		t.Error("GetFeeStatsCtx should have failed")
+	} else if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetFeeStatsCtx returned %v instead of deadline", err)
+	}
+}
+
+func TestRetryAndHeaders(t *testing.T) {
+	tries := 0
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Api-Key") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if tries++; tries < 3 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			fmt.Fprint(w, `{"network_passphrase": "Retry Network"}`)
+		}))
+	defer srv.Close()
+
+	net := StellarNet{
+		Name:    "custom",
+		Horizon: srv.URL + "/",
+		Header:  http.Header{"X-Api-Key": {"secret"}},
+		Retry:   &RetryPolicy{MaxRetries: 2, MinBackoff: time.Millisecond},
+	}
+	if id := net.GetNetworkId(); id != "Retry Network" {
+		t.Errorf("GetNetworkId returned %q after %d tries", id, tries)
+	}
+
+	tries = 0
+	net.NetworkId = ""
+	net.Retry = &RetryPolicy{MaxRetries: 1, MinBackoff: time.Millisecond}
+	if _, err := net.Get(""); err == nil {
+		t.Error("Get should have failed after exhausting retries")
+	}
+}
+
+func TestHorizonProblem(t *testing.T) {
+	var txres stx.TransactionResult
+	txres.Result.Code = stx.TxBAD_SEQ
+	resultXdr := stcdetail.XdrToBase64(&txres)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			if r.FormValue("tx") == "" {
+				fmt.Fprint(w, `{"type": "https://stellar.org/horizon-errors/not_found", "title": "Resource Missing", "status": 404}`)
+			} else if r.URL.Path == "/bad/transactions/" {
+				fmt.Fprint(w, `{"type": "https://stellar.org/horizon-errors/transaction_malformed", "title": "Transaction Malformed", "status": 400, "detail": "bad", "extras": {"envelope_xdr": "AAAA"}}`)
+			} else {
+				fmt.Fprintf(w, `{"type": "https://stellar.org/horizon-errors/transaction_failed", "title": "Transaction Failed", "status": 400, "extras": {"result_xdr": %q, "result_codes": {"transaction": "tx_bad_seq"}}}`, resultXdr)
+			}
+		}))
+	defer srv.Close()
+
+	net := StellarNet{Name: "custom", NetworkId: "Problem Network",
+		Horizon: srv.URL + "/"}
+	var p *HorizonProblem
+	if _, err := net.GetAccountEntry("x"); !errors.As(err, &p) {
+		t.Errorf("GetAccountEntry returned %v instead of HorizonProblem", err)
+	} else if p.Status != 404 || p.Title != "Resource Missing" {
+		t.Errorf("incorrectly parsed HorizonProblem %+v", *p)
+	}
+
+	txe := NewTransactionEnvelope()
+	var txf TxFailure
+	if _, err := net.Post(txe); !errors.As(err, &txf) {
+		t.Errorf("Post returned %v instead of TxFailure", err)
+	} else if txf.Result.Code != stx.TxBAD_SEQ {
+		t.Errorf("TxFailure has wrong code %s", txf.Result.Code)
+	}
+
+	net.Horizon = srv.URL + "/bad/"
+	if _, err := net.Post(txe); !errors.As(err, &p) {
+		t.Errorf("Post returned %v instead of HorizonProblem", err)
+	} else if p.Extras.Envelope_xdr != "AAAA" || p.Detail != "bad" {
+		t.Errorf("incorrectly parsed HorizonProblem %+v", *p)
+	}
+}
+
+func TestPostWait(t *testing.T) {
+	defer func(d time.Duration) { PostWaitInterval = d }(PostWaitInterval)
+	PostWaitInterval = time.Millisecond
+
+	txe := NewTransactionEnvelope()
+	var txres stx.TransactionResult
+	txres.Result.Code = stx.TxSUCCESS
+	var meta stx.TransactionMeta
+	var feeMeta stx.LedgerEntryChanges
+	record := fmt.Sprintf(`{"hash": "%s", "ledger": 7, "created_at": "2020-01-01T00:00:00Z", "envelope_xdr": %q, "result_xdr": %q, "result_meta_xdr": %q, "fee_meta_xdr": %q}`,
+		"%s", stcdetail.XdrToBase64(txe), stcdetail.XdrToBase64(&txres),
+		stcdetail.XdrToBase64(&meta),
+		stcdetail.XdrToBase64(stx.XDR_LedgerEntryChanges(&feeMeta)))
+
+	posts, polls := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				posts++
+				w.WriteHeader(http.StatusGatewayTimeout)
+				fmt.Fprint(w, `{"type": "https://stellar.org/horizon-errors/timeout", "title": "Timeout", "status": 504}`)
+			} else if polls++; posts == 0 || polls < 4 {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"type": "https://stellar.org/horizon-errors/not_found", "title": "Resource Missing", "status": 404}`)
+			} else {
+				fmt.Fprintf(w, record, path.Base(r.URL.Path))
+			}
+		}))
+	defer srv.Close()
+
+	net := &StellarNet{Name: "custom", NetworkId: "Wait Network",
+		Horizon: srv.URL + "/"}
+	res, err := net.PostWait(context.Background(), txe)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.Txhash != *net.HashTx(txe) || res.Ledger != 7 {
+		t.Errorf("PostWait returned wrong transaction %x in ledger %d",
+			res.Txhash, res.Ledger)
+	} else if posts != 1 || polls != 4 {
+		t.Errorf("PostWait posted %d times and polled %d times", posts, polls)
+	}
+
+	// Resubmitting should find the transaction without posting again
+	if _, err = net.PostWait(context.Background(), txe); err != nil {
+		t.Error(err)
+	} else if posts != 1 {
+		t.Errorf("PostWait re-posted an executed transaction")
+	}
+}
+
+func TestRPC(t *testing.T) {
+	defer func(d time.Duration) { PostWaitInterval = d }(PostWaitInterval)
+	PostWaitInterval = time.Millisecond
+
+	acct := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public()
+	entry := stx.XdrAnon_LedgerEntry_Data{Type: stx.ACCOUNT}
+	entry.Account().AccountID = acct
+	entry.Account().SeqNum = 41
+	var txres stx.TransactionResult
+	txres.Result.Code = stx.TxSUCCESS
+
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Method string
+				Params map[string]interface{}
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			var result string
+			switch req.Method {
+			case "getNetwork":
+				result = `{"passphrase": "RPC Network", "protocolVersion": 19}`
+			case "getLedgerEntries":
+				result = fmt.Sprintf(`{"entries": [{"key": %q, "xdr": %q, "lastModifiedLedgerSeq": 5}], "latestLedger": 9}`,
+					req.Params["keys"].([]interface{})[0],
+					stcdetail.XdrToBase64(&entry))
+			case "sendTransaction":
+				result = `{"status": "PENDING", "hash": "abcd", "latestLedger": 9, "latestLedgerCloseTime": "1700000000"}`
+			case "getTransaction":
+				if polls++; polls < 3 {
+					result = `{"status": "NOT_FOUND", "latestLedger": 9}`
+				} else {
+					result = fmt.Sprintf(`{"status": "SUCCESS", "latestLedger": 10, "ledger": 10, "createdAt": 1700000005, "resultXdr": %q}`,
+						stcdetail.XdrToBase64(&txres))
+				}
+			default:
+				fmt.Fprint(w, `{"jsonrpc": "2.0", "id": 1, "error": {"code": -32601, "message": "method not found"}}`)
+				return
+			}
+			fmt.Fprintf(w, `{"jsonrpc": "2.0", "id": 1, "result": %s}`, result)
+		}))
+	defer srv.Close()
+
+	net := &StellarNet{Name: "custom", RPC: srv.URL}
+	if id := net.GetNetworkId(); id != "RPC Network" {
+		t.Errorf("got network ID %q from RPC", id)
+	}
+
+	c := net.RPCClient()
+	if ae, err := c.GetAccountEntry(nil, acct); err != nil {
+		t.Error(err)
+	} else if ae.SeqNum != 41 || ae.AccountID.String() != acct.String() {
+		t.Errorf("GetAccountEntry returned wrong entry %s", net.ToRep(ae))
+	}
+
+	if tx, err := c.Submit(nil, NewTransactionEnvelope()); err != nil {
+		t.Error(err)
+	} else if tx.Ledger != 10 || tx.CreatedAt.Unix() != 1700000005 ||
+		polls != 3 {
+		t.Errorf("Submit returned ledger %d at %s after %d polls",
+			tx.Ledger, tx.CreatedAt, polls)
+	}
+
+	var rpcerr *RPCError
+	if _, err := c.GetLatestLedger(nil); !errors.As(err, &rpcerr) {
+		t.Errorf("expected RPCError, got %v", err)
+	} else if rpcerr.Code != -32601 {
+		t.Errorf("RPCError has wrong code %d", rpcerr.Code)
+	}
+}
+
+// Build a transaction from sk's account with one payment operation.
+func testPayment(net *StellarNet, sk PrivateKey,
+	seq stx.SequenceNumber) *TransactionEnvelope {
+	txe := NewTransactionEnvelope()
+	txe.SetSourceAccount(sk.Public())
+	txe.V1().Tx.SeqNum = seq
+	txe.Append(nil, Payment{
+		Destination: *sk.Public().ToMuxedAccount(),
+		Asset:       NativeAsset(),
+		Amount:      10000000,
+	})
+	txe.SetFee(100)
+	net.SignTx(sk, txe)
+	return txe
+}
+
+func TestFakeHorizon(t *testing.T) {
+	net, srv := stctest.NewFakeHorizon()
+	defer srv.Close()
+	ctx := context.Background()
+
+	net.NetworkId = ""
+	if id := net.GetNetworkId(); id != stctest.FakeNetworkId {
+		t.Errorf("fetched wrong network ID %q", id)
+	}
+
+	sk := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	acct := sk.Public().String()
+	if _, err := net.Get("friendbot?addr=" + acct); err != nil {
+		t.Fatal(err)
+	}
+	ae, err := net.GetAccountEntry(acct)
+	if err != nil {
+		t.Fatal(err)
+	} else if ae.Balance != 10000*10000000 || len(ae.Signers) != 1 ||
+		ae.Signers[0].Key.String() != acct {
+		t.Errorf("wrong account entry\n%s", ae)
+	}
+
+	usd := MkAsset(sk.Public(), "USD")
+	ae.Balances = append(ae.Balances, HorizonBalance{
+		Balance: 5, Limit: MaxInt64, Asset: usd})
+	srv.Fake.SetAccount(acct, ae)
+	if ae2, err := net.GetAccountEntry(acct); err != nil {
+		t.Error(err)
+	} else if len(ae2.Balances) != 1 || ae2.Balances[0].Balance != 5 ||
+		ae2.Balances[0].Asset.String() != usd.String() {
+		t.Errorf("wrong balances %v", ae2.Balances)
+	}
+
+	if fs, err := net.GetFeeStats(); err != nil {
+		t.Error(err)
+	} else if fs.Percentile(50) != 100 {
+		t.Errorf("wrong fee percentile %d", fs.Percentile(50))
+	}
+
+	var txf TxFailure
+	if _, err = net.Post(testPayment(net, sk, ae.NextSeq()+1)); !errors.As(
+		err, &txf) || txf.Result.Code != stx.TxBAD_SEQ {
+		t.Errorf("expected TxBAD_SEQ, got %v", err)
+	}
+
+	txs := make(chan *HorizonTxResult)
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go net.StreamJSON(sctx, "accounts/"+acct+"/transactions?cursor=0",
+		func(r *HorizonTxResult) { txs <- r })
+
+	txe := testPayment(net, sk, ae.NextSeq())
+	if _, err = net.Post(txe); err != nil {
+		t.Fatal(err)
+	}
+	txid := fmt.Sprintf("%x", *net.HashTx(txe))
+	if r, err := net.GetTxResult(txid); err != nil {
+		t.Error(err)
+	} else if !r.Success() || r.Net != net {
+		t.Errorf("wrong transaction result\n%s", r)
+	}
+	if lh, err := net.GetLedgerHeader(); err != nil {
+		t.Error(err)
+	} else if lh.LedgerSeq != 3 {
+		t.Errorf("wrong ledger %d", lh.LedgerSeq)
+	}
+
+	n := 0
+	if err = net.IterateJSON(ctx, "transactions?limit=1",
+		func(r *HorizonTxResult) {
+			if r.Txhash != *net.HashTx(txe) {
+				t.Errorf("iterated over wrong transaction %x", r.Txhash)
+			}
+			n++
+		}); err != nil || n != 1 {
+		t.Errorf("IterateJSON returned %v after %d transactions", err, n)
+	}
+
+	select {
+	case r := <-txs:
+		if r.Txhash != *net.HashTx(txe) {
+			t.Errorf("streamed wrong transaction %x", r.Txhash)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for streamed transaction")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	real, srv := stctest.NewFakeHorizon()
+	defer srv.Close()
+	sk := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	acct := sk.Public().String()
+	srv.Fake.Fund(acct, 100*10000000)
+
+	rec := &stctest.Recorder{}
+	real.Client = &http.Client{Transport: rec}
+	ae, err := real.GetAccountEntry(acct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = real.Post(testPayment(real, sk, ae.NextSeq())); err != nil {
+		t.Fatal(err)
+	}
+	ledgers := 0
+	real.IterateJSON(nil, "ledgers", func(*struct{}) { ledgers++ })
+
+	fixtures := filepath.Join(t.TempDir(), "fixtures.json")
+	if err = rec.Save(fixtures); err != nil {
+		t.Fatal(err)
+	}
+	fxs, err := stctest.LoadFixtures(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := stctest.NewReplayServer(fxs)
+	defer replay.Close()
+	os.Remove(fixtures)
+
+	net := &StellarNet{Name: "replay", NetworkId: real.NetworkId,
+		Horizon: replay.URL + "/"}
+	if ae2, err := net.GetAccountEntry(acct); err != nil {
+		t.Error(err)
+	} else if ae2.Sequence != ae.Sequence {
+		t.Errorf("replayed wrong sequence number %d", ae2.Sequence)
+	}
+	if _, err = net.Post(testPayment(net, sk, ae.NextSeq())); err != nil {
+		t.Error(err)
+	}
+	n := 0
+	if err = net.IterateJSON(nil, "ledgers",
+		func(*struct{}) { n++ }); err != nil || n != ledgers {
+		t.Errorf("replayed %d of %d ledgers (err %v)", n, ledgers, err)
+	}
+	var p *HorizonProblem
+	if _, err = net.GetFeeStats(); !errors.As(err, &p) || p.Status != 404 {
+		t.Errorf("unrecorded request returned %v", err)
+	}
+}
+
+type testRecord struct {
+	Net   *StellarNet `json:"-"`
+	Value int
+}
+
+func TestPager(t *testing.T) {
+	const total = 7
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var cursor, limit int
+			fmt.Sscan(r.FormValue("cursor"), &cursor)
+			fmt.Sscan(r.FormValue("limit"), &limit)
+			var recs []string
+			for i := cursor + 1; i <= total && len(recs) < limit; i++ {
+				recs = append(recs, fmt.Sprintf(
+					`{"paging_token": "%d", "value": %d}`, i, i*i))
+			}
+			fmt.Fprintf(w, `{"_links": {"next": {"href": "http://%s%s?cursor=%d&limit=%d"}}, "_embedded": {"records": [%s]}}`,
+				r.Host, r.URL.Path, cursor+len(recs), limit,
+				strings.Join(recs, ","))
+		}))
+	defer srv.Close()
+
+	net := &StellarNet{Name: "custom", Horizon: srv.URL + "/"}
+	n := 2
+	err := Iterate(context.Background(), net, "records",
+		&PageOptions{Cursor: "1", PageSize: 2},
+		func(r *testRecord, token string) error {
+			if token != fmt.Sprint(n) || r.Value != n*n || r.Net != net {
+				t.Errorf("bad record %d: token %s value %d", n, token, r.Value)
+			}
+			n++
+			return nil
+		})
+	if err != nil {
+		t.Error(err)
+	} else if n != total+1 {
+		t.Errorf("iterated through %d records instead of %d", n-2, total-1)
+	}
+
+	p := NewPager[testRecord](net, "records", &PageOptions{PageSize: 3, Max: 4})
+	n = 0
+	for p.Next(nil) {
+		n++
+	}
+	if p.Err() != nil || n != 4 {
+		t.Errorf("Pager returned %d records (err %v) instead of 4", n, p.Err())
+	}
+}
+
+func TestHorizonAccountEntry(t *testing.T) {
+	acct := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public().String()
+	other := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public().String()
+	issuer := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public().String()
+	pool := strings.Repeat("ab", 32)
+	js := fmt.Sprintf(`{
+  "account_id": "%[1]s",
+  "sequence": "4294967300",
+  "seq_ledger": 7,
+  "seq_time": "1650000000",
+  "subentry_count": 3,
+  "num_sponsoring": 1,
+  "num_sponsored": 2,
+  "sponsor": "%[2]s",
+  "last_modified_ledger": 7,
+  "last_modified_time": "2022-04-15T05:20:00Z",
+  "thresholds": {"low_threshold": 1, "med_threshold": 2, "high_threshold": 3},
+  "flags": {"auth_required": true, "auth_clawback_enabled": true},
+  "balances": [
+    {"balance": "5.0000000", "limit": "100.0000000",
+     "buying_liabilities": "1.0000000", "selling_liabilities": "0.0000000",
+     "is_authorized": true, "is_clawback_enabled": true,
+     "sponsor": "%[2]s", "last_modified_ledger": 6,
+     "asset_type": "credit_alphanum4", "asset_code": "USD",
+     "asset_issuer": "%[3]s"},
+    {"balance": "2.0000000", "limit": "922337203685.4775807",
+     "is_authorized": true, "last_modified_ledger": 6,
+     "asset_type": "liquidity_pool_shares", "liquidity_pool_id": "%[4]s"},
+    {"balance": "10.0000000", "buying_liabilities": "0.0000000",
+     "selling_liabilities": "0.5000000", "asset_type": "native"}
+  ],
+  "signers": [
+    {"key": "%[2]s", "weight": 1, "type": "ed25519_public_key",
+     "sponsor": "%[2]s"},
+    {"key": "%[1]s", "weight": 5, "type": "ed25519_public_key"}
+  ],
+  "data": {}
+}`, acct, other, issuer, pool)
+
+	var ae HorizonAccountEntry
+	if err := json.Unmarshal([]byte(js), &ae); err != nil {
+		t.Fatal(err)
+	}
+	if ae.Balance != 100000000 || ae.Selling_liabilities != 5000000 ||
+		len(ae.Balances) != 1 || len(ae.Pool_shares) != 1 ||
+		!ae.Balances[0].Is_authorized || ae.Balances[0].Sponsor == nil ||
+		ae.Pool_shares[0].Balance != 20000000 ||
+		ae.Signers[0].Sponsor == nil || ae.Num_sponsored != 2 ||
+		ae.Seq_time != 1650000000 || ae.Last_modified_time == nil ||
+		!ae.Flags.Auth_clawback_enabled {
+		t.Errorf("bad account entry\n%s", &ae)
+	}
+	if s := ae.String(); !strings.Contains(s, pool) ||
+		!strings.Contains(s, "Num_sponsored: 2") {
+		t.Errorf("String missing fields\n%s", s)
+	}
+
+	var net StellarNet
+	e := ae.ToAccountEntry()
+	if e.AccountID.String() != acct || e.SeqNum != 4294967300 ||
+		e.Thresholds != (stx.Thresholds{5, 1, 2, 3}) ||
+		e.Flags != uint32(stx.AUTH_REQUIRED_FLAG|
+			stx.AUTH_CLAWBACK_ENABLED_FLAG) ||
+		len(e.Signers) != 1 || e.Signers[0].Key.String() != other ||
+		e.Ext.V != 1 || e.Ext.V1().Liabilities.Selling != 5000000 ||
+		e.Ext.V1().Ext.V != 2 {
+		t.Fatalf("bad AccountEntry\n%s", net.ToRep(e))
+	}
+	v2 := e.Ext.V1().Ext.V2()
+	if v2.NumSponsored != 2 || len(v2.SignerSponsoringIDs) != 1 ||
+		v2.SignerSponsoringIDs[0].String() != other || v2.Ext.V != 3 ||
+		v2.Ext.V3().SeqLedger != 7 || v2.Ext.V3().SeqTime != 1650000000 {
+		t.Errorf("bad AccountEntry extensions\n%s",
+			net.ToRep(e))
+	}
+
+	tls := ae.ToTrustLineEntries()
+	if len(tls) != 2 {
+		t.Fatalf("expected 2 trustlines, got %d", len(tls))
+	}
+	if tls[0].Asset.String() != "USD:"+issuer ||
+		tls[0].Balance != 50000000 || tls[0].Limit != 1000000000 ||
+		tls[0].Flags != uint32(stx.AUTHORIZED_FLAG|
+			stx.TRUSTLINE_CLAWBACK_ENABLED_FLAG) ||
+		tls[0].Ext.V != 1 || tls[0].Ext.V1().Liabilities.Buying != 10000000 {
+		t.Errorf("bad trustline\n%s", net.ToRep(&tls[0]))
+	}
+	if tls[1].Asset.String() != pool+":lp" || tls[1].Limit != MaxInt64 ||
+		tls[1].Flags != uint32(stx.AUTHORIZED_FLAG) {
+		t.Errorf("bad pool share trustline\n%s",
+			net.ToRep(&tls[1]))
+	}
+}
+
+func TestDex(t *testing.T) {
+	net, srv := stctest.NewFakeHorizon()
+	defer srv.Close()
+	seller := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public().String()
+	issuerKey := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public()
+	issuer := issuerKey.String()
+	usd := MkAsset(issuerKey, "USD")
+
+	srv.Fake.AddRecord("accounts/"+seller+"/offers", json.RawMessage(
+		fmt.Sprintf(`{
+  "id": "42", "paging_token": "42", "seller": %q,
+  "selling": {"asset_type": "credit_alphanum4", "asset_code": "USD",
+              "asset_issuer": %q},
+  "buying": {"asset_type": "native"},
+  "amount": "12.5000000", "price_r": {"n": 1, "d": 4}, "price": "0.2500000",
+  "last_modified_ledger": 9
+}`, seller, issuer)))
+	var offers []*HorizonOffer
+	err := Iterate(context.Background(), net, "accounts/"+seller+"/offers",
+		nil, func(o *HorizonOffer, _ string) error {
+			offers = append(offers, o)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(offers) != 1 {
+		t.Fatalf("expected 1 offer, got %d", len(offers))
+	}
+	if o := offers[0]; o.Id != 42 || o.Seller.String() != seller ||
+		o.Selling.String() != usd.String() ||
+		o.Buying.Type != stx.ASSET_TYPE_NATIVE || o.Amount != 125000000 ||
+		o.Price != (stx.Price{N: 1, D: 4}) {
+		t.Errorf("bad offer\n%s", o)
+	} else if !strings.Contains(o.String(), "Price: 1/4 (0.25)") {
+		t.Errorf("bad offer rendering\n%s", o)
+	}
+
+	var trade HorizonTrade
+	if err := json.Unmarshal([]byte(fmt.Sprintf(`{
+  "id": "1-0", "paging_token": "1-0",
+  "ledger_close_time": "2022-04-15T05:20:00Z", "trade_type": "orderbook",
+  "base_offer_id": "42", "base_account": %q, "base_amount": "4.0000000",
+  "base_asset_type": "credit_alphanum4", "base_asset_code": "USD",
+  "base_asset_issuer": %q,
+  "counter_liquidity_pool_id": "abcd", "counter_amount": "1.0000000",
+  "counter_asset_type": "native", "base_is_seller": true,
+  "price": {"n": "6000000000", "d": "24000000000"}
+}`, seller, issuer)), &trade); err != nil {
+		t.Fatal(err)
+	} else if trade.Base_asset.String() != usd.String() ||
+		trade.Counter_asset.Type != stx.ASSET_TYPE_NATIVE ||
+		trade.Base_account == nil || trade.Counter_account != nil ||
+		trade.Price != (stx.Price{N: 1, D: 4}) {
+		t.Errorf("bad trade\n%s", &trade)
+	}
+	for price, want := range map[string]stx.Price{
+		`{"n": "1099511627776", "d": "1"}`: {N: math.MaxInt32, D: 1},
+		`{"n": "1", "d": "1099511627776"}`: {N: 1, D: math.MaxInt32},
+		`{"n": "4294967297", "d": "4294967296"}`: {N: 1, D: 1},
+		`{"n": "7000000001", "d": "3000000000"}`: {N: 7, D: 3},
+	} {
+		var tr HorizonTrade
+		if err := json.Unmarshal([]byte(`{"base_asset_type": "native",
+  "counter_asset_type": "native", "price": `+price+`}`),
+			&tr); err != nil {
+			t.Error(err)
+		} else if tr.Price != want {
+			t.Errorf("price %s approximated as %d/%d", price,
+				tr.Price.N, tr.Price.D)
+		}
+	}
+
+	hsrv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/order_book" ||
+				r.FormValue("selling_asset_code") != "USD" ||
+				r.FormValue("buying_asset_type") != "native" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, `{
+  "bids": [{"price_r": {"n": 1, "d": 5}, "price": "0.2", "amount": "3.0"}],
+  "asks": [{"price_r": {"n": 1, "d": 4}, "price": "0.25", "amount": "12.5"}],
+  "base": {"asset_type": "credit_alphanum4", "asset_code": "USD",
+           "asset_issuer": %q},
+  "counter": {"asset_type": "native"}
+}`, issuer)
+		}))
+	defer hsrv.Close()
+	net.Horizon = hsrv.URL + "/"
+	var native stx.Asset
+	ob, err := net.GetOrderBook(context.Background(), &usd, &native, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if ob.Base.String() != usd.String() || len(ob.Bids) != 1 ||
+		len(ob.Asks) != 1 || ob.Bids[0].Price != (stx.Price{N: 1, D: 5}) ||
+		ob.Asks[0].Amount != 125000000 {
+		t.Errorf("bad order book\n%s", ob)
+	}
+}
+
+func TestPathPayment(t *testing.T) {
+	net, fake := stctest.NewFakeNet()
+	issuerKey := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public()
+	usd := MkAsset(issuerKey, "USD")
+	eur := MkAsset(issuerKey, "EUR")
+	var native stx.Asset
+	var dest stx.MuxedAccount
+	fmt.Sscan(NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public().String(),
+		&dest)
+
+	path := func(src, dst string, hops ...string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{
+  "source_asset_type": "native", "source_amount": %q,
+  "destination_asset_type": "credit_alphanum4",
+  "destination_asset_code": "EUR", "destination_asset_issuer": %q,
+  "destination_amount": %q, "path": [%s]}`, src, issuerKey.String(), dst,
+			strings.Join(hops, ",")))
+	}
+	usdHop := fmt.Sprintf(`{"asset_type": "credit_alphanum4",
+  "asset_code": "USD", "asset_issuer": %q}`, issuerKey.String())
+
+	ctx := context.Background()
+	if _, err := net.FindPathPaymentStrictSend(ctx, &native, 100000000,
+		&dest, &eur, 100); err != ErrNoPath {
+		t.Errorf("expected ErrNoPath, got %v", err)
+	}
+
+	fake.AddRecord("paths/strict-send", path("10", "9.0"))
+	fake.AddRecord("paths/strict-send", path("10", "10.0", usdHop))
+	ps, err := net.FindPathPaymentStrictSend(ctx, &native, 100000000,
+		&dest, &eur, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if ps.DestMin != 99000000 || len(ps.Path) != 1 ||
+		ps.Path[0].String() != usd.String() || ps.SendAmount != 100000000 {
+		t.Errorf("bad strict send payment %+v", ps)
+	}
+
+	fake.AddRecord("paths/strict-receive", path("3.0000001", "10", usdHop))
+	fake.AddRecord("paths/strict-receive", path("2.9", "10"))
+	pr, err := net.FindPathPaymentStrictReceive(ctx, &native, &dest, &eur,
+		100000000, 50)
+	if err != nil {
+		t.Fatal(err)
+	} else if pr.SendMax != 29145000 || len(pr.Path) != 0 ||
+		pr.DestAmount != 100000000 {
+		t.Errorf("bad strict receive payment %+v", pr)
+	}
+
+	txe := NewTransactionEnvelope()
+	txe.Append(nil, ps)
+	txe.Append(nil, pr)
+	if ops := *txe.Operations(); len(ops) != 2 ||
+		ops[0].Body.Type != stx.PATH_PAYMENT_STRICT_SEND ||
+		ops[1].Body.PathPaymentStrictReceiveOp().SendMax != 29145000 {
+		t.Errorf("bad transaction\n%s", net.TxToRep(txe))
+	}
+}
+
+func TestClaimableBalances(t *testing.T) {
+	net, fake := stctest.NewFakeNet()
+	me := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public()
+	other := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public()
+	var id stx.ClaimableBalanceID
+	id.V0()[0] = 0xab
+	idhex := fmt.Sprintf("%x", stcdetail.XdrToBin(&id))
+	fake.AddRecord("claimable_balances", json.RawMessage(fmt.Sprintf(`{
+  "id": %q, "asset": "native", "amount": "7.5000000",
+  "last_modified_time": "2022-01-01T00:00:00Z",
+  "claimants": [
+    {"destination": %q, "predicate": {"unconditional": true}},
+    {"destination": %q, "predicate": {"and": [
+      {"not": {"abs_before": "2022-01-02T00:00:00Z",
+               "abs_before_epoch": "1641081600"}},
+      {"or": [{"rel_before": "172800"},
+              {"abs_before": "2022-01-02T12:00:00Z"}]}]}}
+  ],
+  "flags": {"clawback_enabled": true}
+}`, idhex, other.String(), me.String())))
+
+	cbs, err := net.GetClaimableBalances(context.Background(), me.String())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(cbs) != 1 {
+		t.Fatalf("expected 1 claimable balance, got %d", len(cbs))
+	}
+	cb := &cbs[0]
+	if cb.Amount != 75000000 || cb.Asset.Type != stx.ASSET_TYPE_NATIVE ||
+		cb.Id.V0()[0] != 0xab || len(cb.Claimants) != 2 ||
+		!cb.Flags.Clawback_enabled {
+		t.Errorf("bad claimable balance\n%s", cb)
+	}
+	if s := cb.String(); !strings.Contains(s, idhex) ||
+		!strings.Contains(s, "(not before 1641081600") {
+		t.Errorf("bad claimable balance rendering\n%s", s)
+	}
+
+	day := func(d, h int) time.Time {
+		return time.Date(2022, 1, d, h, 0, 0, 0, time.UTC)
+	}
+	for _, c := range []struct {
+		when time.Time
+		ok   bool
+	}{{day(1, 12), false}, {day(2, 6), true}, {day(2, 23), true},
+		{day(3, 1), false}} {
+		if cb.ClaimableBy(&me, c.when) != c.ok {
+			t.Errorf("ClaimableBy(me, %s) != %v", c.when, c.ok)
+		}
+		if !cb.ClaimableBy(&other, c.when) {
+			t.Errorf("unconditional ClaimableBy(other, %s) false", c.when)
+		}
+	}
+}
+
+func TestLiquidityPool(t *testing.T) {
+	net, fake := stctest.NewFakeNet()
+	issuer := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public()
+	usd := MkAsset(issuer, "USD")
+	var native stx.Asset
+	params := LiquidityPoolParameters(&usd, &native,
+		stx.LIQUIDITY_POOL_FEE_V18)
+	if params.ConstantProduct().AssetA.Type != stx.ASSET_TYPE_NATIVE {
+		t.Errorf("pool assets not sorted")
+	} else if params2 := LiquidityPoolParameters(&native, &usd,
+		stx.LIQUIDITY_POOL_FEE_V18); LiquidityPoolID(&params) !=
+		LiquidityPoolID(&params2) {
+		t.Errorf("pool ID depends on asset order")
+	}
+	id := LiquidityPoolID(&params)
+	fake.AddRecord("liquidity_pools", json.RawMessage(fmt.Sprintf(`{
+  "id": "%x", "fee_bp": 30, "type": "constant_product",
+  "total_trustlines": "3", "total_shares": "1000.0000000",
+  "reserves": [{"asset": "native", "amount": "2000.0000000"},
+               {"asset": %q, "amount": "500.0000000"}]
+}`, id[:], usd.String())))
+
+	var lp *HorizonLiquidityPool
+	err := Iterate(context.Background(), net,
+		LiquidityPoolsQuery(native, usd), nil,
+		func(p *HorizonLiquidityPool, _ string) error {
+			lp = p
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	} else if lp == nil || lp.Id != id || lp.Total_shares != 10000000000 ||
+		len(lp.Reserves) != 2 || lp.Reserves[1].Asset.String() !=
+		usd.String() {
+		t.Fatalf("bad liquidity pool\n%s", lp)
+	}
+	if p, err := lp.Parameters(); err != nil ||
+		LiquidityPoolID(p) != id {
+		t.Errorf("Parameters do not match pool ID")
+	}
+
+	a, b, shares, err := lp.ExpectedDeposit(100e7, 100e7)
+	if err != nil || a != 100e7 || b != 25e7 || shares != 50e7 {
+		t.Errorf("ExpectedDeposit = %d, %d, %d, %v", a, b, shares, err)
+	}
+	dep, err := lp.DepositOp(100e7, 100e7, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if dep.MinPrice != (stx.Price{N: 99, D: 25}) ||
+		dep.MaxPrice != (stx.Price{N: 101, D: 25}) {
+		t.Errorf("bad deposit price bounds %v, %v", dep.MinPrice,
+			dep.MaxPrice)
+	}
+	if a, b, err = lp.ExpectedWithdraw(10e7); err != nil ||
+		a != 20e7 || b != 5e7 {
+		t.Errorf("ExpectedWithdraw = %d, %d, %v", a, b, err)
+	}
+	wd, err := lp.WithdrawOp(10e7, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if wd.MinAmountA != 198000000 || wd.MinAmountB != 49500000 {
+		t.Errorf("bad withdraw minimums %d, %d", wd.MinAmountA,
+			wd.MinAmountB)
+	}
+	if _, _, err = lp.ExpectedWithdraw(2000e7); err == nil {
+		t.Errorf("withdrawing more than total shares should fail")
+	}
+}
+
+func TestOperationsAndEffects(t *testing.T) {
+	net, fake := stctest.NewFakeNet()
+	sk := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	acct := sk.Public().String()
+	txe := NewTransactionEnvelope()
+	txe.SetSourceAccount(sk.Public())
+	txe.Append(nil, SetOptions{})
+	txe.Append(nil, BumpSequence{BumpTo: 99})
+	fake.AddRecord("accounts/"+acct+"/operations", json.RawMessage(
+		fmt.Sprintf(`{
+  "id": "12884905986", "paging_token": "12884905986",
+  "transaction_successful": true, "source_account": %q,
+  "type": "bump_sequence", "type_i": 11,
+  "created_at": "2022-01-01T00:00:00Z", "transaction_hash": "ab",
+  "transaction": {"envelope_xdr": %q}
+}`, acct, stcdetail.XdrToBase64(txe))))
+	fake.AddRecord("accounts/"+acct+"/effects", json.RawMessage(
+		fmt.Sprintf(`{
+  "id": "0012884905986-0000000001", "paging_token": "12884905986-1",
+  "account": %q, "type": "account_credited", "type_i": 2,
+  "created_at": "2022-01-01T00:00:00Z", "amount": "1.5000000",
+  "asset_type": "native"
+}`, acct)))
+	fake.AddRecord("accounts/"+acct+"/effects", json.RawMessage(
+		fmt.Sprintf(`{
+  "id": "0012884905986-0000000002", "paging_token": "12884905986-2",
+  "account": %q, "type": "trustline_created", "type_i": 20,
+  "created_at": "2022-01-01T00:00:00Z", "limit": "922337203685.4775807",
+  "asset_type": "liquidity_pool_shares", "liquidity_pool_id": "abcd"
+}`, acct)))
+
+	ctx := context.Background()
+	var ops []*HorizonOperation
+	if err := Iterate(ctx, net, OperationsQuery(acct), nil,
+		func(op *HorizonOperation, _ string) error {
+			ops = append(ops, op)
+			return nil
+		}); err != nil {
+		t.Fatal(err)
+	} else if len(ops) != 1 {
+		t.Fatalf("expected 1 operation, got %d", len(ops))
+	} else if ops[0].Operation.Body.Type != stx.BUMP_SEQUENCE ||
+		ops[0].Operation.Body.BumpSequenceOp().BumpTo != 99 {
+		t.Errorf("operation not decoded from envelope\n%s", ops[0])
+	}
+
+	var efs []*HorizonEffect
+	if err := Iterate(ctx, net, EffectsQuery(acct), nil,
+		func(ef *HorizonEffect, _ string) error {
+			efs = append(efs, ef)
+			return nil
+		}); err != nil {
+		t.Fatal(err)
+	} else if len(efs) != 2 {
+		t.Fatalf("expected 2 effects, got %d", len(efs))
+	} else if efs[0].Amount != 15000000 || efs[0].Asset == nil ||
+		efs[0].Asset.Type != stx.ASSET_TYPE_NATIVE ||
+		len(efs[0].Details) != 0 {
+		t.Errorf("bad account_credited effect\n%s", efs[0])
+	} else if efs[1].Asset != nil ||
+		efs[1].Details["asset_type"] != "liquidity_pool_shares" ||
+		efs[1].Details["limit"] != "922337203685.4775807" {
+		t.Errorf("bad trustline_created effect\n%s", efs[1])
+	}
+
+	if q := PaymentsQuery(acct); q != "accounts/"+acct+
+		"/payments?join=transactions" {
+		t.Errorf("bad payments query %q", q)
+	}
+	if q := OperationsQuery("12345"); !strings.HasPrefix(q, "ledgers/") {
+		t.Errorf("bad ledger query %q", q)
+	} else if q = EffectsQuery(strings.Repeat("ab", 32)); !strings.HasPrefix(
+		q, "transactions/") {
+		t.Errorf("bad transaction query %q", q)
+	}
+}
+
+func TestLedgerBySeq(t *testing.T) {
+	net, srv := stctest.NewFakeHorizon()
+	defer srv.Close()
+	lh, _ := net.GetLedgerHeader()
+	for i := 0; i < 4; i++ {
+		lh.LedgerSeq++
+		lh.BaseFee = stx.Uint32(100 * lh.LedgerSeq)
+		srv.Fake.SetLedgerHeader(lh)
+	}
+
+	if lh, err := net.GetLedgerHeaderBySeq(3); err != nil {
+		t.Fatal(err)
+	} else if lh.LedgerSeq != 3 || lh.BaseFee != 300 {
+		t.Errorf("got wrong ledger %d (base fee %d)", lh.LedgerSeq,
+			lh.BaseFee)
+	}
+	var p *HorizonProblem
+	if _, err := net.GetLedgerHeaderBySeq(9); !errors.As(err, &p) ||
+		p.Status != 404 {
+		t.Errorf("nonexistent ledger returned %v", err)
+	}
+
+	var seqs []uint32
+	if err := net.IterateLedgers(nil, 2, 4,
+		func(l *HorizonLedger) error {
+			seqs = append(seqs, l.Sequence)
+			return nil
+		}); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(seqs) != "[2 3 4]" {
+		t.Errorf("IterateLedgers(2, 4) returned %v", seqs)
+	}
+}
+
+func TestEndpointFailover(t *testing.T) {
+	hits := map[string]int{}
+	var mu sync.Mutex
+	server := func(name, passphrase string, delay time.Duration,
+		healthy bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/" {
+					time.Sleep(delay)
+					fmt.Fprintf(w, `{"network_passphrase": %q}`, passphrase)
+					return
+				}
+				mu.Lock()
+				hits[name]++
+				mu.Unlock()
+				if !healthy {
+					w.WriteHeader(503)
+					return
+				}
+				fmt.Fprintf(w, `{"server": %q}`, name)
+			}))
+	}
+	count := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[name]
+	}
+	a := server("a", "Test", 0, false)
+	defer a.Close()
+	b := server("b", "Test", 20*time.Millisecond, true)
+	defer b.Close()
+	c := server("c", "Other", 0, true)
+	defer c.Close()
+
+	net := &StellarNet{
+		NetworkId:   "Test",
+		HorizonURLs: []string{a.URL + "/", c.URL + "/", b.URL + "/"},
+		Retry:       &RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond},
+	}
+	status := net.CheckEndpoints(context.Background())
+	var wn *ErrWrongNetwork
+	if len(status) != 3 || status[0].Err != nil || status[2].Err != nil {
+		t.Errorf("bad endpoint status %v", status)
+	} else if !errors.As(status[1].Err, &wn) || wn.Got != "Other" {
+		t.Errorf("wrong network not detected: %v", status[1].Err)
+	}
+
+	var reply struct{ Server string }
+	if err := net.GetJSON("accounts/x", &reply); err != nil {
+		t.Fatal(err)
+	} else if reply.Server != "b" {
+		t.Errorf("request served by %q instead of b", reply.Server)
+	}
+	if na, nc := count("a"), count("c"); na != 1 || nc != 0 {
+		t.Errorf("unexpected requests a=%d c=%d", na, nc)
+	}
+	if err := net.GetJSON("accounts/y", &reply); err != nil {
+		t.Fatal(err)
+	} else if na := count("a"); na != 1 {
+		t.Errorf("request retried failed server %d times", na)
+	}
+}
+
+func TestRPCEndpointCheck(t *testing.T) {
+	server := func(passphrase string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" {
+					fmt.Fprintf(w, `{"network_passphrase": %q}`, passphrase)
+					return
+				}
+				fmt.Fprintf(w, `{"jsonrpc": "2.0", "id": 1,`+
+					` "result": {"passphrase": %q}}`, passphrase)
+			}))
+	}
+	horizon := server("Test")
+	defer horizon.Close()
+	wrong := server("Other")
+	defer wrong.Close()
+	right := server("Test")
+	defer right.Close()
+
+	net := &StellarNet{
+		NetworkId: "Test",
+		Horizon:   horizon.URL + "/",
+		RPCURLs:   []string{wrong.URL, right.URL},
+	}
+	if c := net.RPCClient(); c == nil || c.URL != right.URL {
+		t.Errorf("wrong-network RPC server not avoided: %+v", c)
+	}
+}
+
+func TestStalledEndpoint(t *testing.T) {
+	hits := map[string]int{}
+	var mu sync.Mutex
+	server := func(name string, delay time.Duration,
+		status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/" {
+					time.Sleep(delay)
+					fmt.Fprint(w, `{"network_passphrase": "Test"}`)
+					return
+				}
+				mu.Lock()
+				hits[name]++
+				mu.Unlock()
+				switch status {
+				case 0:
+					<-r.Context().Done()
+				case 200:
+					fmt.Fprintf(w, `{"server": %q}`, name)
+				default:
+					w.WriteHeader(status)
+				}
+			}))
+	}
+	count := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[name]
+	}
+	hung := server("hung", 0, 0)
+	defer hung.Close()
+	gw := server("gateway", 10*time.Millisecond, 502)
+	defer gw.Close()
+	ok := server("ok", 30*time.Millisecond, 200)
+	defer ok.Close()
+
+	net := &StellarNet{
+		NetworkId:   "Test",
+		HorizonURLs: []string{hung.URL + "/", gw.URL + "/", ok.URL + "/"},
+		Timeout:     100 * time.Millisecond,
+		Retry:       &RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond},
+	}
+	net.CheckEndpoints(context.Background())
+	var reply struct{ Server string }
+	if err := net.GetJSON("accounts/x", &reply); err != nil {
+		t.Fatal(err)
+	} else if reply.Server != "ok" {
+		t.Errorf("request served by %q instead of ok", reply.Server)
+	}
+	if nh, ng := count("hung"), count("gateway"); nh != 1 || ng != 1 {
+		t.Errorf("unexpected requests hung=%d gateway=%d", nh, ng)
+	}
+
+	single := &StellarNet{
+		NetworkId: "Test",
+		Horizon:   hung.URL + "/",
+		Timeout:   50 * time.Millisecond,
+		Retry:     &RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond},
+	}
+	if err := single.GetJSON("accounts/x", &reply); err == nil {
+		t.Error("stalled server did not time out")
+	} else if nh := count("hung"); nh != 2 {
+		t.Errorf("stalled lone server retried (%d requests)", nh)
+	}
+}
+
+func TestAccountCache(t *testing.T) {
+	net, fake := stctest.NewFakeNet()
+	sk := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	acct := sk.Public().String()
+	fake.Fund(acct, 100*10000000)
+	orig, _ := net.GetAccountEntry(acct)
+	orig.Balances = []HorizonBalance{{
+		Asset:   MkAsset(sk.Public(), "USD"),
+		Balance: 20000000,
+		Limit:   50000000,
+	}}
+	fake.SetAccount(acct, orig)
+
+	path := filepath.Join(t.TempDir(), "test.accounts")
+	net.AccountCache = NewAccountCache(time.Hour, path)
+	ae, err := net.GetAccountEntry(acct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := *ae
+	changed.Balance = 50000000
+	fake.SetAccount(acct, &changed)
+	if ae2, err := net.GetAccountEntry(acct); err != nil {
+		t.Error(err)
+	} else if ae2.Balance != ae.Balance {
+		t.Errorf("cached entry not used")
+	}
+
+	ae2, _ := net.GetAccountEntry(acct)
+	ae2.Balances[0].Balance = 0
+	ae2.Signers = append(ae2.Signers[:0], HorizonSigner{Weight: 9})
+	if ae3, _ := net.GetAccountEntry(acct); ae3.String() != ae.String() {
+		t.Errorf("modifying returned entry changed cache to %s", ae3)
+	}
+
+	if NewAccountCache(time.Hour, path).Get(acct) != nil {
+		t.Error("cache saved before Save")
+	} else if err = net.Save(); err != nil {
+		t.Error(err)
+	}
+	saved := NewAccountCache(time.Hour, path).Get(acct)
+	if saved == nil {
+		t.Error("cache not saved")
+	} else if saved.String() != ae.String() {
+		t.Errorf("saved %s instead of %s", saved, ae)
+	}
+
+	if _, err = net.Post(testPayment(net, sk, ae.NextSeq())); err != nil {
+		t.Fatal(err)
+	}
+	if ae2, err := net.GetAccountEntry(acct); err != nil {
+		t.Error(err)
+	} else if ae2.Balance != changed.Balance {
+		t.Errorf("Post did not invalidate cached entry")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-RateLimit-Limit", "100")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", "1")
+			fmt.Fprint(w, "{}")
+		}))
+	defer srv.Close()
+	net := &StellarNet{Horizon: srv.URL + "/"}
+	if net.RateLimit() != nil {
+		t.Error("rate limit known before first request")
+	}
+	if _, err := net.Get("ledgers"); err != nil {
+		t.Fatal(err)
+	}
+	if rl := net.RateLimit(); rl == nil || rl.Limit != 100 ||
+		rl.Remaining != 0 || time.Until(rl.Reset) > time.Second {
+		t.Errorf("bad rate limit %+v", rl)
+	}
+	start := time.Now()
+	if _, err := net.Get("ledgers"); err != nil {
+		t.Fatal(err)
+	} else if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("exhausted quota did not delay request (%s)", d)
+	}
+}
+
+func TestRateLimitPerServer(t *testing.T) {
+	server := func(name string, delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/" {
+					time.Sleep(delay)
+					fmt.Fprint(w, `{"network_passphrase": "Test"}`)
+					return
+				}
+				if name == "exhausted" {
+					w.Header().Set("X-RateLimit-Limit", "100")
+					w.Header().Set("X-RateLimit-Remaining", "0")
+					w.Header().Set("X-RateLimit-Reset", "5")
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				fmt.Fprintf(w, `{"server": %q}`, name)
+			}))
+	}
+	exhausted := server("exhausted", 0)
+	defer exhausted.Close()
+	ok := server("ok", 30*time.Millisecond)
+	defer ok.Close()
+
+	net := &StellarNet{
+		NetworkId:   "Test",
+		HorizonURLs: []string{exhausted.URL + "/", ok.URL + "/"},
+		Retry:       &RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond},
+	}
+	net.CheckEndpoints(context.Background())
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		var reply struct{ Server string }
+		if err := net.GetJSON("accounts/x", &reply); err != nil {
+			t.Fatal(err)
+		} else if reply.Server != "ok" {
+			t.Errorf("request served by %q instead of ok", reply.Server)
+		}
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("one server's quota throttled another (%s)", d)
+	}
+}
+
+func TestStreamForever(t *testing.T) {
+	_, srv := stctest.NewFakeHorizon()
+	defer srv.Close()
+	// Put a front end that can fail requests in front of the server
+	var mu sync.Mutex
+	status := 0
+	front := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			st := status
+			mu.Unlock()
+			if st != 0 {
+				w.WriteHeader(st)
+				return
+			}
+			srv.ServeHTTP(w, r)
+		}))
+	defer front.Close()
+	setStatus := func(st int) {
+		mu.Lock()
+		status = st
+		mu.Unlock()
+	}
+	net := srv.StellarNet()
+	net.Horizon = front.URL + "/"
+	net.Retry = &RetryPolicy{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	}
+	type rec struct{ N int }
+	add := func(n int) { srv.Fake.AddRecord("things", rec{n}) }
+	add(1)
+	add(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	got := make(chan int)
+	dropped := make(chan error, 1)
+	done := make(chan error)
+	go func() {
+		done <- StreamForever(ctx, net, "things",
+			&PageOptions{Cursor: "0"},
+			func(r *rec, _ string) error {
+				got <- r.N
+				return nil
+			}, func(err error, _ time.Duration) {
+				select {
+				case dropped <- err:
+				default:
+				}
+			})
+	}()
+	expect := func(n int) {
+		t.Helper()
+		select {
+		case m := <-got:
+			if m != n {
+				t.Fatalf("received record %d instead of %d", m, n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for record %d", n)
+		}
+	}
+	expect(1)
+	expect(2)
+	setStatus(http.StatusServiceUnavailable)
+	front.CloseClientConnections()
+	select {
+	case <-dropped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dropped stream not reported")
+	}
+	add(3)
+	setStatus(0)
+	expect(3)
+	add(4)
+	expect(4)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("StreamForever returned %v after cancel", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, reconnects := 0, 0
+	err := StreamForever(ctx, net, "things",
+		&PageOptions{Cursor: "0", Max: 2},
+		func(r *rec, _ string) error {
+			n++
+			return nil
+		}, func(error, time.Duration) { reconnects++ })
+	if err != nil || n != 2 || reconnects != 0 {
+		t.Errorf("Max 2 returned %v after %d records and %d reconnects",
+			err, n, reconnects)
+	}
+
+	setStatus(http.StatusNotFound)
+	err = StreamForever(context.Background(), net, "things", nil,
+		func(r *rec, _ string) error { return nil }, nil)
+	var hp *HorizonProblem
+	if !errors.As(err, &hp) || hp.Status != http.StatusNotFound {
+		t.Errorf("StreamForever retried %v", err)
+	}
+}
+
+func TestAccountingEntries(t *testing.T) {
+	net, _ := stctest.NewFakeNet()
+	sk := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	self := sk.Public()
+	dest := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public()
+	txe := testPayment(net, sk, 1)
+	txe.V1().Tx.Operations[0].Body.PaymentOp().Destination =
+		*dest.ToMuxedAccount()
+	txe.V1().Tx.Memo = MemoText("rent")
+
+	change := func(typ stx.LedgerEntryChangeType, acct *AccountID,
+		bal int64) stx.LedgerEntryChange {
+		c := stx.LedgerEntryChange{Type: typ}
+		var e *stx.LedgerEntry
+		if typ == stx.LEDGER_ENTRY_STATE {
+			e = c.State()
+		} else {
+			e = c.Updated()
+		}
+		e.Data.Type = stx.ACCOUNT
+		e.Data.Account().AccountID = *acct
+		e.Data.Account().Balance = bal
+		return c
+	}
+	r := HorizonTxResult{Env: *txe.TransactionEnvelope, PagingToken: "1"}
+	r.FeeMeta = stx.LedgerEntryChanges{
+		change(stx.LEDGER_ENTRY_STATE, &self, 100000000),
+		change(stx.LEDGER_ENTRY_UPDATED, &self, 99999900),
+	}
+	r.ResultMeta.V = 2
+	r.ResultMeta.V2().Operations = []stx.OperationMeta{{
+		Changes: stx.LedgerEntryChanges{
+			change(stx.LEDGER_ENTRY_STATE, &self, 99999900),
+			change(stx.LEDGER_ENTRY_UPDATED, &self, 89999900),
+			change(stx.LEDGER_ENTRY_STATE, &dest, 0),
+			change(stx.LEDGER_ENTRY_UPDATED, &dest, 10000000),
+		},
+	}}
+
+	entries, err := AccountingEntries(&r, &self)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 {
+		t.Fatalf("got %d entries instead of 2", len(entries))
+	}
+	fee, pay := entries[0], entries[1]
+	if fee.OpType != "fee" || fee.OpIndex != -1 || fee.Fee != 100 ||
+		fee.Amount != -100 || fee.Balance != 99999900 {
+		t.Errorf("bad fee entry %+v", fee)
+	}
+	if pay.OpType != "payment" || pay.OpIndex != 0 ||
+		pay.Counterparty != dest.String() || pay.Asset != "native" ||
+		pay.Amount != -10000000 || pay.Balance != 89999900 ||
+		pay.Memo != "rent" || pay.PagingToken != "1" {
+		t.Errorf("bad payment entry %+v", pay)
+	}
+	if rec := fee.CSVRecord(); rec[7] != "-0.0000100" {
+		t.Errorf("fee amount formatted as %s", rec[7])
+	}
+
+	if entries, err = AccountingEntries(&r, &dest); err != nil {
+		t.Error(err)
+	} else if len(entries) != 1 || entries[0].Amount != 10000000 ||
+		entries[0].Counterparty != self.String() {
+		t.Errorf("bad entries for destination %+v", entries)
+	}
+}
+
+func TestExplainTxFailure(t *testing.T) {
+	net, fake := stctest.NewFakeNet()
+	sk := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	fake.Fund(sk.Public().String(), 100*10000000)
+	ae, err := net.GetAccountEntry(sk.Public().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txe := testPayment(net, sk, ae.NextSeq()+5)
+	_, err = net.Post(txe)
+	msg := net.ExplainError(context.Background(), txe, err)
+	if want := fmt.Sprintf("sequence number is %d, but the source"+
+		" account's next sequence number is %d", ae.NextSeq()+5,
+		ae.NextSeq()); !strings.Contains(msg, want) {
+		t.Errorf("bad sequence explained as %q", msg)
+	}
+
+	var res TransactionResult
+	res.Result.Code = stx.TxFAILED
+	*res.Result.Results() = make([]stx.OperationResult, 1)
+	opr := &(*res.Result.Results())[0]
+	opr.Code = stx.OpINNER
+	opr.Tr().Type = stx.PAYMENT
+	opr.Tr().PaymentResult().Code = stx.PAYMENT_NO_TRUST
+	fes := net.ExplainTxFailure(nil, txe, TxFailure{&res})
+	if len(fes) != 1 {
+		t.Fatalf("got %d explanations instead of 1", len(fes))
+	} else if fe := fes[0]; fe.OpIndex != 0 ||
+		fe.Op != &txe.V1().Tx.Operations[0] ||
+		fe.Code.String() != "PAYMENT_NO_TRUST" ||
+		!strings.Contains(fe.Fix, "trustline") {
+		t.Errorf("bad explanation %+v", fe)
+	}
+	msg = net.ExplainError(nil, txe, TxFailure{&res})
+	if !strings.Contains(msg, "operation 0: PAYMENT_NO_TRUST") ||
+		!strings.Contains(msg, "  operation.body.type: PAYMENT") {
+		t.Errorf("bad report %q", msg)
+	}
+
+	opr.Tr().Type = stx.CLAWBACK
+	opr.Tr().ClawbackResult().Code = stx.CLAWBACK_NO_TRUST
+	fes = net.ExplainTxFailure(nil, txe, TxFailure{&res})
+	if len(fes) != 1 || fes[0].Explanation == "" ||
+		strings.Contains(fes[0].Explanation, "destination") {
+		t.Errorf("bad CLAWBACK_NO_TRUST explanation %+v", fes)
+	}
+}
+
+func TestResubmit(t *testing.T) {
+	net, fake := stctest.NewFakeNet()
+	sk := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	acct := sk.Public().String()
+	fake.Fund(acct, 100*10000000)
+	minFee := 0
+	fake.PostHook = func(e *TransactionEnvelope) (
+		*TransactionResult, error) {
+		if (e.Type == stx.ENVELOPE_TYPE_TX &&
+			e.V1().Tx.Fee < uint32(minFee)) ||
+			(e.Type == stx.ENVELOPE_TYPE_TX_V0 &&
+				e.V0().Tx.Fee < uint32(minFee)) {
+			res := &TransactionResult{}
+			res.Result.Code = stx.TxINSUFFICIENT_FEE
+			return res, nil
+		}
+		return nil, nil
+	}
+	ae, err := net.GetAccountEntry(acct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	net.Resubmit = &ResubmitPolicy{
+		MaxResubmits: 3,
+		MaxBaseFee:   1000,
+		Keys:         []PrivateKey{sk},
+	}
+	txe := testPayment(net, sk, ae.NextSeq()+3)
+	if _, err = net.Post(txe); err != nil {
+		t.Errorf("resubmitting after bad sequence number: %s", err)
+	} else if txe.V1().Tx.SeqNum != ae.NextSeq() {
+		t.Errorf("resubmitted with sequence number %d", txe.V1().Tx.SeqNum)
+	}
+	if posted := fake.Posted(); len(posted) != 2 ||
+		posted[0].V1().Tx.SeqNum != ae.NextSeq()+3 ||
+		posted[1].V1().Tx.SeqNum != ae.NextSeq() {
+		t.Errorf("Posted did not record each attempt")
+	}
+
+	minFee = 500
+	txe = testPayment(net, sk, ae.NextSeq()+1)
+	if _, err = net.Post(txe); err != nil {
+		t.Errorf("resubmitting after insufficient fee: %s", err)
+	} else if txe.V1().Tx.Fee != 800 {
+		t.Errorf("resubmitted with fee %d instead of 800", txe.V1().Tx.Fee)
+	}
+
+	minFee, net.Resubmit.MaxResubmits = 2000, 10
+	txe = testPayment(net, sk, ae.NextSeq()+2)
+	var txf TxFailure
+	if _, err = net.Post(txe); !errors.As(err, &txf) ||
+		txf.Result.Code != stx.TxINSUFFICIENT_FEE {
+		t.Errorf("expected txINSUFFICIENT_FEE, got %v", err)
+	} else if txe.V1().Tx.Fee != 1000 {
+		t.Errorf("fee raised to %d instead of cap", txe.V1().Tx.Fee)
+	}
+
+	minFee = 500
+	payer := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	payerKey := payer.Public().ToSignerKey()
+	net.Resubmit.Keys, net.Resubmit.FeeSource = nil, &payer
+	txe = testPayment(net, sk, ae.NextSeq()+2)
+	if _, err = net.Post(txe); err != nil {
+		t.Errorf("resubmitting with fee bump: %s", err)
+	} else if txe.Type != stx.ENVELOPE_TYPE_TX_FEE_BUMP ||
+		txe.FeeBump().Tx.Fee != 400 ||
+		len(txe.FeeBump().Tx.InnerTx.V1().Signatures) != 1 ||
+		!net.VerifySig(&payerKey, txe,
+			(*txe.Signatures())[0].Signature) {
+		t.Errorf("bad fee bump %s", net.TxToRep(txe))
+	}
+
+	txe = testPayment(net, sk, ae.NextSeq()+3)
+	if err = txe.ToV0(); err != nil {
+		t.Fatal(err)
+	} else if _, err = net.Post(txe); err != nil {
+		t.Errorf("resubmitting V0 transaction with fee bump: %s", err)
+	} else if txe.Type != stx.ENVELOPE_TYPE_TX_FEE_BUMP ||
+		txe.FeeBump().Tx.Fee != 400 {
+		t.Errorf("bad V0 fee bump %s", net.TxToRep(txe))
+	}
+
+	minFee = 0
+	net.Resubmit.Keys = []PrivateKey{sk}
+	txe = testPayment(net, sk, ae.NextSeq()+5)
+	*txe.Signatures() = nil
+	if _, err = net.Post(txe); !errors.As(err, &txf) ||
+		txf.Result.Code != stx.TxBAD_SEQ {
+		t.Errorf("resubmitted unsigned transaction: %v", err)
+	}
+}
+
+func TestResubmitConfig(t *testing.T) {
+	parse := func(files ...string) *StellarNet {
+		t.Helper()
+		net := &StellarNet{}
+		sink := net.IniSink()
+		for _, f := range files {
+			if err := ini.IniParseContents(sink, "",
+				[]byte(f)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return net
+	}
+	net := parse("[net]\nresubmit-max-base-fee = 500\n",
+		"[net]\nresubmit = 3\nresubmit-max-base-fee = 900\n")
+	if rp := net.Resubmit; rp == nil || rp.MaxResubmits != 3 ||
+		rp.MaxBaseFee != 500 {
+		t.Errorf("bad resubmit policy %+v", rp)
+	}
+	if net = parse("[net]\nresubmit = 0\n",
+		"[net]\nresubmit = 3\n"); net.Resubmit != nil {
+		t.Errorf("resubmit = 0 did not disable policy %+v", net.Resubmit)
+	}
+}
+
+func TestFeePolicy(t *testing.T) {
+	var fp FeePolicy
+	if err := fp.Set("p50,max=1000,congested=2.5"); err != nil {
+		t.Fatal(err)
+	} else if s := fp.String(); s != "p50,max=1000,congested=2.5" {
+		t.Errorf("FeePolicy rendered as %q", s)
+	} else if err = fp.Set("p101"); err == nil {
+		t.Error("accepted invalid percentile")
+	}
+	for _, bad := range []string{"max=abc", "congested=x", "12x"} {
+		if err := fp.Set(bad); err == nil {
+			t.Errorf("accepted invalid setting %q", bad)
+		} else if s := fp.String(); s != "p50,max=1000,congested=2.5" {
+			t.Errorf("invalid setting %q changed policy to %q", bad, s)
+		}
+	}
+
+	fs := &FeeStats{Last_ledger_base_fee: 100}
+	fs.Offered.Percentiles = []FeePercentile{{50, 300}, {90, 700}}
+	if fee := fp.BaseFee(fs); fee != 300 {
+		t.Errorf("base fee %d instead of 300", fee)
+	}
+	fs.Ledger_capacity_usage = 0.95
+	if fee := fp.BaseFee(fs); fee != 750 {
+		t.Errorf("congested base fee %d instead of 750", fee)
+	}
+	fp.Set("p90")
+	if fee := fp.BaseFee(fs); fee != 1000 {
+		t.Errorf("base fee %d not capped at 1000", fee)
+	}
+
+	net, fake := stctest.NewFakeNet()
+	fake.SetFeeStats(fs)
+	net.FeePolicy = &FeePolicy{Fixed: 200}
+	sk := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	txe := testPayment(net, sk, 1)
+	fb := NewTransactionEnvelope()
+	fb.Type = stx.ENVELOPE_TYPE_TX_FEE_BUMP
+	fb.FeeBump().Tx.InnerTx.Type = stx.ENVELOPE_TYPE_TX
+	*fb.FeeBump().Tx.InnerTx.V1() = *txe.V1()
+	for _, e := range []*TransactionEnvelope{txe, fb} {
+		if err := net.ApplyFeePolicy(nil, e); err != nil {
+			t.Error(err)
+		}
+	}
+	if txe.V1().Tx.Fee != 200 {
+		t.Errorf("fee %d instead of 200", txe.V1().Tx.Fee)
+	} else if fb.FeeBump().Tx.Fee != 400 {
+		t.Errorf("fee-bump fee %d instead of 400", fb.FeeBump().Tx.Fee)
+	}
+}
+
+func TestNewFeeBump(t *testing.T) {
+	net, _ := stctest.NewFakeNet()
+	net.FeePolicy = &FeePolicy{Fixed: 100}
+	sk := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	payer := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	self, payerPub := sk.Public(), payer.Public()
+	selfKey, payerKey := self.ToSignerKey(), payerPub.ToSignerKey()
+	txe := testPayment(net, sk, 1)
+	txe.SetFee(300)
+	*txe.Signatures() = nil
+	net.SignTx(sk, txe)
+
+	fb := NewFeeBump(txe, &payerPub, 100)
+	if fb.FeeBump().Tx.Fee != 600 {
+		t.Errorf("fee-bump fee %d instead of 600", fb.FeeBump().Tx.Fee)
+	} else if fb.SourceAccount().String() != payerPub.String() {
+		t.Errorf("fee source %s", fb.SourceAccount())
+	}
+	inner := &TransactionEnvelope{
+		TransactionEnvelope: &stx.TransactionEnvelope{
+			Type: stx.ENVELOPE_TYPE_TX,
+		},
+	}
+	*inner.V1() = *fb.FeeBump().Tx.InnerTx.V1()
+	if sigs := *inner.Signatures(); len(sigs) != 1 ||
+		!net.VerifySig(&selfKey, inner, sigs[0].Signature) {
+		t.Error("inner signature not preserved")
+	}
+
+	if err := net.ApplyFeePolicy(nil, fb); err != nil {
+		t.Error(err)
+	} else if fb.FeeBump().Tx.Fee != 600 {
+		t.Errorf("fee policy lowered fee bump to %d", fb.FeeBump().Tx.Fee)
+	}
+	if err := net.SignTx(payer, fb); err != nil {
+		t.Fatal(err)
+	} else if len(*txe.Signatures()) != 1 || len(*fb.Signatures()) != 1 ||
+		!net.VerifySig(&payerKey, fb, (*fb.Signatures())[0].Signature) {
+		t.Errorf("bad fee-bump signatures %s", net.TxToRep(fb))
+	}
+}
+
+func TestEnvelopeVersions(t *testing.T) {
+	net, _ := stctest.NewFakeNet()
+	sk := NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	self := sk.Public()
+	selfKey := self.ToSignerKey()
+	txe := testPayment(net, sk, 1)
+	txe.V1().Tx.Cond.Type = stx.PRECOND_TIME
+	txe.V1().Tx.Cond.TimeBounds().MaxTime = 1000
+	*txe.Signatures() = nil
+	net.SignTx(sk, txe)
+	v1bin := stcdetail.XdrToBin(txe)
+	hash := *stcdetail.TxPayloadHash(net.GetNetworkId(), txe)
+
+	if err := txe.ToV0(); err != nil {
+		t.Fatal(err)
+	} else if txe.Type != stx.ENVELOPE_TYPE_TX_V0 ||
+		txe.V0().Tx.TimeBounds == nil ||
+		txe.V0().Tx.TimeBounds.MaxTime != 1000 {
+		t.Errorf("bad V0 envelope %s", net.TxToRep(txe))
+	}
+	if h := stcdetail.TxPayloadHash(net.GetNetworkId(), txe); *h != hash {
+		t.Error("V0 envelope has different payload hash")
+	} else if !net.VerifySig(&selfKey, txe,
+		(*txe.Signatures())[0].Signature) {
+		t.Error("signature invalid after ToV0")
+	}
+
+	txe.ToV1()
+	if stcdetail.XdrToBin(txe) != v1bin {
+		t.Errorf("V1 round trip produced %s", net.TxToRep(txe))
+	} else if h := stcdetail.TxPayloadHash(net.GetNetworkId(),
+		txe); *h != hash {
+		t.Error("V1 envelope has different payload hash")
+	}
+
+	id := uint64(7)
+	txe.SetSourceAccount(MuxAcct(&self, &id))
+	if err := txe.ToV0(); err == nil {
+		t.Error("converted multiplexed source account to V0")
+	}
+	txe.SetSourceAccount(self)
+	txe.V1().Tx.Cond.Type = stx.PRECOND_V2
+	if err := txe.ToV0(); err == nil || txe.Type != stx.ENVELOPE_TYPE_TX {
+		t.Error("converted PRECOND_V2 to V0")
+	}
+}
+
 func TestParseTxrep(t *testing.T) {
 	var yourkey PublicKey
 	fmt.Sscan("GATPALHEEUERWYW275QDBNBMCM4KEHYJU34OPIZ6LKJAXK6B4IJ73V4L",
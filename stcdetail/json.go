@@ -48,7 +48,8 @@ func (i JsonInt64e7) MarshalText() ([]byte, error) {
 		return []byte(fmt.Sprintf("%d.%07d", int64(i)/10000000,
 			int64(i)%10000000)), nil
 	} else {
-		return []byte(fmt.Sprintf("%d.%07d", int64(i)/10000000,
+		// Written so that the sign survives when -1 < i/10^7 < 0
+		return []byte(fmt.Sprintf("-%d.%07d", -(int64(i) / 10000000),
 			-(int64(i) % 10000000))), nil
 	}
 }
@@ -115,6 +115,18 @@ needs to reconnect.
 
 */
 func Stream(ctx context.Context, url string,
+	cb func(eventType string, data []byte) error) error {
+	return StreamClient(ctx, http.DefaultClient, url, cb)
+}
+
+// Anything that can send an HTTP request, such as an *http.Client.
+type HTTPDoer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Like Stream, but sends requests through client instead of
+// http.DefaultClient.
+func StreamClient(ctx context.Context, client HTTPDoer, url string,
 	cb func(eventType string, data []byte) error) error {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -142,7 +154,7 @@ func Stream(ctx context.Context, url string,
 
 	for ctx.Err() == nil {
 		cleanup()
-		resp, err = http.DefaultClient.Do(req)
+		resp, err = client.Do(req)
 		if err != nil || ctx.Err() != nil {
 			return err
 		}
@@ -0,0 +1,523 @@
+// Helpers for testing code that uses the stc library without access
+// to a real Stellar network.
+package stctest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xdrpp/stc"
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+)
+
+// Network ID of the StellarNet returned by NewFakeNet.
+const FakeNetworkId = "stctest Fake Network ; January 2023"
+
+type fakeRecord struct {
+	token string
+	data  json.RawMessage
+}
+
+// An in-memory implementation of stc.NetBackend for deterministic
+// tests.  Tests populate the fake with accounts, fee statistics, and
+// collection records, then exercise code that uses a StellarNet whose
+// Backend field points to the fake.
+//
+// Post simulates transaction execution just enough to exercise
+// clients:  the source account must have been registered with
+// SetAccount and the transaction must have the next sequence number,
+// or else Post fails with TxNO_ACCOUNT or TxBAD_SEQ.  Otherwise, Post
+// closes a new ledger, bumps the account's sequence number, and
+// records the transaction so that it can be retrieved through
+// GetTxResult and the "transactions" and
+// "accounts/ACCOUNT/transactions" collections.  Operations are not
+// otherwise executed.  A Fake is safe for concurrent use.
+type Fake struct {
+	// Network with which to hash transactions.
+	Net *stc.StellarNet
+
+	// If non-nil, Post calls PostHook before checking sequence
+	// numbers.  If PostHook returns a non-nil result or error, Post
+	// uses that outcome instead of simulating execution.  Results
+	// with code TxSUCCESS or TxFAILED are recorded as transactions in
+	// a new ledger.  PostHook is called with the Fake locked, so must
+	// not call the Fake's methods.
+	PostHook func(e *stc.TransactionEnvelope) (
+		*stc.TransactionResult, error)
+
+	mu       sync.Mutex
+	ledger   stc.LedgerHeader
+	fees     *stc.FeeStats
+	accounts map[string]*stc.HorizonAccountEntry
+	txs      map[string]json.RawMessage
+	records  map[string][]fakeRecord
+	posted   []*stc.TransactionEnvelope
+	changed  chan struct{}
+}
+
+var _ stc.NetBackend = &Fake{}
+
+// Create a Fake and install it as the backend of net.
+func NewFake(net *stc.StellarNet) *Fake {
+	f := &Fake{
+		Net:      net,
+		accounts: make(map[string]*stc.HorizonAccountEntry),
+		txs:      make(map[string]json.RawMessage),
+		records:  make(map[string][]fakeRecord),
+		changed:  make(chan struct{}),
+	}
+	f.ledger.LedgerVersion = 19
+	f.ledger.LedgerSeq = 1
+	f.ledger.BaseFee = 100
+	f.ledger.BaseReserve = 5000000
+	f.ledger.MaxTxSetSize = 1000
+	f.ledger.ScpValue.CloseTime = stx.TimePoint(time.Date(
+		2023, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	f.addLedger()
+	net.Backend = f
+	return f
+}
+
+// Return a new StellarNet with network ID FakeNetworkId, backed by
+// a new Fake.
+func NewFakeNet() (*stc.StellarNet, *Fake) {
+	net := &stc.StellarNet{
+		Name:        "fake",
+		NetworkId:   FakeNetworkId,
+		NativeAsset: "FakeXLM",
+		Signers:     make(stc.SignerCache),
+		Accounts:    make(stc.AccountHints),
+	}
+	return net, NewFake(net)
+}
+
+func notFound(what string) error {
+	return &stc.HorizonProblem{
+		Type:   "https://stellar.org/horizon-errors/not_found",
+		Title:  "Resource Missing",
+		Status: http.StatusNotFound,
+		Detail: what + " not found",
+	}
+}
+
+// Wake up any streams waiting for new records.  Must be called with
+// f.mu held.
+func (f *Fake) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Create or replace an account, where acct is in strkey format.  The
+// entry is deep-copied, and its Account_id is set to acct.
+func (f *Fake) SetAccount(acct string, ae *stc.HorizonAccountEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	copy := ae.Copy()
+	copy.Net = nil
+	copy.Account_id.UnmarshalText([]byte(acct))
+	f.accounts[acct] = copy
+}
+
+// Set the result of GetFeeStats.  If never set, all fee percentiles
+// are the ledger's base fee.
+func (f *Fake) SetFeeStats(fs *stc.FeeStats) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fees = fs
+}
+
+// Replace the current ledger header, and add it to the "ledgers"
+// collection.  The next ledger closed by Post will be one higher than
+// lh.LedgerSeq.
+func (f *Fake) SetLedgerHeader(lh *stc.LedgerHeader) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ledger = *lh
+	f.addLedger()
+}
+
+// Add the current ledger to the "ledgers" collection.  Must be
+// called with f.mu held.
+func (f *Fake) addLedger() {
+	closeTime := time.Unix(int64(f.ledger.ScpValue.CloseTime), 0).UTC()
+	f.addRecord("ledgers", map[string]interface{}{
+		"sequence":   f.ledger.LedgerSeq,
+		"closed_at":  closeTime.Format("2006-01-02T15:04:05Z"),
+		"header_xdr": stcdetail.XdrToBase64(&f.ledger),
+		"paging_token": strconv.FormatInt(
+			int64(f.ledger.LedgerSeq)<<32, 10),
+	})
+}
+
+// Create an account with a particular native balance, as friendbot
+// does, in a new ledger.  As on the real network, the account's
+// sequence number is the ledger number shifted left 32 bits.
+func (f *Fake) Fund(acct string, balance stcdetail.JsonInt64e7) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ledger.LedgerSeq++
+	f.ledger.ScpValue.CloseTime += 5
+	f.addLedger()
+	seq := int64(f.ledger.LedgerSeq) << 32
+	ae := &stc.HorizonAccountEntry{
+		Sequence:             stcdetail.JsonInt64(seq),
+		Seq_ledger:           uint32(f.ledger.LedgerSeq),
+		Seq_time:             stcdetail.JsonInt64(f.ledger.ScpValue.CloseTime),
+		Balance:              balance,
+		Last_modified_ledger: uint32(f.ledger.LedgerSeq),
+	}
+	ae.Account_id.UnmarshalText([]byte(acct))
+	var master stc.SignerKey
+	if master.UnmarshalText([]byte(acct)) == nil {
+		ae.Signers = []stc.HorizonSigner{{
+			Key:    master,
+			Weight: 1,
+			Type:   "ed25519_public_key",
+		}}
+	}
+	f.accounts[acct] = ae
+}
+
+// Append a record to a collection such as "transactions" or
+// "accounts/ACCOUNT/payments", making it available to GetPage and
+// Stream.  rec must marshal to a JSON object.  If the object does
+// not have a paging_token field, one is added.  Returns the record's
+// paging token.
+func (f *Fake) AddRecord(collection string, rec interface{}) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addRecord(collection, rec)
+}
+
+func (f *Fake) addRecord(collection string, rec interface{}) string {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		panic(err)
+	}
+	var obj map[string]interface{}
+	if err = json.Unmarshal(data, &obj); err != nil {
+		panic(err)
+	}
+	collection = strings.Trim(collection, "/")
+	token, ok := obj["paging_token"].(string)
+	if !ok {
+		token = strconv.Itoa(len(f.records[collection]) + 1)
+		obj["paging_token"] = token
+		data, _ = json.Marshal(obj)
+	}
+	f.records[collection] = append(f.records[collection],
+		fakeRecord{token, data})
+	f.notify()
+	return token
+}
+
+// Return copies of all the transactions passed to Post (whether or
+// not they succeeded), as they were when submitted, in the order they
+// were submitted.
+func (f *Fake) Posted() []*stc.TransactionEnvelope {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*stc.TransactionEnvelope(nil), f.posted...)
+}
+
+func (f *Fake) GetAccountEntry(ctx context.Context, acct string) (
+	*stc.HorizonAccountEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ae, ok := f.accounts[acct]; ok {
+		return ae.Copy(), nil
+	}
+	return nil, notFound("account " + acct)
+}
+
+func (f *Fake) GetFeeStats(ctx context.Context) (*stc.FeeStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fees != nil {
+		copy := *f.fees
+		return &copy, nil
+	}
+	fee := stc.FeeVal(f.ledger.BaseFee)
+	dist := stc.FeeDist{Max: fee, Min: fee, Mode: fee}
+	for _, p := range []int{10, 20, 30, 40, 50, 60, 70, 80, 90, 95, 99} {
+		dist.Percentiles = append(dist.Percentiles,
+			stc.FeePercentile{Percentile: p, Fee: fee})
+	}
+	return &stc.FeeStats{
+		Last_ledger:          uint64(f.ledger.LedgerSeq),
+		Last_ledger_base_fee: fee,
+		Charged:              dist,
+		Offered:              dist,
+	}, nil
+}
+
+func (f *Fake) GetLedgerHeader(ctx context.Context) (
+	*stc.LedgerHeader, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	copy := f.ledger
+	return &copy, nil
+}
+
+// Return the source account and sequence number of a transaction.
+func txSource(e *stc.TransactionEnvelope) (string, stx.SequenceNumber) {
+	switch e.Type {
+	case stx.ENVELOPE_TYPE_TX_V0:
+		return e.SourceAccount().ToSignerKey().String(), e.V0().Tx.SeqNum
+	case stx.ENVELOPE_TYPE_TX:
+		acct, _ := stc.DemuxAcct(&e.V1().Tx.SourceAccount)
+		return acct.String(), e.V1().Tx.SeqNum
+	case stx.ENVELOPE_TYPE_TX_FEE_BUMP:
+		inner := &e.FeeBump().Tx.InnerTx.V1().Tx
+		acct, _ := stc.DemuxAcct(&inner.SourceAccount)
+		return acct.String(), inner.SeqNum
+	}
+	return "", 0
+}
+
+func (f *Fake) Post(ctx context.Context, e *stc.TransactionEnvelope) (
+	*stc.TransactionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Copy e, since callers such as StellarNet.PostCtx modify
+	// transactions in place when resubmitting them
+	posted, err := stc.TxFromBase64(stc.TxToBase64(e))
+	if err != nil {
+		return nil, err
+	}
+	f.posted = append(f.posted, posted)
+
+	var res *stc.TransactionResult
+	if f.PostHook != nil {
+		if res, err = f.PostHook(e); err != nil {
+			return nil, err
+		}
+	}
+	src, seq := txSource(e)
+	ae := f.accounts[src]
+	if res == nil {
+		res = &stc.TransactionResult{}
+		if ae == nil {
+			res.Result.Code = stx.TxNO_ACCOUNT
+		} else if seq != ae.NextSeq() {
+			res.Result.Code = stx.TxBAD_SEQ
+		} else {
+			res.Result.Code = stx.TxSUCCESS
+			ops := e.Operations()
+			if e.Type == stx.ENVELOPE_TYPE_TX_FEE_BUMP {
+				ops = &e.FeeBump().Tx.InnerTx.V1().Tx.Operations
+			}
+			opres := make([]stx.OperationResult, len(*ops))
+			for i := range *ops {
+				opres[i].Tr().Type = (*ops)[i].Body.Type
+			}
+			*res.Result.Results() = opres
+		}
+	}
+
+	switch res.Result.Code {
+	case stx.TxSUCCESS, stx.TxFAILED:
+		f.closeLedger(e, res, src)
+		if ae != nil && seq > stx.SequenceNumber(ae.Sequence) {
+			ae.Sequence = stcdetail.JsonInt64(seq)
+			ae.Seq_ledger = uint32(f.ledger.LedgerSeq)
+			ae.Seq_time = stcdetail.JsonInt64(f.ledger.ScpValue.CloseTime)
+		}
+	}
+	if res.Result.Code != stx.TxSUCCESS {
+		return nil, stc.TxFailure{TransactionResult: res}
+	}
+	return res, nil
+}
+
+// Close a new ledger containing a transaction, and record the
+// transaction.  Must be called with f.mu held.
+func (f *Fake) closeLedger(e *stc.TransactionEnvelope,
+	res *stc.TransactionResult, src string) {
+	f.ledger.LedgerSeq++
+	f.ledger.ScpValue.CloseTime += 5
+	f.addLedger()
+	closeTime := time.Unix(int64(f.ledger.ScpValue.CloseTime), 0).UTC()
+
+	var meta stx.TransactionMeta
+	var feeMeta stx.LedgerEntryChanges
+	txid := fmt.Sprintf("%x", *f.Net.HashTx(e))
+	rec := map[string]interface{}{
+		"hash":            txid,
+		"ledger":          f.ledger.LedgerSeq,
+		"created_at":      closeTime.Format("2006-01-02T15:04:05Z"),
+		"source_account":  src,
+		"successful":      res.Result.Code == stx.TxSUCCESS,
+		"envelope_xdr":    stcdetail.XdrToBase64(e),
+		"result_xdr":      stcdetail.XdrToBase64(res),
+		"result_meta_xdr": stcdetail.XdrToBase64(&meta),
+		"fee_meta_xdr": stcdetail.XdrToBase64(
+			stx.XDR_LedgerEntryChanges(&feeMeta)),
+		"paging_token": strconv.FormatInt(
+			int64(f.ledger.LedgerSeq)<<32, 10),
+	}
+	data, _ := json.Marshal(rec)
+	f.txs[txid] = data
+	f.addRecord("transactions", rec)
+	if src != "" {
+		f.addRecord("accounts/"+src+"/transactions", rec)
+	}
+}
+
+func (f *Fake) GetTxResult(ctx context.Context, txid string) (
+	*stc.HorizonTxResult, error) {
+	f.mu.Lock()
+	data, ok := f.txs[strings.ToLower(txid)]
+	f.mu.Unlock()
+	if !ok {
+		return nil, notFound("transaction " + txid)
+	}
+	var ret stc.HorizonTxResult
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// Find the position after the record with paging token cursor.  As
+// horizon's paging tokens are numeric, a numeric cursor that matches
+// no record (such as "0") selects the position after all records with
+// smaller numeric tokens.  Otherwise, returns -1 if there is no
+// record with the cursor as its paging token.  The second result is
+// true if a record's paging token matched the cursor exactly.
+func findCursor(recs []fakeRecord, cursor string) (int, bool) {
+	for i := range recs {
+		if recs[i].token == cursor {
+			return i + 1, true
+		}
+	}
+	c, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return -1, false
+	}
+	for i := range recs {
+		if t, err := strconv.ParseInt(recs[i].token, 10, 64); err == nil &&
+			t > c {
+			return i, false
+		}
+	}
+	return len(recs), false
+}
+
+func parseQuery(query string) (string, url.Values, error) {
+	u, err := url.Parse(query)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.Trim(u.Path, "/"), u.Query(), nil
+}
+
+func (f *Fake) GetPage(ctx context.Context, query string) (
+	[]json.RawMessage, string, error) {
+	collection, q, err := parseQuery(query)
+	if err != nil {
+		return nil, "", err
+	}
+	limit := 10
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil ||
+			limit < 1 || limit > 200 {
+			return nil, "", &stc.HorizonProblem{
+				Title:  "Bad Request",
+				Status: http.StatusBadRequest,
+				Detail: "invalid limit " + l,
+			}
+		}
+	}
+	desc := q.Get("order") == "desc"
+
+	f.mu.Lock()
+	recs := f.records[collection]
+	f.mu.Unlock()
+
+	pos := 0
+	if desc {
+		pos = len(recs)
+	}
+	if c := q.Get("cursor"); c != "" {
+		var exact bool
+		if pos, exact = findCursor(recs, c); pos < 0 {
+			return nil, "", &stc.HorizonProblem{
+				Title:  "Bad Request",
+				Status: http.StatusBadRequest,
+				Detail: "invalid cursor " + c,
+			}
+		} else if desc && exact {
+			// Records before the cursor record, not including it
+			pos--
+		}
+	}
+
+	var ret []json.RawMessage
+	cursor := q.Get("cursor")
+	for len(ret) < limit {
+		var r *fakeRecord
+		if desc && pos > 0 {
+			pos--
+			r = &recs[pos]
+		} else if !desc && pos < len(recs) {
+			r = &recs[pos]
+			pos++
+		} else {
+			break
+		}
+		ret = append(ret, r.data)
+		cursor = r.token
+	}
+	q.Set("cursor", cursor)
+	q.Set("limit", strconv.Itoa(limit))
+	return ret, collection + "?" + q.Encode(), nil
+}
+
+func (f *Fake) Stream(ctx context.Context, query string,
+	cb func(json.RawMessage) error) error {
+	collection, q, err := parseQuery(query)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	pos := len(f.records[collection])
+	if c := q.Get("cursor"); c != "" && c != "now" {
+		pos, _ = findCursor(f.records[collection], c)
+	}
+	f.mu.Unlock()
+	if pos < 0 {
+		return &stc.HorizonProblem{
+			Title:  "Bad Request",
+			Status: http.StatusBadRequest,
+			Detail: "invalid cursor " + q.Get("cursor"),
+		}
+	}
+
+	for {
+		f.mu.Lock()
+		recs := f.records[collection][pos:]
+		changed := f.changed
+		f.mu.Unlock()
+		for i := range recs {
+			if err := cb(recs[i].data); err != nil {
+				return err
+			}
+		}
+		pos += len(recs)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package stctest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/xdrpp/stc"
+	"github.com/xdrpp/stc/stx"
+)
+
+func TestFake(t *testing.T) {
+	net, fake := NewFakeNet()
+	sk := stc.NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519)
+	acct := sk.Public().String()
+	fake.SetAccount(acct, &stc.HorizonAccountEntry{Sequence: 10})
+
+	mktx := func(seq stx.SequenceNumber) *stc.TransactionEnvelope {
+		txe := stc.NewTransactionEnvelope()
+		txe.SetSourceAccount(sk.Public())
+		txe.V1().Tx.SeqNum = seq
+		txe.Append(nil, stc.BumpSequence{})
+		txe.SetFee(100)
+		net.SignTx(&sk, txe)
+		return txe
+	}
+
+	var txf stc.TxFailure
+	if _, err := net.Post(mktx(12)); !errors.As(err, &txf) ||
+		txf.Result.Code != stx.TxBAD_SEQ {
+		t.Errorf("expected TxBAD_SEQ, got %v", err)
+	}
+	for seq := stx.SequenceNumber(11); seq <= 13; seq++ {
+		if res, err := net.PostWait(nil, mktx(seq)); err != nil {
+			t.Fatal(err)
+		} else if res.Net != net || res.Ledger != uint32(seq-9) {
+			t.Errorf("transaction %d in wrong ledger %d", seq, res.Ledger)
+		}
+	}
+	if ae, err := net.GetAccountEntry(acct); err != nil {
+		t.Error(err)
+	} else if ae.NextSeq() != 14 {
+		t.Errorf("account has wrong next sequence number %d", ae.NextSeq())
+	}
+	if n := len(fake.Posted()); n != 4 {
+		t.Errorf("Posted returned %d transactions instead of 4", n)
+	}
+
+	var seqs []stx.SequenceNumber
+	var last string
+	if err := stc.Iterate(nil, net, "accounts/"+acct+"/transactions",
+		&stc.PageOptions{Order: "desc", PageSize: 2},
+		func(r *stc.HorizonTxResult, token string) error {
+			if last == "" {
+				last = token
+			}
+			seqs = append(seqs, r.Env.V1().Tx.SeqNum)
+			return nil
+		}); err != nil {
+		t.Error(err)
+	} else if len(seqs) != 3 || seqs[0] != 13 || seqs[2] != 11 {
+		t.Errorf("iterated over wrong transactions %v", seqs)
+	}
+
+	for _, tok := range []string{"10", "20", "30"} {
+		fake.AddRecord("effects", map[string]string{"paging_token": tok})
+	}
+	for cursor, want := range map[string]int{"20": 1, "25": 2, "99": 3} {
+		recs, _, err := fake.GetPage(context.Background(),
+			"effects?order=desc&cursor="+cursor)
+		if err != nil {
+			t.Error(err)
+		} else if len(recs) != want {
+			t.Errorf("desc page before %s has %d records instead of %d",
+				cursor, len(recs), want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan stx.SequenceNumber)
+	go stc.Stream(ctx, net, "transactions",
+		&stc.PageOptions{Cursor: last, Max: 1},
+		func(r *stc.HorizonTxResult, _ string) error {
+			got <- r.Env.V1().Tx.SeqNum
+			return nil
+		})
+	fake.AddRecord("operations", map[string]int{"id": 1})
+	net.Post(mktx(14))
+	if seq := <-got; seq != 14 {
+		t.Errorf("stream returned transaction %d instead of 14", seq)
+	}
+}
+
+func TestFakeAccountCopies(t *testing.T) {
+	net, fake := NewFakeNet()
+	acct := stc.NewPrivateKey(stx.PUBLIC_KEY_TYPE_ED25519).Public().String()
+	ae := &stc.HorizonAccountEntry{
+		Sequence: 10,
+		Balances: []stc.HorizonBalance{{Balance: 5}},
+		Data:     map[string]string{"k": "v"},
+	}
+	fake.SetAccount(acct, ae)
+	ae.Balances[0].Balance = 6
+	ae.Data["k"] = "w"
+
+	got, err := net.GetAccountEntry(acct)
+	if err != nil {
+		t.Fatal(err)
+	} else if got.Balances[0].Balance != 5 || got.Data["k"] != "v" {
+		t.Fatalf("SetAccount shares state with caller: %+v", got)
+	}
+	got.Balances[0].Balance = 7
+	got.Data["k"] = "x"
+	if got, err = net.GetAccountEntry(acct); err != nil {
+		t.Fatal(err)
+	} else if got.Balances[0].Balance != 5 || got.Data["k"] != "v" {
+		t.Errorf("GetAccountEntry shares state with caller: %+v", got)
+	}
+}
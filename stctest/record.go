@@ -0,0 +1,194 @@
+package stctest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// An HTTP exchange captured by a Recorder and served by a replay
+// server.
+type Fixture struct {
+	Method      string
+	URL         string
+	Body        string `json:",omitempty"`
+	Status      int
+	ContentType string `json:",omitempty"`
+	Response    string
+}
+
+func (fx *Fixture) key() string {
+	u, err := url.Parse(fx.URL)
+	if err != nil {
+		return ""
+	}
+	return fx.Method + " " + u.RequestURI() + "\n" + fx.Body
+}
+
+func (fx *Fixture) origin() string {
+	u, err := url.Parse(fx.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// An http.RoundTripper that records requests and responses as
+// fixtures, so that a test run against a real horizon server can be
+// replayed later without network access.  To record, set the Client
+// of a StellarNet to &http.Client{Transport: recorder}, then call
+// Save when done.  Responses are recorded when their bodies are
+// closed, so event streams are recorded up to the point where the
+// client stops reading them.
+type Recorder struct {
+	// Transport used to send requests, or nil for
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+
+	mu       sync.Mutex
+	fixtures []Fixture
+}
+
+type recordBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	done func(string)
+	once sync.Once
+}
+
+func (b *recordBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.buf.String()) })
+	return err
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	fx := Fixture{Method: req.Method, URL: req.URL.String()}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		fx.Body = string(body)
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	t := r.Transport
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	fx.Status = resp.StatusCode
+	fx.ContentType = resp.Header.Get("Content-Type")
+	resp.Body = &recordBody{
+		ReadCloser: resp.Body,
+		done: func(body string) {
+			fx.Response = body
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.fixtures = append(r.fixtures, fx)
+		},
+	}
+	return resp, nil
+}
+
+// Return the fixtures recorded so far.
+func (r *Recorder) Fixtures() []Fixture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Fixture(nil), r.fixtures...)
+}
+
+// Write the fixtures recorded so far to a JSON file.
+func (r *Recorder) Save(path string) error {
+	data, err := json.MarshalIndent(r.Fixtures(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0666)
+}
+
+// Read fixtures saved by Recorder.Save.
+func LoadFixtures(path string) ([]Fixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Fixture
+	if err = json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Start a server that replays fixtures.  A request is answered by a
+// fixture with the same method, path, query, and body.  If several
+// fixtures match, they are returned in the order recorded, after
+// which the last one is repeated.  References to the recorded
+// server's URL in responses (such as links to the next page of a
+// collection) are rewritten to refer to the replay server.  Event
+// streams are held open after the recorded events until the client
+// disconnects.  Requests that do not match any fixture fail with
+// status 404.
+func NewReplayServer(fixtures []Fixture) *httptest.Server {
+	var mu sync.Mutex
+	byKey := make(map[string][]*Fixture)
+	for i := range fixtures {
+		k := fixtures[i].key()
+		byKey[k] = append(byKey[k], &fixtures[i])
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			k := r.Method + " " + r.URL.RequestURI() + "\n" + string(body)
+			mu.Lock()
+			fxs := byKey[k]
+			var fx *Fixture
+			if len(fxs) > 0 {
+				fx = fxs[0]
+				if len(fxs) > 1 {
+					byKey[k] = fxs[1:]
+				}
+			}
+			mu.Unlock()
+			if fx == nil {
+				writeError(w, notFound("fixture for "+r.URL.String()), "")
+				return
+			}
+
+			if fx.ContentType != "" {
+				w.Header().Set("Content-Type", fx.ContentType)
+			}
+			w.WriteHeader(fx.Status)
+			resp := fx.Response
+			if o := fx.origin(); o != "" {
+				resp = strings.ReplaceAll(resp, o, srv.URL)
+			}
+			io.WriteString(w, resp)
+			if strings.HasPrefix(fx.ContentType, "text/event-stream") {
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+				<-r.Context().Done()
+			}
+		}))
+	return srv
+}
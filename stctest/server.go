@@ -0,0 +1,319 @@
+package stctest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/xdrpp/goxdr/xdr"
+	"github.com/xdrpp/stc"
+	"github.com/xdrpp/stc/stcdetail"
+	"github.com/xdrpp/stc/stx"
+)
+
+// An HTTP server that emulates the parts of the horizon REST API used
+// by package stc, serving the state of a Fake.  Unlike installing the
+// Fake as a StellarNet's Backend, using a Server exercises stc's
+// HTTP code.  The server handles the following requests:
+//
+//	GET  /                          network passphrase
+//	GET  /accounts/ACCOUNT          accounts set with SetAccount or Fund
+//	GET  /transactions/TXHASH       transactions submitted to the Fake
+//	GET  /ledgers/LEDGER            ledgers added by SetLedgerHeader,
+//	                                Fund, or Post
+//	POST /transactions              transaction submission
+//	GET  /fee_stats                 fee statistics
+//	GET  /friendbot?addr=ACCOUNT    create an account with 10,000 XLM
+//	GET  /COLLECTION                pages of records (see Fake.AddRecord)
+//
+// Requests for collections with header "Accept: text/event-stream"
+// are streamed as server-sent events.
+type Server struct {
+	*httptest.Server
+	Fake *Fake
+}
+
+// Start a Server for f.  Call Close when done with the server.
+func NewServer(f *Fake) *Server {
+	s := &Server{Fake: f}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Start a Server with a new Fake, and return a StellarNet that uses
+// the server as its horizon.
+func NewFakeHorizon() (*stc.StellarNet, *Server) {
+	_, f := NewFakeNet()
+	s := NewServer(f)
+	return s.StellarNet(), s
+}
+
+// Return a new StellarNet that uses the server as its horizon.
+func (s *Server) StellarNet() *stc.StellarNet {
+	return &stc.StellarNet{
+		Name:        s.Fake.Net.Name,
+		NetworkId:   s.Fake.Net.NetworkId,
+		NativeAsset: s.Fake.Net.NativeAsset,
+		Horizon:     s.URL + "/",
+		Signers:     make(stc.SignerCache),
+		Accounts:    make(stc.AccountHints),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusOK {
+		w.Header().Set("Content-Type", "application/hal+json")
+	} else {
+		w.Header().Set("Content-Type", "application/problem+json")
+	}
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Convert an XDR result code name such as txBAD_SEQ to horizon's
+// format (tx_bad_seq).
+func horizonCode(name string) string {
+	for _, prefix := range []string{"tx", "op"} {
+		if strings.HasPrefix(name, prefix) {
+			return prefix + "_" + strings.ToLower(name[len(prefix):])
+		}
+	}
+	return strings.ToLower(name)
+}
+
+func resultCodes(res *stc.TransactionResult) map[string]interface{} {
+	ret := map[string]interface{}{
+		"transaction": horizonCode(res.Result.Code.String()),
+	}
+	if res.Result.Code != stx.TxFAILED {
+		return ret
+	}
+	var ops []string
+	for _, r := range *res.Result.Results() {
+		if r.Code != stx.OpINNER {
+			ops = append(ops, horizonCode(r.Code.String()))
+		} else if u, ok := r.Tr().XdrUnionBody().(xdr.XdrUnion); ok {
+			code := strings.TrimPrefix(u.XdrUnionTag().String(),
+				r.Tr().Type.String()+"_")
+			ops = append(ops, "op_"+strings.ToLower(code))
+		}
+	}
+	ret["operations"] = ops
+	return ret
+}
+
+func writeError(w http.ResponseWriter, err error, env string) {
+	var p *stc.HorizonProblem
+	var txf stc.TxFailure
+	switch {
+	case errors.As(err, &txf):
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"type":   "https://stellar.org/horizon-errors/transaction_failed",
+			"title":  "Transaction Failed",
+			"status": http.StatusBadRequest,
+			"detail": txf.Error(),
+			"extras": map[string]interface{}{
+				"envelope_xdr": env,
+				"result_xdr":   stcdetail.XdrToBase64(txf.TransactionResult),
+				"result_codes": resultCodes(txf.TransactionResult),
+			},
+		})
+	case errors.As(err, &p):
+		writeJSON(w, p.Status, map[string]interface{}{
+			"type":   p.Type,
+			"title":  p.Title,
+			"status": p.Status,
+			"detail": p.Detail,
+		})
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"type":   "https://stellar.org/horizon-errors/bad_request",
+			"title":  "Bad Request",
+			"status": http.StatusBadRequest,
+			"detail": err.Error(),
+		})
+	}
+}
+
+func feeDistJSON(fd *stc.FeeDist) interface{} {
+	ret := map[string]string{
+		"max":  fmt.Sprint(fd.Max),
+		"min":  fmt.Sprint(fd.Min),
+		"mode": fmt.Sprint(fd.Mode),
+	}
+	for _, p := range fd.Percentiles {
+		ret[fmt.Sprintf("p%d", p.Percentile)] = fmt.Sprint(p.Fee)
+	}
+	return ret
+}
+
+// Render fee statistics in horizon's JSON format.
+func feeStatsJSON(fs *stc.FeeStats) interface{} {
+	return map[string]interface{}{
+		"last_ledger":           fmt.Sprint(fs.Last_ledger),
+		"last_ledger_base_fee":  fmt.Sprint(fs.Last_ledger_base_fee),
+		"ledger_capacity_usage": fmt.Sprint(fs.Ledger_capacity_usage),
+		"fee_charged":           feeDistJSON(&fs.Charged),
+		"max_fee":               feeDistJSON(&fs.Offered),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f := s.Fake
+	ctx := r.Context()
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "":
+		lh, _ := f.GetLedgerHeader(ctx)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"horizon_version":                 "stctest",
+			"network_passphrase":              f.Net.NetworkId,
+			"history_latest_ledger":           lh.LedgerSeq,
+			"core_supported_protocol_version": lh.LedgerVersion,
+		})
+	case path == "fee_stats":
+		if fs, err := f.GetFeeStats(ctx); err != nil {
+			writeError(w, err, "")
+		} else {
+			writeJSON(w, http.StatusOK, feeStatsJSON(fs))
+		}
+	case path == "friendbot":
+		var acct stc.AccountID
+		addr := r.FormValue("addr")
+		if _, err := fmt.Sscan(addr, &acct); err != nil {
+			writeError(w, err, "")
+			return
+		}
+		f.Fund(acct.String(), 10000*10000000)
+		lh, _ := f.GetLedgerHeader(ctx)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"successful": true,
+			"ledger":     lh.LedgerSeq,
+		})
+	case path == "transactions" && r.Method == "POST":
+		s.submit(w, r)
+	case len(parts) == 2 && parts[0] == "accounts":
+		if ae, err := f.GetAccountEntry(ctx, parts[1]); err != nil {
+			writeError(w, err, "")
+		} else {
+			writeJSON(w, http.StatusOK, ae)
+		}
+	case len(parts) == 2 && parts[0] == "ledgers":
+		if data := s.ledger(parts[1]); data == nil {
+			writeError(w, notFound("ledger "+parts[1]), "")
+		} else {
+			writeJSON(w, http.StatusOK, data)
+		}
+	case len(parts) == 2 && parts[0] == "transactions":
+		f.mu.Lock()
+		data, ok := f.txs[strings.ToLower(parts[1])]
+		f.mu.Unlock()
+		if !ok {
+			writeError(w, notFound("transaction "+parts[1]), "")
+		} else {
+			writeJSON(w, http.StatusOK, data)
+		}
+	case r.Header.Get("Accept") == "text/event-stream":
+		s.stream(w, r)
+	default:
+		s.page(w, r)
+	}
+}
+
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	env := r.FormValue("tx")
+	e, err := stc.TxFromBase64(env)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"type":   "https://stellar.org/horizon-errors/transaction_malformed",
+			"title":  "Transaction Malformed",
+			"status": http.StatusBadRequest,
+			"detail": err.Error(),
+			"extras": map[string]interface{}{
+				"envelope_xdr": env,
+			},
+		})
+		return
+	}
+	if _, err = s.Fake.Post(r.Context(), e); err != nil {
+		writeError(w, err, env)
+		return
+	}
+	txid := fmt.Sprintf("%x", *s.Fake.Net.HashTx(e))
+	s.Fake.mu.Lock()
+	data := s.Fake.txs[txid]
+	s.Fake.mu.Unlock()
+	writeJSON(w, http.StatusOK, data)
+}
+
+// Return the record for a ledger in the "ledgers" collection, or nil.
+func (s *Server) ledger(seq string) json.RawMessage {
+	s.Fake.mu.Lock()
+	defer s.Fake.mu.Unlock()
+	for _, r := range s.Fake.records["ledgers"] {
+		var l struct{ Sequence json.Number }
+		if json.Unmarshal(r.data, &l) == nil && l.Sequence.String() == seq {
+			return r.data
+		}
+	}
+	return nil
+}
+
+func (s *Server) page(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimPrefix(r.URL.RequestURI(), "/")
+	recs, next, err := s.Fake.GetPage(r.Context(), query)
+	if err != nil {
+		writeError(w, err, "")
+		return
+	}
+	if recs == nil {
+		recs = []json.RawMessage{}
+	}
+	base := s.URL + "/"
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"_links": map[string]interface{}{
+			"self": map[string]string{"href": base + query},
+			"next": map[string]string{"href": base + next},
+		},
+		"_embedded": map[string]interface{}{
+			"records": recs,
+		},
+	})
+}
+
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 1000\nevent: open\ndata: \"hello\"\n\n")
+	flusher.Flush()
+	query := strings.TrimPrefix(r.URL.RequestURI(), "/")
+	s.Fake.Stream(r.Context(), query, func(data json.RawMessage) error {
+		var pt struct {
+			Paging_token string
+		}
+		json.Unmarshal(data, &pt)
+		event := strings.Builder{}
+		if pt.Paging_token != "" {
+			fmt.Fprintf(&event, "id: %s\n", pt.Paging_token)
+		}
+		fmt.Fprintf(&event, "data: %s\n\n", data)
+		if _, err := fmt.Fprint(w, event.String()); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/xdrpp/stc/ini"
 	"github.com/xdrpp/stc/stcdetail"
 	"github.com/xdrpp/stc/stx"
+	"net/http"
 	"strings"
 	"time"
 )
@@ -24,6 +25,19 @@ type StellarNet struct {
 	// Base URL of horizon (including trailing slash).
 	Horizon string
 
+	// URL of a Stellar RPC server (optional).  See RPCClient.
+	RPC string
+
+	// Base URLs of several horizon servers for the network, used
+	// instead of Horizon if non-empty.  Requests go to the healthy
+	// server with the lowest latency and fail over to the others on
+	// temporary errors.  See CheckEndpoints.
+	HorizonURLs []string
+
+	// URLs of several RPC servers, used instead of RPC if non-empty,
+	// with failover as for HorizonURLs.
+	RPCURLs []string
+
 	// Set of signers to recognize when checking signatures on
 	// transactions and annotations to show when printing signers.
 	Signers SignerCache
@@ -41,6 +55,48 @@ type StellarNet struct {
 	// Cache of fee stats
 	FeeCache     *FeeStats
 	FeeCacheTime time.Time
+
+	// How to choose transaction fees.  If nil, uses DefaultFeePolicy.
+	FeePolicy *FeePolicy
+
+	// Cache of account entries, or nil to fetch accounts every time.
+	AccountCache *AccountCache
+
+	// HTTP client used for requests to horizon, or nil to use
+	// http.DefaultClient.  To use a custom RoundTripper, set the
+	// client's Transport field.
+	Client *http.Client
+
+	// If non-zero, the time limit for each individual request to
+	// horizon (not counting event streams, which are long-lived).
+	Timeout time.Duration
+
+	// Extra headers to send with every request to horizon, such as
+	// API keys required by an authenticated gateway.
+	Header http.Header
+
+	// User-Agent header for requests to horizon.  If empty, uses
+	// DefaultUserAgent.
+	UserAgent string
+
+	// How to retry requests that fail with temporary errors.  If nil,
+	// uses DefaultRetryPolicy.
+	Retry *RetryPolicy
+
+	// How to resubmit transactions that fail with txBAD_SEQ or
+	// txINSUFFICIENT_FEE.  If nil, Post does not resubmit
+	// transactions.
+	Resubmit *ResubmitPolicy
+
+	// Implementation of network operations.  If nil, uses
+	// HorizonBackend.
+	Backend NetBackend
+
+	// Health and latency of HorizonURLs and RPCURLs
+	endpoints *endpointState
+
+	// Request quota of each server, keyed by base URL
+	rate map[string]*rateLimiter
 }
 
 func (net *StellarNet) AddHint(acct string, hint string) {
@@ -0,0 +1,144 @@
+package stc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/xdrpp/stc/stx"
+)
+
+// How often PostWait polls horizon for the result of a pending
+// transaction.
+var PostWaitInterval = 2 * time.Second
+
+// Returned by PostWait when the network has closed a ledger after
+// the transaction's maximum time bound without including the
+// transaction.  Such a transaction can never execute, so it is safe
+// to build and submit a replacement.
+var ErrTxExpired error = horizonFailure(
+	"Transaction time bounds expired before it was included in a ledger")
+
+// Return the maximum time bound of a transaction, or 0 if it has
+// none.
+func txMaxTime(e *TransactionEnvelope) uint64 {
+	var tb *stx.TimeBounds
+	switch e.Type {
+	case stx.ENVELOPE_TYPE_TX_V0:
+		tb = e.V0().Tx.TimeBounds
+	case stx.ENVELOPE_TYPE_TX:
+		tb = condTimeBounds(&e.V1().Tx.Cond)
+	case stx.ENVELOPE_TYPE_TX_FEE_BUMP:
+		tb = condTimeBounds(&e.FeeBump().Tx.InnerTx.V1().Tx.Cond)
+	}
+	if tb == nil {
+		return 0
+	}
+	return uint64(tb.MaxTime)
+}
+
+func condTimeBounds(cond *stx.Preconditions) *stx.TimeBounds {
+	switch cond.Type {
+	case stx.PRECOND_TIME:
+		return cond.TimeBounds()
+	case stx.PRECOND_V2:
+		return cond.V2().TimeBounds
+	}
+	return nil
+}
+
+// Returns true if an error from submitting a transaction leaves its
+// fate unknown, meaning the transaction may still make it into a
+// ledger.
+func postPending(err error) bool {
+	var p *HorizonProblem
+	if errors.As(err, &p) {
+		return p.Status == http.StatusGatewayTimeout || p.Temporary()
+	}
+	return IsTemporary(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Look up a transaction by hash.  Returns nil, nil if horizon does
+// not (yet) know about the transaction or if the lookup failed with
+// a temporary error.
+func (net *StellarNet) lookupTx(ctx context.Context, txid string) (
+	*HorizonTxResult, error) {
+	res, err := net.GetTxResultCtx(ctx, txid)
+	var p *HorizonProblem
+	switch {
+	case err == nil:
+		net.AccountCache.InvalidateMetas(
+			stx.XDR_LedgerEntryChanges(&res.FeeMeta), &res.ResultMeta)
+		if res.Result.Result.Code != stx.TxSUCCESS {
+			return res, TxFailure{&res.Result}
+		}
+		return res, nil
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case errors.As(err, &p) && p.Status == http.StatusNotFound,
+		postPending(err):
+		return nil, nil
+	}
+	return nil, err
+}
+
+// Submit a transaction and wait for it to be included in a ledger.
+// Unlike Post, PostWait does not give up when horizon times out
+// waiting for the transaction to execute (status 504).  Instead, it
+// polls horizon for the transaction's result by hash until the
+// transaction appears in a ledger, the network closes a ledger past
+// the transaction's maximum time bound (in which case the error is
+// ErrTxExpired), or ctx is done.  Because PostWait first checks
+// whether the transaction has already executed, it is safe to call
+// again with the same transaction after a failure.
+//
+// If the transaction executes but fails, PostWait returns both the
+// HorizonTxResult and a TxFailure error.
+func (net *StellarNet) PostWait(ctx context.Context,
+	e *TransactionEnvelope) (*HorizonTxResult, error) {
+	ctx = ctxOrBackground(ctx)
+	txid := fmt.Sprintf("%x", *net.HashTx(e))
+	if res, err := net.lookupTx(ctx, txid); res != nil || err != nil {
+		return res, err
+	}
+
+	_, err := net.PostCtx(ctx, e)
+	// With net.Resubmit, PostCtx may have changed the transaction
+	txid = fmt.Sprintf("%x", *net.HashTx(e))
+	if err != nil {
+		var txf TxFailure
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if errors.As(err, &txf) &&
+			txf.Result.Code == stx.TxBAD_SEQ {
+			// Possibly an earlier submission already executed
+			if res, err2 := net.lookupTx(ctx, txid); res != nil {
+				return res, err2
+			}
+			return nil, err
+		} else if !postPending(err) {
+			return nil, err
+		}
+	}
+
+	maxTime := txMaxTime(e)
+	for {
+		expired := false
+		if maxTime != 0 && uint64(time.Now().Unix()) > maxTime {
+			// Local clocks may be off, so ask the network
+			if lh, err := net.GetLedgerHeaderCtx(ctx); err == nil {
+				expired = uint64(lh.ScpValue.CloseTime) > maxTime
+			}
+		}
+		if res, err := net.lookupTx(ctx, txid); res != nil || err != nil {
+			return res, err
+		} else if expired {
+			return nil, ErrTxExpired
+		}
+		if err := sleepCtx(ctx, PostWaitInterval); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -220,15 +220,28 @@ func (txe *TransactionEnvelope) Append(
 	})
 }
 
+// Return the number of operations a transaction pays fees for, which
+// for a fee-bump transaction includes the fee bump itself.
+func feeOps(e *stx.TransactionEnvelope) int64 {
+	if e.Type == stx.ENVELOPE_TYPE_TX_FEE_BUMP {
+		return int64(len(e.FeeBump().Tx.InnerTx.V1().Tx.Operations)) + 1
+	} else if ops := e.Operations(); ops != nil && len(*ops) > 0 {
+		return int64(len(*ops))
+	}
+	return 1
+}
+
 // Set the fee of a transaction to baseFee times the number of
 // operations.  If the result would exceed the maximum fee of
 // 0xffffffff (~430 XLM), then just set the fee to 0xffffffff.
 // (Obviously only call this once you have finished adding operations
-// to the transaction with Append.)
+// to the transaction with Append.)  A fee-bump transaction counts as
+// one more operation than its inner transaction, and its fee is not
+// limited to 0xffffffff.
 func (txe *TransactionEnvelope) SetFee(baseFee uint32) {
 	if txe.Type == stx.ENVELOPE_TYPE_TX_FEE_BUMP {
 		txe.FeeBump().Tx.Fee = int64(baseFee) *
-			int64(len(txe.FeeBump().Tx.InnerTx.V1().Tx.Operations))
+			feeOps(txe.TransactionEnvelope)
 		return
 	}
 	if ops := txe.Operations(); ops != nil {
@@ -282,6 +295,128 @@ func (txe *TransactionEnvelope) SetSourceAccount(m0 stx.IsAccount) {
 	}
 }
 
+// Return a V1 envelope equivalent to a legacy V0 envelope.  The
+// result shares operations and signatures with v0.
+func v0ToV1(v0 *stx.TransactionV0Envelope) *stx.TransactionV1Envelope {
+	ret := &stx.TransactionV1Envelope{Signatures: v0.Signatures}
+	tx := &ret.Tx
+	tx.SourceAccount.Type = stx.KEY_TYPE_ED25519
+	*tx.SourceAccount.Ed25519() = v0.Tx.SourceAccountEd25519
+	tx.Fee = v0.Tx.Fee
+	tx.SeqNum = v0.Tx.SeqNum
+	if v0.Tx.TimeBounds != nil {
+		tx.Cond.Type = stx.PRECOND_TIME
+		*tx.Cond.TimeBounds() = *v0.Tx.TimeBounds
+	}
+	tx.Memo = v0.Tx.Memo
+	tx.Operations = v0.Tx.Operations
+	return ret
+}
+
+// Convert a legacy ENVELOPE_TYPE_TX_V0 transaction to an
+// ENVELOPE_TYPE_TX transaction in place.  Other envelope types are
+// left unchanged.  Existing signatures remain valid, because the
+// network signs V0 transactions by hashing them as the equivalent V1
+// transaction, so both versions have the same signature payload.
+func (txe *TransactionEnvelope) ToV1() {
+	if txe.Type != stx.ENVELOPE_TYPE_TX_V0 {
+		return
+	}
+	v1 := v0ToV1(txe.V0())
+	txe.Type = stx.ENVELOPE_TYPE_TX
+	*txe.V1() = *v1
+}
+
+// Convert an ENVELOPE_TYPE_TX transaction to a legacy
+// ENVELOPE_TYPE_TX_V0 transaction in place, leaving existing
+// signatures valid (see ToV1).  This is only possible when the source
+// account is a plain (not multiplexed) ed25519 account and the only
+// precondition, if any, is a time bound.  Returns an error without
+// changing the transaction if it cannot be converted.  A V0
+// transaction is left unchanged.
+func (txe *TransactionEnvelope) ToV0() error {
+	switch txe.Type {
+	case stx.ENVELOPE_TYPE_TX_V0:
+		return nil
+	case stx.ENVELOPE_TYPE_TX:
+	default:
+		return fmt.Errorf("cannot convert %s to ENVELOPE_TYPE_TX_V0",
+			txe.Type)
+	}
+	v1 := txe.V1()
+	if v1.Tx.SourceAccount.Type != stx.KEY_TYPE_ED25519 {
+		return fmt.Errorf("ENVELOPE_TYPE_TX_V0 does not support " +
+			"multiplexed source accounts")
+	}
+	v0 := stx.TransactionV0Envelope{Signatures: v1.Signatures}
+	switch v1.Tx.Cond.Type {
+	case stx.PRECOND_NONE:
+	case stx.PRECOND_TIME:
+		tb := *v1.Tx.Cond.TimeBounds()
+		v0.Tx.TimeBounds = &tb
+	default:
+		return fmt.Errorf("ENVELOPE_TYPE_TX_V0 does not support %s",
+			v1.Tx.Cond.Type)
+	}
+	v0.Tx.SourceAccountEd25519 = *v1.Tx.SourceAccount.Ed25519()
+	v0.Tx.Fee = v1.Tx.Fee
+	v0.Tx.SeqNum = v1.Tx.SeqNum
+	v0.Tx.Memo = v1.Tx.Memo
+	v0.Tx.Operations = v1.Tx.Operations
+	txe.Type = stx.ENVELOPE_TYPE_TX_V0
+	*txe.V0() = v0
+	return nil
+}
+
+// Return the lowest base fee a fee-bump transaction around inner can
+// offer, which is inner's fee per operation rounded up.
+func minFeeBumpBaseFee(inner *stx.TransactionV1Envelope) uint32 {
+	ops := uint32(len(inner.Tx.Operations))
+	if ops == 0 {
+		return inner.Tx.Fee
+	}
+	return uint32((uint64(inner.Tx.Fee) + uint64(ops) - 1) / uint64(ops))
+}
+
+// Wrap a transaction in a fee-bump transaction whose fee is paid by
+// feeSource.  The inner transaction, including its signatures, is
+// copied unchanged.  The fee is set to baseFee per operation
+// (counting the fee bump as an operation, as with SetFee), but never
+// less than the inner transaction's fee per operation, since the
+// network rejects fee bumps that lower the fee rate.  The fee-bump
+// transaction is not signed.  A legacy V0 transaction is converted to
+// V1 as with ToV1 (leaving e unchanged).  Panics if e is already a
+// fee-bump transaction.
+func NewFeeBump(e *TransactionEnvelope, feeSource stx.IsAccount,
+	baseFee uint32) *TransactionEnvelope {
+	var inner *stx.TransactionV1Envelope
+	switch e.Type {
+	case stx.ENVELOPE_TYPE_TX:
+		inner = e.V1()
+	case stx.ENVELOPE_TYPE_TX_V0:
+		inner = v0ToV1(e.V0())
+	default:
+		xdr.XdrPanic("NewFeeBump: cannot wrap envelope type %s", e.Type)
+	}
+	ret := &TransactionEnvelope{
+		TransactionEnvelope: &stx.TransactionEnvelope{
+			Type: stx.ENVELOPE_TYPE_TX_FEE_BUMP,
+		},
+	}
+	fb := &ret.FeeBump().Tx
+	fb.FeeSource = *feeSource.ToMuxedAccount()
+	fb.InnerTx.Type = stx.ENVELOPE_TYPE_TX
+	if err := stcdetail.XdrFromBin(fb.InnerTx.V1(),
+		stcdetail.XdrToBin(inner)); err != nil {
+		panic(err)
+	}
+	if min := minFeeBumpBaseFee(fb.InnerTx.V1()); baseFee < min {
+		baseFee = min
+	}
+	ret.SetFee(baseFee)
+	return ret
+}
+
 func (txe *TransactionEnvelope) GetHelp(name string) bool {
 	_, ok := txe.Help[name]
 	return ok